@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// --- Admin Accounts ---
+// Admins log in with a named account and password. Passwords are stored as bcrypt hashes in
+// the admin_accounts table. Each account has a role:
+//
+//	viewer    stats, the audit log and read-only views of the admin pages
+//	operator  also changes triggers, zones, maintenance mode, simulation and vouchers
+//	owner     also manages users and admin accounts
+//
+// The first owner is created on the command line with "dashboard create-admin". Until an
+// account exists, the shared ADMIN_SECRET_KEY still works and logs in as an owner; once one
+// does, the shared key is refused. Admin sessions are users with is_admin set, and those that
+// belong to an account record it in users.admin_account, so changing an account's role or
+// deleting it takes effect on its sessions immediately. Sessions started from an admin invite
+// (see invites.go) have the invite's role. Other admins without an account (shared key sessions
+// and users promoted with /api/admin/users) are owners.
+
+// Admin roles, from least to most privileged.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleOwner    = "owner"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleOwner: 3}
+
+const minAdminPasswordLength = 8
+
+// dummyPasswordHash is compared against when a login names an unknown account, so it takes as
+// long as a wrong password and doesn't reveal which accounts exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// adminAccount is an admin account as listed by /api/admin/accounts. The hash is never sent.
+type adminAccount struct {
+	Username    string     `json:"username"`
+	Role        string     `json:"role"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CreatedBy   string     `json:"created_by"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// hasRole reports whether the user is an admin with at least the given role.
+func (u *User) hasRole(role string) bool {
+	return u.IsAdmin && roleRank[u.Role] >= roleRank[role]
+}
+
+// actor identifies an admin in the audit log and updated_by columns: the account name, or the
+// user ID for admins without an account.
+func (u *User) actor() string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.ID
+}
+
+// resolveAdminRole sets a user's role: their admin account's role, or for a session without an
+// account, the role it was created with (owner if none). An admin whose account has been
+// deleted is no longer an admin.
+func resolveAdminRole(user *User, account, accountRole, sessionRole string) {
+	switch {
+	case !user.IsAdmin:
+		user.Role = ""
+	case account == "" && sessionRole != "":
+		user.Role = sessionRole
+	case account == "":
+		user.Role = roleOwner
+	case accountRole == "":
+		user.IsAdmin = false
+		user.Role = ""
+	default:
+		user.Username = account
+		user.Role = accountRole
+	}
+}
+
+// requireRole returns the user making the request if they are an admin with at least role, and
+// otherwise answers with 403.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) (*User, bool) {
+	user, ok := r.Context().Value(userContextKey).(*User)
+	if !ok || !user.IsAdmin {
+		http.Error(w, "Forbidden: Admins only", http.StatusForbidden)
+		return nil, false
+	}
+	if !user.hasRole(role) {
+		http.Error(w, fmt.Sprintf("Forbidden: requires the %s role", role), http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// writeRole is the role a request needs: viewer to read, and role to change anything.
+func writeRole(r *http.Request, role string) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return roleViewer
+	}
+	return role
+}
+
+func validateAdminAccount(username, password, role string) error {
+	if username == "" || len(username) > 64 || strings.IndexFunc(username, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' || r == '@')
+	}) >= 0 {
+		return errors.New("username must be 1-64 letters, digits or . _ - @")
+	}
+	if password != "" && len(password) < minAdminPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minAdminPasswordLength)
+	}
+	if role != "" && roleRank[role] == 0 {
+		return fmt.Errorf("role must be %s, %s or %s", roleViewer, roleOperator, roleOwner)
+	}
+	return nil
+}
+
+// hasAdminAccounts reports whether any admin account exists. The shared admin key only works
+// while none do.
+func (app *App) hasAdminAccounts() (bool, error) {
+	var exists bool
+	err := app.db.QueryRow("SELECT EXISTS (SELECT 1 FROM admin_accounts)").Scan(&exists)
+	return exists, err
+}
+
+// sharedAdminKeyValid reports whether key is the shared admin key and the shared key may still
+// be used.
+func (app *App) sharedAdminKeyValid(key string) bool {
+	if subtle.ConstantTimeCompare([]byte(key), []byte(app.settings.AdminSecretKey)) != 1 {
+		return false
+	}
+	hasAccounts, err := app.hasAdminAccounts()
+	if err != nil {
+		log.Printf("ERROR: could not check for admin accounts: %v", err)
+		return false
+	}
+	return !hasAccounts
+}
+
+// authenticateAdmin checks a username and password and returns the account's role, or "" if
+// they don't match.
+func (app *App) authenticateAdmin(username, password string) (string, error) {
+	var hash, role string
+	err := app.db.QueryRow("SELECT password_hash, role FROM admin_accounts WHERE username = ?", username).Scan(&hash, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", nil
+	}
+	if _, err := app.db.Exec("UPDATE admin_accounts SET last_login_at = CURRENT_TIMESTAMP WHERE username = ?", username); err != nil {
+		log.Printf("ERROR: could not record login of admin %s: %v", username, err)
+	}
+	return role, nil
+}
+
+// saveAdminAccount creates an account or, if it exists, changes its password and role. It
+// returns whether the account was created.
+func saveAdminAccount(db *sql.DB, actor, username, password, role string) (bool, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM admin_accounts WHERE username = ?)", username).Scan(&exists); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`INSERT INTO admin_accounts (username, password_hash, role, created_by) VALUES (?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role`, username, string(hash), role, actor)
+	if err != nil {
+		return false, err
+	}
+	action := "account.create"
+	if exists {
+		action = "account.update"
+	}
+	if err := recordAudit(tx, actor, action, username, map[string]string{"role": role}); err != nil {
+		return false, err
+	}
+	return !exists, tx.Commit()
+}
+
+// countOtherOwners counts the owner accounts other than username, so the last owner can't be
+// demoted or deleted.
+func countOtherOwners(tx *sql.Tx, username string) (int, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM admin_accounts WHERE role = ? AND username != ?", roleOwner, username).Scan(&n)
+	return n, err
+}
+
+func (app *App) listAdminAccounts() ([]adminAccount, error) {
+	rows, err := app.db.Query("SELECT username, role, created_at, created_by, last_login_at FROM admin_accounts ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []adminAccount{}
+	for rows.Next() {
+		var a adminAccount
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&a.Username, &a.Role, &a.CreatedAt, &a.CreatedBy, &lastLogin); err != nil {
+			return nil, err
+		}
+		if lastLogin.Valid {
+			a.LastLoginAt = &lastLogin.Time
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// adminAccountsHandler lists (GET) and creates (POST) admin accounts, and changes the role or
+// password of (PATCH) or deletes (DELETE) /api/admin/accounts/{username}. Owners only.
+func (app *App) adminAccountsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := requireRole(w, r, roleOwner)
+		if !ok {
+			return
+		}
+		actor := admin.actor()
+
+		username := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/accounts"), "/")
+		var payload struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var err error
+		switch {
+		case username == "" && r.Method == http.MethodGet:
+			accounts, err := app.listAdminAccounts()
+			if err != nil {
+				log.Printf("ERROR: could not list admin accounts: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(accounts)
+			return
+		case username == "" && r.Method == http.MethodPost:
+			if payload.Role == "" {
+				payload.Role = roleViewer
+			}
+			if payload.Password == "" {
+				http.Error(w, "password is required", http.StatusBadRequest)
+				return
+			}
+			if err := validateAdminAccount(payload.Username, payload.Password, payload.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var exists bool
+			if err := app.db.QueryRow("SELECT EXISTS (SELECT 1 FROM admin_accounts WHERE username = ?)", payload.Username).Scan(&exists); err == nil && exists {
+				http.Error(w, "An account with that username already exists", http.StatusConflict)
+				return
+			}
+			_, err = saveAdminAccount(app.db, actor, payload.Username, payload.Password, payload.Role)
+		case username != "" && r.Method == http.MethodPatch:
+			if err := validateAdminAccount(username, payload.Password, payload.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if payload.Password == "" && payload.Role == "" {
+				http.Error(w, `Expected {"role": "..."} and/or {"password": "..."}`, http.StatusBadRequest)
+				return
+			}
+			err = app.updateAdminAccount(actor, username, payload.Password, payload.Role)
+		case username != "" && r.Method == http.MethodDelete:
+			err = app.deleteAdminAccount(actor, username)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case errors.Is(err, errLastOwner):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Account not found", http.StatusNotFound)
+		case err != nil:
+			log.Printf("ERROR: could not change admin account: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		default:
+			log.Printf("Admin %s changed admin accounts (%s %s).", actor, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// errLastOwner refuses to demote or delete the only owner, which would leave nobody able to
+// manage accounts.
+var errLastOwner = errors.New("there must be at least one owner")
+
+// updateAdminAccount changes an account's role and/or password.
+func (app *App) updateAdminAccount(actor, username, password, role string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow("SELECT role FROM admin_accounts WHERE username = ?", username).Scan(&current); err != nil {
+		return err
+	}
+	if role != "" && role != roleOwner && current == roleOwner {
+		if n, err := countOtherOwners(tx, username); err != nil {
+			return err
+		} else if n == 0 {
+			return errLastOwner
+		}
+	}
+	details := map[string]interface{}{}
+	if role != "" {
+		if _, err := tx.Exec("UPDATE admin_accounts SET role = ? WHERE username = ?", role, username); err != nil {
+			return err
+		}
+		details["role"] = role
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE admin_accounts SET password_hash = ? WHERE username = ?", string(hash), username); err != nil {
+			return err
+		}
+		details["password_changed"] = true
+	}
+	if err := recordAudit(tx, actor, "account.update", username, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteAdminAccount deletes an account. Its sessions stop being admin sessions at once.
+func (app *App) deleteAdminAccount(actor, username string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var role string
+	if err := tx.QueryRow("SELECT role FROM admin_accounts WHERE username = ?", username).Scan(&role); err != nil {
+		return err
+	}
+	if role == roleOwner {
+		if n, err := countOtherOwners(tx, username); err != nil {
+			return err
+		} else if n == 0 {
+			return errLastOwner
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM admin_accounts WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET is_admin = 0 WHERE admin_account = ?", username); err != nil {
+		return err
+	}
+	if err := recordAudit(tx, actor, "account.delete", username, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runCreateAdmin implements "dashboard create-admin -username <name> [-role owner]". It creates
+// an admin account, or changes the password and role of an existing one, which also recovers a
+// lost password. The password is read from ADMIN_PASSWORD, or prompted for.
+func runCreateAdmin(args []string) int {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	username := fs.String("username", "", "name of the account")
+	role := fs.String("role", roleOwner, "viewer, operator or owner")
+	dbPath := fs.String("db", "", "path to the SQLite database (default: the server's db setting)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: dashboard create-admin -username <name> [-role viewer|operator|owner] [-db path]")
+		return 2
+	}
+	if *dbPath == "" {
+		settings, err := loadSettings(nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load settings: %v\n", err)
+			return 1
+		}
+		*dbPath = settings.DBPath
+	}
+
+	password, err := readAdminPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read password: %v\n", err)
+		return 1
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "password is required")
+		return 2
+	}
+	if err := validateAdminAccount(*username, password, *role); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*dbPath), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create data directory: %v\n", err)
+		return 1
+	}
+	db, err := initDB(*dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	created, err := saveAdminAccount(db, "create-admin", *username, password, *role)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not save account: %v\n", err)
+		return 1
+	}
+	if created {
+		fmt.Printf("Created %s account %q.\n", *role, *username)
+	} else {
+		fmt.Printf("Updated the password and role (%s) of account %q.\n", *role, *username)
+	}
+	return 0
+}
+
+// readAdminPassword reads the password for create-admin from ADMIN_PASSWORD, from a prompt
+// if stdin is a terminal, or otherwise from the first line of stdin.
+func readAdminPassword() (string, error) {
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		repeated, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(password) != string(repeated) {
+			return "", errors.New("the passwords don't match")
+		}
+		return string(password), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestRequireRole checks that each role can read everything and change what its rank allows,
+// and that visitors and admins whose account is gone are turned away.
+func TestRequireRole(t *testing.T) {
+	admin := func(role string) *User { return &User{ID: role, IsAdmin: true, Role: role} }
+	tests := []struct {
+		name   string
+		user   *User
+		method string
+		role   string // Needed to change things
+		want   bool
+	}{
+		{name: "no user", method: http.MethodGet, role: roleViewer},
+		{name: "visitor", user: &User{ID: "visitor"}, method: http.MethodGet, role: roleViewer},
+		{name: "deleted account", user: &User{ID: "gone", Role: roleOwner}, method: http.MethodGet, role: roleViewer},
+		{name: "viewer reads", user: admin(roleViewer), method: http.MethodGet, role: roleOwner, want: true},
+		{name: "viewer reads headers", user: admin(roleViewer), method: http.MethodHead, role: roleOwner, want: true},
+		{name: "viewer can't change", user: admin(roleViewer), method: http.MethodPost, role: roleOperator},
+		{name: "operator changes", user: admin(roleOperator), method: http.MethodPost, role: roleOperator, want: true},
+		{name: "operator deletes", user: admin(roleOperator), method: http.MethodDelete, role: roleOperator, want: true},
+		{name: "operator can't do owner changes", user: admin(roleOperator), method: http.MethodPatch, role: roleOwner},
+		{name: "owner does operator changes", user: admin(roleOwner), method: http.MethodPost, role: roleOperator, want: true},
+		{name: "owner does owner changes", user: admin(roleOwner), method: http.MethodDelete, role: roleOwner, want: true},
+		{name: "unknown role", user: admin("superuser"), method: http.MethodGet, role: roleViewer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := requestAs(tt.user, tt.method, "/api/admin/anything", "")
+			rec := httptest.NewRecorder()
+			user, ok := requireRole(rec, req, writeRole(req, tt.role))
+			if ok != tt.want {
+				t.Fatalf("allowed = %v, want %v", ok, tt.want)
+			}
+			if ok && user != tt.user {
+				t.Errorf("got user %v, want %v", user, tt.user)
+			}
+			if !ok && rec.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// TestLastOwnerIsKept runs account changes in order and checks that the only owner can't be
+// demoted or deleted, while an owner who isn't the last one can.
+func TestLastOwnerIsKept(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, a := range []struct{ username, role string }{{"alice", roleOwner}, {"bob", roleOperator}} {
+		if _, err := saveAdminAccount(app.db, "test", a.username, "password1", a.role); err != nil {
+			t.Fatalf("saveAdminAccount %s: %v", a.username, err)
+		}
+	}
+	owner := &User{ID: "owner-session", IsAdmin: true, Role: roleOwner, Username: "alice"}
+
+	steps := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{name: "demote the only owner", method: http.MethodPatch, target: "/api/admin/accounts/alice", body: `{"role": "operator"}`, want: http.StatusConflict},
+		{name: "delete the only owner", method: http.MethodDelete, target: "/api/admin/accounts/alice", want: http.StatusConflict},
+		{name: "change the only owner's password", method: http.MethodPatch, target: "/api/admin/accounts/alice", body: `{"password": "password2"}`, want: http.StatusNoContent},
+		{name: "keep the only owner an owner", method: http.MethodPatch, target: "/api/admin/accounts/alice", body: `{"role": "owner"}`, want: http.StatusNoContent},
+		{name: "promote a second owner", method: http.MethodPatch, target: "/api/admin/accounts/bob", body: `{"role": "owner"}`, want: http.StatusNoContent},
+		{name: "demote one of two owners", method: http.MethodPatch, target: "/api/admin/accounts/alice", body: `{"role": "viewer"}`, want: http.StatusNoContent},
+		{name: "demote the new only owner", method: http.MethodPatch, target: "/api/admin/accounts/bob", body: `{"role": "viewer"}`, want: http.StatusConflict},
+		{name: "delete the new only owner", method: http.MethodDelete, target: "/api/admin/accounts/bob", want: http.StatusConflict},
+		{name: "delete a viewer", method: http.MethodDelete, target: "/api/admin/accounts/alice", want: http.StatusNoContent},
+		{name: "delete an unknown account", method: http.MethodDelete, target: "/api/admin/accounts/carol", want: http.StatusNotFound},
+	}
+	handler := app.adminAccountsHandler()
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		handler(rec, requestAs(owner, step.method, step.target, step.body))
+		if rec.Code != step.want {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, rec.Code, step.want, rec.Body)
+		}
+	}
+
+	var owners int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM admin_accounts WHERE role = ?", roleOwner).Scan(&owners); err != nil {
+		t.Fatalf("count owners: %v", err)
+	}
+	if owners != 1 {
+		t.Errorf("%d owners are left, want 1", owners)
+	}
+}
+
+// TestAdminUserChanges runs user management changes in order and checks each one's status,
+// audit record and effect on the balance and admin role, and that a banned visitor can't
+// activate anything.
+func TestAdminUserChanges(t *testing.T) {
+	app := newTestApp(t, &Config{Triggers: []Trigger{{ID: "scream", Name: "Scream", Description: "Boo", ArduinoIP: "10.0.0.5", SecretKey: "k", Simulate: true}}})
+	if err := app.loadSessionKeys(); err != nil {
+		t.Fatalf("loadSessionKeys: %v", err)
+	}
+	if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES ('visitor', 5, 0)"); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	cookie, err := app.issueSession(sessionKindUser, "visitor", time.Hour)
+	if err != nil {
+		t.Fatalf("issueSession: %v", err)
+	}
+	owner := &User{ID: "owner-session", IsAdmin: true, Role: roleOwner, Username: "alice"}
+
+	steps := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		asVisitor   bool // Made by the visitor through the session middleware instead of by the owner
+		want        int
+		wantAction  string // Audit action recorded, empty for none
+		wantBalance int
+		wantRole    string // The visitor's stored admin_role afterwards
+	}{
+		{name: "look up", method: http.MethodGet, target: "/api/admin/users/visitor", want: http.StatusOK, wantBalance: 5},
+		{name: "credit", method: http.MethodPost, target: "/api/admin/users/visitor/tokens", body: `{"delta": 5, "note": "Lost a token to a broken prop"}`, want: http.StatusOK, wantAction: "user.grant", wantBalance: 10},
+		{name: "debit", method: http.MethodPost, target: "/api/admin/users/visitor/tokens", body: `{"delta": -3}`, want: http.StatusOK, wantAction: "user.revoke", wantBalance: 7},
+		{name: "debit below zero", method: http.MethodPost, target: "/api/admin/users/visitor/tokens", body: `{"delta": -8}`, want: http.StatusConflict, wantBalance: 7},
+		{name: "zero delta", method: http.MethodPost, target: "/api/admin/users/visitor/tokens", body: `{"delta": 0}`, want: http.StatusBadRequest, wantBalance: 7},
+		{name: "credit unknown user", method: http.MethodPost, target: "/api/admin/users/ghost/tokens", body: `{"delta": 5}`, want: http.StatusNotFound, wantBalance: 7},
+		{name: "activate", method: http.MethodPost, target: "/api/activate/scream", asVisitor: true, want: http.StatusOK, wantBalance: 6},
+		{name: "ban", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"banned": true, "reason": "Kicking props"}`, want: http.StatusOK, wantAction: "user.ban", wantBalance: 6},
+		{name: "activate while banned", method: http.MethodPost, target: "/api/activate/scream", asVisitor: true, want: http.StatusForbidden, wantBalance: 6},
+		{name: "unban", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"banned": false}`, want: http.StatusOK, wantAction: "user.unban", wantBalance: 6},
+		{name: "activate after unban", method: http.MethodPost, target: "/api/activate/scream", asVisitor: true, want: http.StatusOK, wantBalance: 5},
+		{name: "ban yourself", method: http.MethodPatch, target: "/api/admin/users/owner-session", body: `{"banned": true}`, want: http.StatusBadRequest, wantBalance: 5},
+		{name: "promote", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"is_admin": true}`, want: http.StatusOK, wantAction: "user.promote", wantBalance: 5, wantRole: roleViewer},
+		{name: "promote to operator", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"is_admin": true, "role": "operator"}`, want: http.StatusOK, wantAction: "user.promote", wantBalance: 5, wantRole: roleOperator},
+		{name: "promote to unknown role", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"is_admin": true, "role": "wizard"}`, want: http.StatusBadRequest, wantBalance: 5, wantRole: roleOperator},
+		{name: "role without promotion", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"banned": false, "role": "owner"}`, want: http.StatusBadRequest, wantBalance: 5, wantRole: roleOperator},
+		{name: "demote", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"is_admin": false}`, want: http.StatusOK, wantAction: "user.demote", wantBalance: 5},
+		{name: "ban and promote unknown user", method: http.MethodPatch, target: "/api/admin/users/ghost", body: `{"banned": true, "is_admin": true}`, want: http.StatusNotFound, wantBalance: 5},
+		{name: "ban and promote", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"banned": true, "is_admin": true, "role": "owner"}`, want: http.StatusOK, wantAction: "user.promote", wantBalance: 5, wantRole: roleOwner},
+		{name: "unban and demote", method: http.MethodPatch, target: "/api/admin/users/visitor", body: `{"banned": false, "is_admin": false}`, want: http.StatusOK, wantAction: "user.demote", wantBalance: 5},
+		{name: "reset sessions", method: http.MethodPost, target: "/api/admin/users/visitor/reset-sessions", want: http.StatusOK, wantAction: "user.reset_sessions", wantBalance: 5},
+		{name: "activate with a reset session", method: http.MethodPost, target: "/api/activate/scream", asVisitor: true, want: http.StatusUnauthorized, wantBalance: 5},
+	}
+	lastAudit := func() (id int64, action string) {
+		if err := app.db.QueryRow("SELECT COALESCE(MAX(id), 0), COALESCE((SELECT action FROM audit_log ORDER BY id DESC LIMIT 1), '') FROM audit_log").Scan(&id, &action); err != nil {
+			t.Fatalf("read audit log: %v", err)
+		}
+		return id, action
+	}
+	for _, step := range steps {
+		beforeID, _ := lastAudit()
+		rec := httptest.NewRecorder()
+		if step.asVisitor {
+			req := httptest.NewRequest(step.method, step.target, nil)
+			req.AddCookie(&http.Cookie{Name: userCookieName, Value: cookie})
+			app.userAuthMiddleware(app.activateHandler()).ServeHTTP(rec, req)
+			app.activations.Wait()
+		} else {
+			app.adminUsersHandler()(rec, requestAs(owner, step.method, step.target, step.body))
+		}
+		if rec.Code != step.want {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, rec.Code, step.want, rec.Body)
+		}
+
+		afterID, action := lastAudit()
+		if step.wantAction == "" && afterID != beforeID {
+			t.Errorf("%s: recorded audit action %q, want none", step.name, action)
+		}
+		if step.wantAction != "" && (afterID == beforeID || action != step.wantAction) {
+			t.Errorf("%s: last audit action = %q, want %q", step.name, action, step.wantAction)
+		}
+		var balance int
+		var role string
+		if err := app.db.QueryRow("SELECT tokens_remaining, COALESCE(admin_role, '') FROM users WHERE id = 'visitor'").Scan(&balance, &role); err != nil {
+			t.Fatalf("%s: read user: %v", step.name, err)
+		}
+		if balance != step.wantBalance {
+			t.Errorf("%s: balance = %d, want %d", step.name, balance, step.wantBalance)
+		}
+		if role != step.wantRole {
+			t.Errorf("%s: admin role = %q, want %q", step.name, role, step.wantRole)
+		}
+	}
+
+	// Each change in a combined PATCH has its own audit record.
+	var bans int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'user.ban' AND target = 'visitor'").Scan(&bans); err != nil {
+		t.Fatalf("count bans: %v", err)
+	}
+	if bans != 2 {
+		t.Errorf("%d ban audit records, want 2", bans)
+	}
+
+	history, err := queryLedger(app.db, "visitor", 10)
+	if err != nil {
+		t.Fatalf("queryLedger: %v", err)
+	}
+	var grants []int
+	for _, e := range history {
+		if e.Reason == ledgerAdminGrant {
+			grants = append(grants, e.Delta)
+		}
+	}
+	if want := []int{-3, 5}; !slices.Equal(grants, want) {
+		t.Errorf("admin grant ledger deltas (newest first) = %v, want %v", grants, want)
+	}
+}
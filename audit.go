@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Audit Log ---
+// Every admin change to runtime state is recorded in the audit_log table with who made it,
+// what was changed and the details needed to see the before and after.
+
+// auditEntry is one row of the audit log.
+type auditEntry struct {
+	ID        int64           `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+// dbExecer is satisfied by both *sql.DB and *sql.Tx, so audit records can be written in the
+// same transaction as the change they describe.
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit writes an audit entry. details is stored as JSON.
+func recordAudit(db dbExecer, actor, action, target string, details interface{}) error {
+	var detailsJSON []byte
+	if details != nil {
+		var err error
+		if detailsJSON, err = json.Marshal(details); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("INSERT INTO audit_log (actor, action, target, details) VALUES (?, ?, ?, ?)", actor, action, target, string(detailsJSON))
+	return err
+}
+
+func (app *App) auditLogHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireRole(w, r, roleViewer); !ok {
+			return
+		}
+
+		rows, err := app.db.Query("SELECT id, timestamp, actor, action, target, COALESCE(details, '') FROM audit_log ORDER BY id DESC LIMIT 200")
+		if err != nil {
+			log.Printf("ERROR: could not query audit log: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []auditEntry{}
+		for rows.Next() {
+			var e auditEntry
+			var details string
+			if err := rows.Scan(&e.ID, &e.Timestamp, &e.Actor, &e.Action, &e.Target, &details); err != nil {
+				log.Printf("ERROR: could not scan audit log row: %v", err)
+				continue
+			}
+			if details != "" {
+				e.Details = json.RawMessage(details)
+			}
+			entries = append(entries, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Availability ---
+// Admins can take things offline at runtime without editing the config: a single trigger when
+// a prop breaks, a zone while actors reset it (see zones.go), or the whole dashboard for
+// maintenance. Triggers with availability windows are also offline outside them (see
+// schedule.go). Offline triggers stay on the dashboard with the reason, and activateHandler
+// refuses them before a token is spent. The states are stored in the database so they survive
+// restarts: zones in the zones table, triggers in trigger_states and maintenance mode as the
+// single row of dashboard_state.
+//
+// Hiding a trigger on the Manage Triggers page (db_triggers.disabled, see dbtriggers.go) is a
+// different thing: it removes the trigger from the dashboard altogether. A trigger can't be
+// both, so each change is refused while the other one is in effect.
+
+const dashboardStateKey = "dashboard" // The only row of dashboard_state.
+
+// offlineState says whether something has been taken offline, and why.
+type offlineState struct {
+	Disabled  bool      `json:"disabled"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// loadOfflineStates reads one of the offline state tables into a map keyed by keyColumn.
+func loadOfflineStates(db dbQuerier, table, keyColumn string) (map[string]offlineState, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT %s, disabled, COALESCE(reason, ''), updated_at, updated_by FROM %s", keyColumn, table))
+	if err != nil {
+		return nil, fmt.Errorf("could not query %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]offlineState)
+	for rows.Next() {
+		var key string
+		var s offlineState
+		if err := rows.Scan(&key, &s.Disabled, &s.Reason, &s.UpdatedAt, &s.UpdatedBy); err != nil {
+			return nil, fmt.Errorf("could not scan %s row: %w", table, err)
+		}
+		states[key] = s
+	}
+	return states, rows.Err()
+}
+
+// loadOfflineStates loads every offline state table into the app.
+func (app *App) loadOfflineStates() error {
+	var err error
+	if app.zones, err = loadOfflineStates(app.db, "zones", "name"); err != nil {
+		return err
+	}
+	if app.triggerStates, err = loadOfflineStates(app.db, "trigger_states", "trigger_id"); err != nil {
+		return err
+	}
+	app.dashboardState, err = loadOfflineStates(app.db, "dashboard_state", "name")
+	return err
+}
+
+// saveOfflineState stores a state together with its audit record and updates the in-memory
+// copy in states. The caller must hold configMutex for writing.
+func (app *App) saveOfflineState(user *User, table, keyColumn, key, action string, states map[string]offlineState, disabled bool, reason string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %[1]s (%[2]s, disabled, reason, updated_by) VALUES (?, ?, ?, ?)
+		ON CONFLICT(%[2]s) DO UPDATE SET disabled = excluded.disabled, reason = excluded.reason, updated_at = CURRENT_TIMESTAMP, updated_by = excluded.updated_by`, table, keyColumn),
+		key, disabled, reason, user.actor())
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(tx, user.actor(), action, key, map[string]string{"reason": reason}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	states[key] = offlineState{Disabled: disabled, Reason: reason, UpdatedAt: time.Now(), UpdatedBy: user.actor()}
+	log.Printf("Admin %s: %s %s.", user.actor(), action, key)
+	return nil
+}
+
+// maintenance returns the dashboard's maintenance state. The caller must hold configMutex.
+func (app *App) maintenance() offlineState {
+	return app.dashboardState[dashboardStateKey]
+}
+
+// unavailableReason explains why a trigger can't be activated right now by user, or returns
+// "" if it can. Admins aren't held back by maintenance mode or closed zones, so they can test
+// props while visitors can't use them. The caller must hold configMutex.
+func (app *App) unavailableReason(t *Trigger, user *User) string {
+	withReason := func(msg, reason string) string {
+		if reason != "" {
+			return msg + " " + reason
+		}
+		return msg
+	}
+	admin := user != nil && user.IsAdmin
+	if m := app.maintenance(); m.Disabled && !admin {
+		return withReason("The dashboard is down for maintenance.", m.Reason)
+	}
+	if z := app.zones[t.Zone]; t.Zone != "" && z.Disabled && !admin {
+		return withReason(fmt.Sprintf("%s is temporarily closed.", t.Zone), z.Reason)
+	}
+	if s := app.triggerStates[t.ID]; s.Disabled {
+		return withReason(fmt.Sprintf("%s is out of order.", t.Name), s.Reason)
+	}
+	if open, next := t.availableAt(time.Now()); !open {
+		if next.IsZero() {
+			return fmt.Sprintf("%s is no longer available.", t.Name)
+		}
+		return fmt.Sprintf("%s isn't available right now. It opens again %s.", t.Name, next.Format("Mon Jan 2 at 15:04 MST"))
+	}
+	return ""
+}
+
+// offlinePayload is the body of the requests that take something offline or bring it back.
+type offlinePayload struct {
+	Disabled *bool  `json:"disabled"`
+	Reason   string `json:"reason"`
+}
+
+func decodeOfflinePayload(r *http.Request) (*offlinePayload, bool) {
+	var payload offlinePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Disabled == nil {
+		return nil, false
+	}
+	if !*payload.Disabled {
+		payload.Reason = ""
+	}
+	return &payload, true
+}
+
+// triggerStatesHandler lists and sets the offline state of individual triggers.
+func (app *App) triggerStatesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireRole(w, r, writeRole(r, roleOperator))
+		if !ok {
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/trigger-states"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			app.configMutex.RLock()
+			states := make(map[string]offlineState)
+			for id, s := range app.triggerStates {
+				if s.Disabled {
+					states[id] = s
+				}
+			}
+			app.configMutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(states)
+		case id != "" && r.Method == http.MethodPatch:
+			payload, ok := decodeOfflinePayload(r)
+			if !ok {
+				http.Error(w, `Expected {"disabled": true|false, "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			action := "trigger.online"
+			if *payload.Disabled {
+				action = "trigger.offline"
+			}
+
+			app.configMutex.Lock()
+			defer app.configMutex.Unlock()
+			known := false
+			for _, t := range app.config.Triggers {
+				known = known || t.ID == id
+			}
+			if !known && *payload.Disabled {
+				var hidden bool
+				if err := app.db.QueryRow("SELECT COUNT(*) FROM db_triggers WHERE id = ? AND disabled = 1", id).Scan(&hidden); err != nil {
+					log.Printf("ERROR: could not look up trigger '%s': %v", id, err)
+					http.Error(w, "Database error", http.StatusInternalServerError)
+					return
+				}
+				if hidden {
+					http.Error(w, "Trigger is hidden, so it isn't on the dashboard to be out of order; show it first", http.StatusConflict)
+					return
+				}
+				http.Error(w, "Trigger not found", http.StatusNotFound)
+				return
+			}
+			if err := app.saveOfflineState(user, "trigger_states", "trigger_id", id, action, app.triggerStates, *payload.Disabled, payload.Reason); err != nil {
+				log.Printf("ERROR: could not update state of trigger '%s': %v", id, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// maintenanceHandler reports and sets maintenance mode.
+func (app *App) maintenanceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireRole(w, r, writeRole(r, roleOperator))
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			app.configMutex.RLock()
+			state := app.maintenance()
+			app.configMutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state)
+		case http.MethodPatch:
+			payload, ok := decodeOfflinePayload(r)
+			if !ok {
+				http.Error(w, `Expected {"disabled": true|false, "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			action := "maintenance.end"
+			if *payload.Disabled {
+				action = "maintenance.start"
+			}
+
+			app.configMutex.Lock()
+			defer app.configMutex.Unlock()
+			if err := app.saveOfflineState(user, "dashboard_state", "name", dashboardStateKey, action, app.dashboardState, *payload.Disabled, payload.Reason); err != nil {
+				log.Printf("ERROR: could not update maintenance mode: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
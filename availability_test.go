@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUnavailableReason checks which offline states refuse an activation: visitors are held
+// back by all of them, admins only by an offline trigger, so they can test props during
+// maintenance and in closed zones.
+func TestUnavailableReason(t *testing.T) {
+	visitor := &User{ID: "visitor"}
+	admin := &User{ID: "admin", IsAdmin: true, Role: roleOperator}
+	tests := []struct {
+		name        string
+		maintenance bool
+		zoneClosed  bool
+		offline     bool
+		user        *User
+		want        string // Part of the reason, empty if the trigger can be activated
+	}{
+		{name: "all open", user: visitor},
+		{name: "maintenance", maintenance: true, user: visitor, want: "maintenance"},
+		{name: "maintenance for an admin", maintenance: true, user: admin},
+		{name: "zone closed", zoneClosed: true, user: visitor, want: "Graveyard is temporarily closed"},
+		{name: "zone closed for an admin", zoneClosed: true, user: admin},
+		{name: "trigger offline", offline: true, user: visitor, want: "Crypt is out of order"},
+		{name: "trigger offline for an admin", offline: true, user: admin, want: "Crypt is out of order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			if err := app.loadOfflineStates(); err != nil {
+				t.Fatalf("loadOfflineStates: %v", err)
+			}
+			app.dashboardState[dashboardStateKey] = offlineState{Disabled: tt.maintenance}
+			app.zones["Graveyard"] = offlineState{Disabled: tt.zoneClosed}
+			app.triggerStates["crypt"] = offlineState{Disabled: tt.offline}
+
+			trigger := &Trigger{ID: "crypt", Name: "Crypt", Zone: "Graveyard"}
+			got := app.unavailableReason(trigger, tt.user)
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("unavailableReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Command Trigger Implementation ---
+// Runs a local executable for quick hacks (playing a sound, poking a GPIO pin, ...).
+// Only executables listed in the config's "allowed_commands" may run.
+
+const (
+	defaultCommandTimeout = 30 * time.Second
+	maxCommandOutput      = 64 * 1024 // Bytes of stdout/stderr kept per action.
+)
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops the rest,
+// so a chatty script can't fill the database.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+func (c *cappedBuffer) String() string {
+	if c.truncated {
+		return c.buf.String() + "\n[output truncated]"
+	}
+	return c.buf.String()
+}
+
+func (app *App) handleCommandTrigger(trigger *Trigger, actionID int64, sim *simulation) error {
+	app.configMutex.RLock()
+	allowed := slices.Contains(app.config.AllowedCommands, trigger.Command)
+	app.configMutex.RUnlock()
+	if !allowed {
+		return fmt.Errorf("command %q is not in allowed_commands", trigger.Command)
+	}
+
+	timeout := defaultCommandTimeout
+	if trigger.TimeoutSeconds > 0 {
+		timeout = time.Duration(trigger.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, trigger.Command, trigger.Args...)
+	cmd.WaitDelay = 2 * time.Second // Don't hang on grandchildren that keep stdout open.
+
+	// Start from a minimal environment so server secrets (ADMIN_SECRET_KEY etc.) aren't leaked to scripts.
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"TRIGGER_ID=" + trigger.ID,
+		"ACTION_ID=" + strconv.FormatInt(actionID, 10),
+	}
+	for k, v := range trigger.secrets.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdout := &cappedBuffer{limit: maxCommandOutput}
+	stderr := &cappedBuffer{limit: maxCommandOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if sim != nil {
+		// Only variable names are recorded; values may hold secrets.
+		envNames := make([]string, 0, len(cmd.Env))
+		for _, kv := range cmd.Env {
+			envNames = append(envNames, strings.SplitN(kv, "=", 2)[0])
+		}
+		sim.record("command", trigger.Command, fmt.Sprintf("args=%q env=%v timeout=%s", trigger.Args, envNames, timeout))
+		return nil
+	}
+
+	log.Printf("Running command for action ID %d: %s %v", actionID, trigger.Command, trigger.Args)
+	runErr := cmd.Run()
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if _, err := app.db.Exec("UPDATE actions SET stdout = ?, stderr = ?, exit_code = ? WHERE id = ?", stdout.String(), stderr.String(), exitCode, actionID); err != nil {
+		log.Printf("ERROR: could not store command output for action ID %d: %v", actionID, err)
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command timed out after %s", timeout)
+	}
+	if runErr != nil {
+		return fmt.Errorf("command failed (exit code %d): %w", exitCode, runErr)
+	}
+	return nil
+}
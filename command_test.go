@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCommandTrigger checks the boundaries around scripts: only whitelisted executables run,
+// they don't inherit the server's environment and their output is capped.
+func TestCommandTrigger(t *testing.T) {
+	t.Setenv("ADMIN_SECRET_KEY", "owner-secret")
+	tests := []struct {
+		name        string
+		trigger     Trigger
+		wantErr     string // Expected in the error, empty if the command should succeed
+		wantStdout  []string
+		notInStdout []string
+		wantLen     int // Expected stdout length, 0 to skip the check
+	}{
+		{
+			name:    "not in allowed_commands",
+			trigger: Trigger{ID: "sneaky", Type: "command", Command: "/usr/bin/env"},
+			wantErr: `command "/usr/bin/env" is not in allowed_commands`,
+		},
+		{
+			name:        "minimal environment",
+			trigger:     Trigger{ID: "env", Type: "command", Command: "/bin/sh", Args: []string{"-c", "env"}, Env: map[string]string{"VOLUME": "11"}},
+			wantStdout:  []string{"TRIGGER_ID=env", "ACTION_ID=", "PATH=", "VOLUME=11"},
+			notInStdout: []string{"ADMIN_SECRET_KEY", "owner-secret"},
+		},
+		{
+			name:       "output is truncated",
+			trigger:    Trigger{ID: "chatty", Type: "command", Command: "/bin/sh", Args: []string{"-c", "head -c 100000 /dev/zero | tr '\\000' x"}},
+			wantStdout: []string{"\n[output truncated]"},
+			wantLen:    maxCommandOutput + len("\n[output truncated]"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &Config{AllowedCommands: []string{"/bin/sh"}})
+			tt.trigger.secrets.env = tt.trigger.Env
+			if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES ('visitor', 0, 0)"); err != nil {
+				t.Fatalf("insert user: %v", err)
+			}
+			res, err := app.db.Exec("INSERT INTO actions (user_id, trigger_id, success, cost) VALUES ('visitor', ?, 0, 0)", tt.trigger.ID)
+			if err != nil {
+				t.Fatalf("insert action: %v", err)
+			}
+			actionID, _ := res.LastInsertId()
+
+			err = app.handleCommandTrigger(&tt.trigger, actionID, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleCommandTrigger: %v", err)
+			}
+
+			var stdout string
+			if err := app.db.QueryRow("SELECT stdout FROM actions WHERE id = ?", actionID).Scan(&stdout); err != nil {
+				t.Fatalf("read output: %v", err)
+			}
+			for _, want := range tt.wantStdout {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("stdout doesn't contain %q", want)
+				}
+			}
+			for _, leaked := range tt.notInStdout {
+				if strings.Contains(stdout, leaked) {
+					t.Errorf("stdout contains %q", leaked)
+				}
+			}
+			if tt.wantLen > 0 && len(stdout) != tt.wantLen {
+				t.Errorf("stdout is %d bytes, want %d", len(stdout), tt.wantLen)
+			}
+		})
+	}
+}
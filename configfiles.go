@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Multi-File Config ---
+// The main config file may be JSON or YAML (chosen by extension). Triggers can be split into
+// per-area files: every .json, .yaml and .yml file in the "triggers.d" directory next to the
+// main file is merged in, followed by the files matching the main file's "include" globs.
+// Included files may only define "triggers"; everything else belongs in the main file.
+
+const triggersDirName = "triggers.d"
+
+// triggerSource records which file a merged trigger came from, so problems can be reported
+// against the file the user has to edit.
+type triggerSource struct {
+	file  string
+	index int    // Position in that file's "triggers" list.
+	path  string // Replaces "triggers[index]" for triggers that aren't in a list, such as stored ones.
+}
+
+// triggerLocation returns the file and path of the i-th merged trigger.
+func (c *Config) triggerLocation(i int) (string, string) {
+	if i < len(c.sources) {
+		if c.sources[i].path != "" {
+			return c.sources[i].file, c.sources[i].path
+		}
+		return c.sources[i].file, fmt.Sprintf("triggers[%d]", c.sources[i].index)
+	}
+	return c.path, fmt.Sprintf("triggers[%d]", i)
+}
+
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func isConfigFile(path string) bool {
+	return isYAMLFile(path) || strings.ToLower(filepath.Ext(path)) == ".json"
+}
+
+// yamlToJSON converts a YAML document to JSON so it goes through the same decoding and
+// validation as a JSON config. YAML keys are the same as the JSON field names.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{} // An empty file is an empty config.
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert to JSON (are all keys strings?): %w", err)
+	}
+	return out, nil
+}
+
+// loadConfigFile reads the main config file at path and every file it includes, merges them
+// and validates the result. The returned problems are warnings only; if there are any
+// errors, a *configError listing every problem in every file is returned instead. Secret
+// references that can't be resolved are errors only if requireSecrets is set.
+func loadConfigFile(path string, requireSecrets bool) (*Config, []configProblem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.New()
+	hashConfigFile(sum, path, data)
+
+	config, problems := parseConfig(path, data)
+	if config == nil {
+		return nil, nil, &configError{Problems: problems}
+	}
+	config.path = path
+	config.files = []string{path}
+	for i := range config.Triggers {
+		config.sources = append(config.sources, triggerSource{file: path, index: i})
+	}
+
+	files, includeProblems := includedConfigFiles(path, config.Include)
+	problems = append(problems, includeProblems...)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems = append(problems, configProblem{File: file, Message: err.Error()})
+			continue
+		}
+		hashConfigFile(sum, file, data)
+
+		part, partProblems := parseConfig(file, data)
+		problems = append(problems, partProblems...)
+		if part == nil {
+			continue
+		}
+		problems = append(problems, mainOnlyFields(file, part)...)
+		config.files = append(config.files, file)
+		for i, t := range part.Triggers {
+			config.Triggers = append(config.Triggers, t)
+			config.sources = append(config.sources, triggerSource{file: file, index: i})
+		}
+	}
+
+	problems = append(problems, validateConfig(config)...)
+	problems = append(problems, resolveSecrets(config, requireSecrets)...)
+	problems = append(problems, compileSchedules(config)...)
+	if hasConfigErrors(problems) {
+		return nil, nil, &configError{Problems: problems}
+	}
+	config.hash = hex.EncodeToString(sum.Sum(nil))
+	return config, problems, nil
+}
+
+// hashConfigFile adds a file to the combined config hash. The name is included so moving a
+// trigger between files counts as a change.
+func hashConfigFile(h hash.Hash, path string, data []byte) {
+	fmt.Fprintf(h, "%s\x00%d\x00", path, len(data))
+	h.Write(data)
+}
+
+// includedConfigFiles lists the files merged into the main config at path, in load order:
+// the triggers.d directory (sorted by name), then each include pattern's matches (sorted).
+// Patterns are relative to the main file's directory. Hidden files are skipped, which also
+// keeps editor swap files and Kubernetes' "..data" links out.
+func includedConfigFiles(path string, include []string) ([]string, []configProblem) {
+	dir := filepath.Dir(path)
+	var files []string
+	var problems []configProblem
+	add := func(file string) {
+		if filepath.Clean(file) == filepath.Clean(path) || slices.Contains(files, file) {
+			return
+		}
+		if strings.HasPrefix(filepath.Base(file), ".") {
+			return
+		}
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			return
+		}
+		files = append(files, file)
+	}
+
+	if entries, err := os.ReadDir(filepath.Join(dir, triggersDirName)); err == nil {
+		for _, e := range entries { // ReadDir returns entries sorted by name.
+			if isConfigFile(e.Name()) {
+				add(filepath.Join(dir, triggersDirName, e.Name()))
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		problems = append(problems, configProblem{File: filepath.Join(dir, triggersDirName), Message: err.Error()})
+	}
+
+	for i, pattern := range include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			problems = append(problems, configProblem{File: path, Path: fmt.Sprintf("include[%d]", i), Message: fmt.Sprintf("invalid pattern: %v", err)})
+			continue
+		}
+		if len(matches) == 0 {
+			problems = append(problems, configProblem{File: path, Path: fmt.Sprintf("include[%d]", i), Message: fmt.Sprintf("%q matches no files", include[i]), Warning: true})
+			continue
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			add(m)
+		}
+	}
+	return files, problems
+}
+
+// mainOnlyFields reports settings in an included file that are only honoured in the main file.
+// allowed_commands in particular must not be extendable from a per-area file.
+func mainOnlyFields(file string, part *Config) []configProblem {
+	var problems []configProblem
+	add := func(field string) {
+		problems = append(problems, configProblem{File: file, Path: field, Message: "is only allowed in the main config file"})
+	}
+	if part.LivestreamURL != "" {
+		add("livestream_url")
+	}
+	if len(part.AllowedCommands) > 0 {
+		add("allowed_commands")
+	}
+	if part.Simulate {
+		add("simulate")
+	}
+	if len(part.Include) > 0 {
+		add("include")
+	}
+	return problems
+}
+
+// configWatchDirs returns the directories whose changes may affect the config: those of every
+// loaded file (and their symlink targets) plus the triggers.d directory, so new files are seen.
+func configWatchDirs(path string, files []string) []string {
+	var dirs []string
+	add := func(dir string) {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	add(filepath.Dir(path))
+	if info, err := os.Stat(filepath.Join(filepath.Dir(path), triggersDirName)); err == nil && info.IsDir() {
+		add(filepath.Join(filepath.Dir(path), triggersDirName))
+	}
+	for _, file := range append([]string{path}, files...) {
+		add(filepath.Dir(file))
+		if target, err := filepath.EvalSymlinks(file); err == nil {
+			add(filepath.Dir(target))
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestLoadConfigFileMerge checks the order triggers are merged in from the main file,
+// triggers.d and includes, and that problems are reported against the file that has them.
+func TestLoadConfigFileMerge(t *testing.T) {
+	trigger := func(id string) string {
+		return `{"id": "` + id + `", "name": "N", "description": "D", "arduino_ip": "10.0.0.5", "secret_key": "k"}`
+	}
+	tests := []struct {
+		name       string
+		main       string            // Name of the main file
+		files      map[string]string // Relative path to contents
+		wantIDs    []string          // Merged trigger IDs in order
+		wantFiles  []string          // File each merged trigger came from
+		wantErrors []string          // "file: path" of each error, if loading should fail
+	}{
+		{
+			name:      "yaml main file",
+			main:      "config.yaml",
+			files:     map[string]string{"config.yaml": "triggers:\n  - id: door\n    name: Door\n    description: Creak\n    arduino_ip: 10.0.0.5\n    secret_key: k\n"},
+			wantIDs:   []string{"door"},
+			wantFiles: []string{"config.yaml"},
+		},
+		{
+			name: "triggers.d sorted by name, then includes in pattern order",
+			main: "config.json",
+			files: map[string]string{
+				"config.json":             `{"include": ["extra/b*.json", "extra/a*.json"], "triggers": [` + trigger("main") + `]}`,
+				"triggers.d/2-yard.yml":   "triggers:\n  - {id: yard, name: N, description: D, arduino_ip: 10.0.0.5, secret_key: k}\n",
+				"triggers.d/1-porch.json": `{"triggers": [` + trigger("porch") + `]}`,
+				"triggers.d/.swap.json":   `{"triggers": [` + trigger("swap") + `]}`,
+				"triggers.d/notes.txt":    "not a config",
+				"extra/a.json":            `{"triggers": [` + trigger("a") + `]}`,
+				"extra/b.json":            `{"triggers": [` + trigger("b") + `]}`,
+			},
+			wantIDs:   []string{"main", "porch", "yard", "b", "a"},
+			wantFiles: []string{"config.json", "triggers.d/1-porch.json", "triggers.d/2-yard.yml", "extra/b.json", "extra/a.json"},
+		},
+		{
+			name: "file included twice is merged once",
+			main: "config.json",
+			files: map[string]string{
+				"config.json":             `{"include": ["triggers.d/*.json", "config.json"], "triggers": [` + trigger("main") + `]}`,
+				"triggers.d/1-porch.json": `{"triggers": [` + trigger("porch") + `]}`,
+			},
+			wantIDs:   []string{"main", "porch"},
+			wantFiles: []string{"config.json", "triggers.d/1-porch.json"},
+		},
+		{
+			name: "duplicate id across files",
+			main: "config.json",
+			files: map[string]string{
+				"config.json":             `{"triggers": [` + trigger("door") + `]}`,
+				"triggers.d/1-porch.json": `{"triggers": [` + trigger("porch") + `, ` + trigger("door") + `]}`,
+			},
+			wantErrors: []string{"triggers.d/1-porch.json: triggers[1].id"},
+		},
+		{
+			name: "main-only fields in an included file",
+			main: "config.json",
+			files: map[string]string{
+				"config.json":             `{"triggers": [` + trigger("door") + `]}`,
+				"triggers.d/1-porch.json": `{"allowed_commands": ["/bin/sh"], "include": ["*.json"], "triggers": [` + trigger("porch") + `]}`,
+			},
+			wantErrors: []string{"triggers.d/1-porch.json: allowed_commands", "triggers.d/1-porch.json: include"},
+		},
+		{
+			name: "broken included file",
+			main: "config.json",
+			files: map[string]string{
+				"config.json":             `{"triggers": [` + trigger("door") + `]}`,
+				"triggers.d/1-porch.json": `{"triggers": [`,
+			},
+			wantErrors: []string{"triggers.d/1-porch.json: line 1, column 14"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rel := func(path string) string {
+				r, err := filepath.Rel(dir, path)
+				if err != nil {
+					return path
+				}
+				return filepath.ToSlash(r)
+			}
+
+			config, _, err := loadConfigFile(filepath.Join(dir, tt.main), true)
+			if tt.wantErrors != nil {
+				var cerr *configError
+				if !errors.As(err, &cerr) {
+					t.Fatalf("got error %v, want a *configError", err)
+				}
+				var got []string
+				for _, p := range cerr.Problems {
+					if !p.Warning {
+						got = append(got, rel(p.File)+": "+p.Path)
+					}
+				}
+				if !slices.Equal(got, tt.wantErrors) {
+					t.Errorf("got errors %q, want %q", got, tt.wantErrors)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigFile: %v", err)
+			}
+
+			var ids, files []string
+			for i, trig := range config.Triggers {
+				file, _ := config.triggerLocation(i)
+				ids = append(ids, trig.ID)
+				files = append(files, rel(file))
+			}
+			if !slices.Equal(ids, tt.wantIDs) || !slices.Equal(files, tt.wantFiles) {
+				t.Errorf("got triggers %q from %q, want %q from %q", ids, files, tt.wantIDs, tt.wantFiles)
+			}
+		})
+	}
+}
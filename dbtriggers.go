@@ -0,0 +1,532 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Database-Stored Triggers ---
+// Admins can create, edit, disable, reorder and delete triggers while the event is running.
+// They are kept in the db_triggers table and merged over the file config: a stored definition
+// with the same id as a file trigger overrides it, and a row without a definition only carries
+// the position and disabled flag of a file trigger. The merged config goes through
+// validateConfig like a file config, and every change is written to the audit log.
+
+const storedTriggerFile = "database" // Shown as the "file" of problems in stored triggers.
+
+// storedTrigger is one row of db_triggers.
+type storedTrigger struct {
+	ID        string    `json:"id"`
+	Trigger   *Trigger  `json:"trigger,omitempty"` // nil if the row only positions or disables a file trigger
+	Position  *int      `json:"position,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// dbQuerier is satisfied by both *sql.DB and *sql.Tx.
+type dbQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadStoredTriggers(db dbQuerier) ([]storedTrigger, error) {
+	rows, err := db.Query("SELECT id, definition, position, disabled, updated_at, updated_by FROM db_triggers ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("could not query stored triggers: %w", err)
+	}
+	defer rows.Close()
+
+	var stored []storedTrigger
+	for rows.Next() {
+		var st storedTrigger
+		var definition sql.NullString
+		var position sql.NullInt64
+		if err := rows.Scan(&st.ID, &definition, &position, &st.Disabled, &st.UpdatedAt, &st.UpdatedBy); err != nil {
+			return nil, fmt.Errorf("could not scan stored trigger: %w", err)
+		}
+		if definition.Valid {
+			st.Trigger = &Trigger{}
+			if err := json.Unmarshal([]byte(definition.String), st.Trigger); err != nil {
+				return nil, fmt.Errorf("stored trigger %q has an unreadable definition: %w", st.ID, err)
+			}
+		}
+		if position.Valid {
+			p := int(position.Int64)
+			st.Position = &p
+		}
+		stored = append(stored, st)
+	}
+	return stored, rows.Err()
+}
+
+// mergeTriggers applies the stored triggers to a file config and validates the result. Only
+// errors are returned; the file's warnings were already logged when it was loaded.
+func mergeTriggers(file *Config, stored []storedTrigger) (*Config, error) {
+	merged := *file
+	merged.Triggers = nil
+	merged.sources = nil
+
+	byID := make(map[string]storedTrigger, len(stored))
+	for _, st := range stored {
+		byID[st.ID] = st
+	}
+	storedSource := func(id string) triggerSource {
+		return triggerSource{file: storedTriggerFile, path: fmt.Sprintf("db_triggers[%s]", id)}
+	}
+
+	type entry struct {
+		trigger  Trigger
+		source   triggerSource
+		position *int
+	}
+	var entries []entry
+	inFile := make(map[string]bool)
+	for i, t := range file.Triggers {
+		inFile[t.ID] = true
+		source := triggerSource{file: file.path, index: i}
+		if i < len(file.sources) {
+			source = file.sources[i]
+		}
+		st, ok := byID[t.ID]
+		if !ok {
+			entries = append(entries, entry{trigger: t, source: source})
+			continue
+		}
+		if st.Disabled {
+			continue
+		}
+		if st.Trigger != nil {
+			t, source = *st.Trigger, storedSource(st.ID)
+		}
+		entries = append(entries, entry{trigger: t, source: source, position: st.Position})
+	}
+	for _, st := range stored {
+		if inFile[st.ID] || st.Trigger == nil || st.Disabled {
+			continue
+		}
+		entries = append(entries, entry{trigger: *st.Trigger, source: storedSource(st.ID), position: st.Position})
+	}
+
+	// Positioned triggers come first, in position order; the rest keep their natural order.
+	sort.SliceStable(entries, func(i, j int) bool {
+		pi, pj := entries[i].position, entries[j].position
+		if pi == nil || pj == nil {
+			return pi != nil && pj == nil
+		}
+		return *pi < *pj
+	})
+	for _, e := range entries {
+		e.trigger.positioned = e.position != nil
+		merged.Triggers = append(merged.Triggers, e.trigger)
+		merged.sources = append(merged.sources, e.source)
+	}
+
+	problems := append(validateConfig(&merged), resolveStoredSecrets(&merged, file)...)
+	problems = append(problems, compileSchedules(&merged)...)
+	problems = slices.DeleteFunc(problems, func(p configProblem) bool { return p.Warning })
+	if len(problems) > 0 {
+		return nil, &configError{Problems: problems}
+	}
+	return &merged, nil
+}
+
+// applyFileConfig merges the stored triggers over a newly loaded file config and makes the
+// result live. The caller must hold configMutex for writing.
+func (app *App) applyFileConfig(file *Config) error {
+	stored, err := loadStoredTriggers(app.db)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeTriggers(file, stored)
+	if err != nil {
+		return err
+	}
+	app.fileConfig = file
+	app.config = merged
+	return nil
+}
+
+// triggerRequestError is a client error from a stored-trigger change, with its HTTP status.
+type triggerRequestError struct {
+	status  int
+	message string
+}
+
+func (e *triggerRequestError) Error() string { return e.message }
+
+// changeStoredTriggers runs change in a transaction, validates the resulting merged config and,
+// if it is valid, commits the change together with its audit record and makes it live.
+func (app *App) changeStoredTriggers(actor, action, target string, details interface{}, change func(tx *sql.Tx) error) error {
+	app.configMutex.Lock()
+	defer app.configMutex.Unlock()
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := change(tx); err != nil {
+		return err
+	}
+	stored, err := loadStoredTriggers(tx)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeTriggers(app.fileConfig, stored)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(tx, actor, action, target, details); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	app.config = merged
+	log.Printf("Admin %s: %s %s. Now %d triggers.", actor, action, target, len(merged.Triggers))
+	return nil
+}
+
+// adminTriggerView is a trigger as listed for the trigger editor.
+type adminTriggerView struct {
+	Trigger   Trigger    `json:"trigger"`
+	Origin    string     `json:"origin"` // "file", "database" or "override"
+	Source    string     `json:"source"` // File the trigger comes from, or "database"
+	Disabled  bool       `json:"disabled"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+}
+
+// listAdminTriggers returns every trigger, enabled ones in their effective order followed by
+// the disabled ones. The caller must hold configMutex.
+func (app *App) listAdminTriggers() ([]adminTriggerView, error) {
+	stored, err := loadStoredTriggers(app.db)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]storedTrigger, len(stored))
+	for _, st := range stored {
+		byID[st.ID] = st
+	}
+	fileSource := make(map[string]string)
+	for i, t := range app.fileConfig.Triggers {
+		fileSource[t.ID] = app.fileConfig.path
+		if i < len(app.fileConfig.sources) {
+			fileSource[t.ID] = app.fileConfig.sources[i].file
+		}
+	}
+
+	view := func(t Trigger) adminTriggerView {
+		v := adminTriggerView{Trigger: withRedactedSecrets(t), Origin: "file", Source: fileSource[t.ID]}
+		if st, ok := byID[t.ID]; ok {
+			v.Disabled = st.Disabled
+			v.UpdatedAt, v.UpdatedBy = &st.UpdatedAt, st.UpdatedBy
+			if st.Trigger != nil {
+				v.Origin, v.Source = "database", storedTriggerFile
+				if _, inFile := fileSource[t.ID]; inFile {
+					v.Origin = "override"
+				}
+			}
+		}
+		return v
+	}
+
+	visible := make([]*Trigger, len(app.config.Triggers))
+	for i := range app.config.Triggers {
+		visible[i] = &app.config.Triggers[i]
+	}
+	sortTriggers(visible) // The order the arrows move triggers in
+	views := []adminTriggerView{}
+	for _, t := range visible {
+		views = append(views, view(*t))
+	}
+	for _, t := range app.fileConfig.Triggers {
+		if st, ok := byID[t.ID]; ok && st.Disabled {
+			if st.Trigger != nil {
+				t = *st.Trigger
+			}
+			views = append(views, view(t))
+		}
+	}
+	for _, st := range stored {
+		if _, ok := fileSource[st.ID]; !ok && st.Trigger != nil && st.Disabled {
+			views = append(views, view(*st.Trigger))
+		}
+	}
+	return views, nil
+}
+
+// decodeTriggerBody reads a trigger definition from a request, rejecting unknown fields and
+// secret references, which only the config files may use (see secrets.go).
+func decodeTriggerBody(r *http.Request) (*Trigger, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var t Trigger
+	if err := decoder.Decode(&t); err != nil {
+		return nil, &triggerRequestError{http.StatusBadRequest, fmt.Sprintf("Invalid trigger definition: %v", err)}
+	}
+	if field := secretReferenceField(&t); field != "" {
+		return nil, &triggerRequestError{http.StatusBadRequest, fmt.Sprintf("%s: secret references (env: and file:) can only be used in config files; enter the secret itself", field)}
+	}
+	return &t, nil
+}
+
+func (app *App) adminTriggersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireRole(w, r, writeRole(r, roleOperator))
+		if !ok {
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/triggers"), "/")
+		var err error
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			app.configMutex.RLock()
+			views, listErr := app.listAdminTriggers()
+			app.configMutex.RUnlock()
+			if listErr != nil {
+				log.Printf("ERROR: could not list triggers: %v", listErr)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(views)
+			return
+		case id == "" && r.Method == http.MethodPost:
+			err = app.createStoredTrigger(r, user)
+		case id == "reorder" && r.Method == http.MethodPost:
+			err = app.reorderTriggers(r, user)
+		case id != "" && r.Method == http.MethodPut:
+			err = app.updateStoredTrigger(r, user, id)
+		case id != "" && r.Method == http.MethodPatch:
+			err = app.setTriggerDisabled(r, user, id)
+		case id != "" && r.Method == http.MethodDelete:
+			err = app.deleteStoredTrigger(user, id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqErr *triggerRequestError
+		var cfgErr *configError
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.As(err, &reqErr):
+			http.Error(w, reqErr.message, reqErr.status)
+		case errors.As(err, &cfgErr):
+			http.Error(w, cfgErr.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("ERROR: could not change triggers: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// triggerDefined reports whether a trigger with the id exists in the file config or has a
+// stored definition. The caller must hold configMutex.
+func (app *App) triggerDefined(tx *sql.Tx, id string) (inFile bool, inDB bool, err error) {
+	inFile = slices.ContainsFunc(app.fileConfig.Triggers, func(t Trigger) bool { return t.ID == id })
+	err = tx.QueryRow("SELECT COUNT(*) FROM db_triggers WHERE id = ? AND definition IS NOT NULL", id).Scan(&inDB)
+	return inFile, inDB, err
+}
+
+// triggerDefinition returns the definition in effect for id, disabled or not: the stored one if
+// there is one, otherwise the file's, or nil if there is neither. The caller must hold configMutex.
+func (app *App) triggerDefinition(id string) (*Trigger, error) {
+	stored, err := loadStoredTriggers(app.db)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range stored {
+		if st.ID == id && st.Trigger != nil {
+			return st.Trigger, nil
+		}
+	}
+	for i := range app.fileConfig.Triggers {
+		if app.fileConfig.Triggers[i].ID == id {
+			t := app.fileConfig.Triggers[i]
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+
+// auditTrigger is how a trigger definition is written to the audit log: without secrets.
+func auditTrigger(t *Trigger) *Trigger {
+	if t == nil {
+		return nil
+	}
+	redacted := withRedactedSecrets(*t)
+	return &redacted
+}
+
+func (app *App) createStoredTrigger(r *http.Request, user *User) error {
+	t, err := decodeTriggerBody(r)
+	if err != nil {
+		return err
+	}
+	if t.ID == "" {
+		return &triggerRequestError{http.StatusBadRequest, "Trigger id is required"}
+	}
+	if hasRedactedSecret(t) {
+		return &triggerRequestError{http.StatusBadRequest, fmt.Sprintf("Secret fields of a new trigger can't be %q", redactedSecret)}
+	}
+	definition, _ := json.Marshal(t)
+
+	return app.changeStoredTriggers(user.actor(), "trigger.create", t.ID, map[string]interface{}{"after": auditTrigger(t)}, func(tx *sql.Tx) error {
+		inFile, inDB, err := app.triggerDefined(tx, t.ID)
+		if err != nil {
+			return err
+		}
+		if inFile || inDB {
+			return &triggerRequestError{http.StatusConflict, fmt.Sprintf("Trigger %q already exists; use PUT to change it", t.ID)}
+		}
+		_, err = tx.Exec(`INSERT INTO db_triggers (id, definition, updated_by) VALUES (?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET definition = excluded.definition, updated_at = CURRENT_TIMESTAMP, updated_by = excluded.updated_by`,
+			t.ID, string(definition), user.actor())
+		return err
+	})
+}
+
+// updateStoredTrigger replaces a stored trigger's definition, or overrides a file trigger.
+func (app *App) updateStoredTrigger(r *http.Request, user *User, id string) error {
+	t, err := decodeTriggerBody(r)
+	if err != nil {
+		return err
+	}
+	if t.ID == "" {
+		t.ID = id
+	}
+	if t.ID != id {
+		return &triggerRequestError{http.StatusBadRequest, "Trigger id can't be changed; delete it and create a new one"}
+	}
+
+	app.configMutex.RLock()
+	before, err := app.triggerDefinition(id)
+	app.configMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	// The editor is given redacted secrets; unchanged placeholders keep the current secret.
+	restoreRedactedSecrets(t, before)
+	if hasRedactedSecret(t) && before != nil && !sameSecretTarget(t, before) {
+		return &triggerRequestError{http.StatusBadRequest, "Secrets have to be entered again when arduino_ip, hue_bridge_ip or command changes"}
+	}
+	if hasRedactedSecret(t) {
+		return &triggerRequestError{http.StatusBadRequest, fmt.Sprintf("New secret fields can't be %q", redactedSecret)}
+	}
+	definition, _ := json.Marshal(t)
+
+	return app.changeStoredTriggers(user.actor(), "trigger.update", id, map[string]interface{}{"before": auditTrigger(before), "after": auditTrigger(t)}, func(tx *sql.Tx) error {
+		inFile, inDB, err := app.triggerDefined(tx, id)
+		if err != nil {
+			return err
+		}
+		if !inFile && !inDB {
+			return &triggerRequestError{http.StatusNotFound, "Trigger not found"}
+		}
+		_, err = tx.Exec(`INSERT INTO db_triggers (id, definition, updated_by) VALUES (?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET definition = excluded.definition, updated_at = CURRENT_TIMESTAMP, updated_by = excluded.updated_by`,
+			id, string(definition), user.actor())
+		return err
+	})
+}
+
+func (app *App) setTriggerDisabled(r *http.Request, user *User, id string) error {
+	var payload struct {
+		Disabled *bool `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Disabled == nil {
+		return &triggerRequestError{http.StatusBadRequest, `Expected {"disabled": true|false}`}
+	}
+
+	action := "trigger.enable"
+	if *payload.Disabled {
+		action = "trigger.disable"
+	}
+	return app.changeStoredTriggers(user.actor(), action, id, nil, func(tx *sql.Tx) error {
+		inFile, inDB, err := app.triggerDefined(tx, id)
+		if err != nil {
+			return err
+		}
+		if !inFile && !inDB {
+			return &triggerRequestError{http.StatusNotFound, "Trigger not found"}
+		}
+		if *payload.Disabled && app.triggerStates[id].Disabled {
+			return &triggerRequestError{http.StatusConflict, "Trigger is offline, which keeps it on the dashboard with the reason; bring it back online before hiding it"}
+		}
+		_, err = tx.Exec(`INSERT INTO db_triggers (id, disabled, updated_by) VALUES (?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET disabled = excluded.disabled, updated_at = CURRENT_TIMESTAMP, updated_by = excluded.updated_by`,
+			id, *payload.Disabled, user.actor())
+		return err
+	})
+}
+
+// reorderTriggers sets the display order. Triggers not listed keep their natural order after
+// the listed ones.
+func (app *App) reorderTriggers(r *http.Request, user *User) error {
+	var payload struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return &triggerRequestError{http.StatusBadRequest, `Expected {"ids": ["first", "second", ...]}`}
+	}
+
+	return app.changeStoredTriggers(user.actor(), "trigger.reorder", "", map[string]interface{}{"order": payload.IDs}, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE db_triggers SET position = NULL"); err != nil {
+			return err
+		}
+		for i, id := range payload.IDs {
+			inFile, inDB, err := app.triggerDefined(tx, id)
+			if err != nil {
+				return err
+			}
+			if !inFile && !inDB {
+				return &triggerRequestError{http.StatusBadRequest, fmt.Sprintf("Unknown trigger %q", id)}
+			}
+			_, err = tx.Exec(`INSERT INTO db_triggers (id, position, updated_by) VALUES (?, ?, ?)
+				ON CONFLICT(id) DO UPDATE SET position = excluded.position, updated_at = CURRENT_TIMESTAMP, updated_by = excluded.updated_by`,
+				id, i, user.actor())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteStoredTrigger removes everything stored for a trigger. For an overridden file trigger
+// this restores the file's definition; file-only triggers can't be deleted here.
+func (app *App) deleteStoredTrigger(user *User, id string) error {
+	app.configMutex.RLock()
+	before, err := app.triggerDefinition(id)
+	app.configMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return app.changeStoredTriggers(user.actor(), "trigger.delete", id, map[string]interface{}{"before": auditTrigger(before)}, func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM db_triggers WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			if slices.ContainsFunc(app.fileConfig.Triggers, func(t Trigger) bool { return t.ID == id }) {
+				return &triggerRequestError{http.StatusConflict, "Trigger is defined in the config file; disable it instead"}
+			}
+			return &triggerRequestError{http.StatusNotFound, "Trigger not found"}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestStoredTriggerSecretReferences checks that triggers edited on the dashboard can't read the
+// server's environment or files through env: and file: references.
+func TestStoredTriggerSecretReferences(t *testing.T) {
+	t.Setenv("DOOR_KEY", "door-secret")
+	t.Setenv("ADMIN_SECRET_KEY", "owner-secret")
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"triggers": [{"id": "door", "name": "Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "env:DOOR_KEY"}]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	app := newTestApp(t, file)
+	operator := &User{ID: "op", IsAdmin: true, Role: roleOperator}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantError  string // Part of the error message, for a 400
+		wantKey    string // Resolved secret_key of trigger "door" afterwards
+	}{
+		{
+			name:       "env reference to an owner secret",
+			method:     http.MethodPost,
+			target:     "/api/admin/triggers",
+			body:       `{"id": "leak", "name": "Leak", "description": "x", "arduino_ip": "attacker.example", "secret_key": "env:ADMIN_SECRET_KEY"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "secret references",
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "file reference",
+			method:     http.MethodPost,
+			target:     "/api/admin/triggers",
+			body:       `{"id": "leak", "name": "Leak", "description": "x", "arduino_ip": "attacker.example", "secret_key": "file:/etc/passwd"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "secret references",
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "reference in a command env",
+			method:     http.MethodPost,
+			target:     "/api/admin/triggers",
+			body:       `{"id": "leak", "name": "Leak", "description": "x", "type": "command", "command": "/bin/true", "env": {"K": "env:ADMIN_SECRET_KEY"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "secret references",
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "override pointed at another reference",
+			method:     http.MethodPut,
+			target:     "/api/admin/triggers/door",
+			body:       `{"name": "Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "env:ADMIN_SECRET_KEY"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "secret references",
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "override keeping the file's reference",
+			method:     http.MethodPut,
+			target:     "/api/admin/triggers/door",
+			body:       `{"name": "Front Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "[REDACTED]"}`,
+			wantStatus: http.StatusNoContent,
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "override moving a redacted secret to another address",
+			method:     http.MethodPut,
+			target:     "/api/admin/triggers/door",
+			body:       `{"name": "Door", "description": "Creak", "arduino_ip": "attacker.example", "secret_key": "[REDACTED]"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "entered again",
+			wantKey:    "door-secret",
+		},
+		{
+			name:       "override with a literal secret",
+			method:     http.MethodPut,
+			target:     "/api/admin/triggers/door",
+			body:       `{"name": "Front Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "new-secret"}`,
+			wantStatus: http.StatusNoContent,
+			wantKey:    "new-secret",
+		},
+		{
+			name:       "literal secret moved to another address",
+			method:     http.MethodPut,
+			target:     "/api/admin/triggers/door",
+			body:       `{"name": "Front Door", "description": "Creak", "arduino_ip": "attacker.example", "secret_key": "[REDACTED]"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "entered again",
+			wantKey:    "new-secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			app.adminTriggersHandler()(rec, requestAs(operator, tt.method, tt.target, tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.wantError)
+			}
+			for _, tr := range app.config.Triggers {
+				if tr.ID == "leak" {
+					t.Errorf("trigger %q was created", tr.ID)
+				}
+				if tr.ID == "door" && tr.secrets.secretKey != tt.wantKey {
+					t.Errorf("door secret = %q, want %q", tr.secrets.secretKey, tt.wantKey)
+				}
+			}
+		})
+	}
+
+	// A reference that got into the database anyway isn't resolved, not even the file's own
+	// reference once the override sends it somewhere else.
+	stored := []struct{ id, definition string }{
+		{"leak", `{"id": "leak", "name": "Leak", "description": "x", "arduino_ip": "attacker.example", "secret_key": "env:ADMIN_SECRET_KEY"}`},
+		{"door", `{"id": "door", "name": "Door", "description": "Creak", "arduino_ip": "attacker.example", "secret_key": "env:DOOR_KEY"}`},
+	}
+	for _, st := range stored {
+		if _, err := app.db.Exec(`INSERT INTO db_triggers (id, definition, updated_by) VALUES (?, ?, 'test')
+			ON CONFLICT(id) DO UPDATE SET definition = excluded.definition`, st.id, st.definition); err != nil {
+			t.Fatal(err)
+		}
+		triggers, err := loadStoredTriggers(app.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "db_triggers[" + st.id + "].secret_key"
+		var cfgErr *configError
+		if _, err := mergeTriggers(app.fileConfig, triggers); !errors.As(err, &cfgErr) || !strings.Contains(err.Error(), want) {
+			t.Errorf("mergeTriggers error = %v, want a problem at %s", err, want)
+		}
+		if _, err := app.db.Exec("DELETE FROM db_triggers WHERE id = ?", st.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestHiddenAndOfflineAreExclusive checks that a trigger can't be hidden and offline at once,
+// so each switch keeps the meaning the Manage Triggers page gives it.
+func TestHiddenAndOfflineAreExclusive(t *testing.T) {
+	app := newTestApp(t, &Config{Triggers: []Trigger{
+		{ID: "door", Name: "Door", Description: "Creak", ArduinoIP: "10.0.0.5", SecretKey: "k"},
+		{ID: "fog", Name: "Fog", Description: "Whoosh", ArduinoIP: "10.0.0.6", SecretKey: "k"},
+	}})
+	if err := app.loadOfflineStates(); err != nil {
+		t.Fatalf("loadOfflineStates: %v", err)
+	}
+	operator := &User{ID: "op", IsAdmin: true, Role: roleOperator}
+
+	steps := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{name: "take door offline", target: "/api/admin/trigger-states/door", body: `{"disabled": true, "reason": "Hinge broke"}`, wantStatus: http.StatusNoContent},
+		{name: "hide offline door", target: "/api/admin/triggers/door", body: `{"disabled": true}`, wantStatus: http.StatusConflict},
+		{name: "bring door online", target: "/api/admin/trigger-states/door", body: `{"disabled": false}`, wantStatus: http.StatusNoContent},
+		{name: "hide door", target: "/api/admin/triggers/door", body: `{"disabled": true}`, wantStatus: http.StatusNoContent},
+		{name: "take hidden door offline", target: "/api/admin/trigger-states/door", body: `{"disabled": true, "reason": "Hinge broke"}`, wantStatus: http.StatusConflict},
+		{name: "take unknown trigger offline", target: "/api/admin/trigger-states/ghost", body: `{"disabled": true}`, wantStatus: http.StatusNotFound},
+		{name: "hide fog", target: "/api/admin/triggers/fog", body: `{"disabled": true}`, wantStatus: http.StatusNoContent},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		req := requestAs(operator, http.MethodPatch, step.target, step.body)
+		if strings.HasPrefix(step.target, "/api/admin/trigger-states/") {
+			app.triggerStatesHandler()(rec, req)
+		} else {
+			app.adminTriggersHandler()(rec, req)
+		}
+		if rec.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d (%s), want %d", step.name, rec.Code, strings.TrimSpace(rec.Body.String()), step.wantStatus)
+		}
+	}
+	if len(app.config.Triggers) != 0 || app.triggerStates["door"].Disabled {
+		t.Errorf("got %d visible triggers and door offline = %v, want both hidden and online", len(app.config.Triggers), app.triggerStates["door"].Disabled)
+	}
+}
+
+// TestReorderTriggers checks that the order set on the Manage Triggers page is the order the
+// dashboard shows, even across different "order" values, and that unordered triggers follow.
+func TestReorderTriggers(t *testing.T) {
+	app := newTestApp(t, &Config{Triggers: []Trigger{
+		{ID: "door", Name: "Door", Description: "Creak", ArduinoIP: "10.0.0.5", SecretKey: "k", Order: 2},
+		{ID: "fog", Name: "Fog", Description: "Whoosh", ArduinoIP: "10.0.0.6", SecretKey: "k", Order: 1},
+		{ID: "bats", Name: "Bats", Description: "Flap", ArduinoIP: "10.0.0.7", SecretKey: "k", Order: 3},
+	}})
+	operator := &User{ID: "op", IsAdmin: true, Role: roleOperator}
+	shown := func() []string {
+		var ids []string
+		for _, zone := range app.groupTriggers(func(*Trigger) bool { return true }) {
+			for _, p := range zone.Triggers {
+				ids = append(ids, p.ID)
+			}
+		}
+		return ids
+	}
+	// The arrows move triggers in the order Manage Triggers lists them, so it must match.
+	listed := func() []string {
+		views, err := app.listAdminTriggers()
+		if err != nil {
+			t.Fatalf("listAdminTriggers: %v", err)
+		}
+		var ids []string
+		for _, v := range views {
+			ids = append(ids, v.Trigger.ID)
+		}
+		return ids
+	}
+
+	if got, want := shown(), []string{"fog", "door", "bats"}; !slices.Equal(got, want) {
+		t.Errorf("before reordering got %q, want %q", got, want)
+	}
+	if got, want := listed(), shown(); !slices.Equal(got, want) {
+		t.Errorf("Manage Triggers lists %q, want the dashboard order %q", got, want)
+	}
+
+	tests := []struct {
+		ids  string
+		want []string
+	}{
+		{ids: `["bats", "door", "fog"]`, want: []string{"bats", "door", "fog"}},
+		{ids: `["door", "bats"]`, want: []string{"door", "bats", "fog"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		app.adminTriggersHandler()(rec, requestAs(operator, http.MethodPost, "/api/admin/triggers/reorder", `{"ids": `+tt.ids+`}`))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("reorder %s: status = %d (%s)", tt.ids, rec.Code, strings.TrimSpace(rec.Body.String()))
+		}
+		if got := shown(); !slices.Equal(got, tt.want) {
+			t.Errorf("after reordering %s got %q, want %q", tt.ids, got, tt.want)
+		}
+		if got := listed(); !slices.Equal(got, tt.want) {
+			t.Errorf("after reordering %s Manage Triggers lists %q, want %q", tt.ids, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Development Device Emulators ---
+// With DEV_EMULATORS=true the dashboard starts fake Govee LAN devices and a fake Arduino
+// in-process so every trigger can be exercised on a laptop. Govee devices are emulated for
+// each loopback govee_device_ip in the config (127.0.0.2, 127.0.0.3, ...), since every
+// device needs its own address to listen on UDP port 4003.
+
+const (
+	defaultEmulatedArduinoAddr = "127.0.0.1:8081"
+	maxEmulatedArduinoHits     = 50
+)
+
+// emulatedGoveeDevice is a fake Govee light listening on ip:4003.
+type emulatedGoveeDevice struct {
+	IP           string     `json:"ip"`
+	State        goveeState `json:"state"`
+	LastCommand  string     `json:"last_command,omitempty"`
+	LastSeen     time.Time  `json:"last_seen,omitempty"`
+	CommandCount int        `json:"command_count"`
+}
+
+// emulatedArduinoHit is one request received by the fake Arduino.
+type emulatedArduinoHit struct {
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	Key  string    `json:"key"`
+}
+
+// devEmulators holds the simulated state of every fake device.
+type devEmulators struct {
+	mu          sync.Mutex
+	govee       map[string]*emulatedGoveeDevice
+	arduinoAddr string
+	arduinoHits []emulatedArduinoHit
+}
+
+// startDevEmulators starts the fake devices for the given config.
+func startDevEmulators(config *Config, arduinoAddr string) (*devEmulators, error) {
+	emu := &devEmulators{govee: make(map[string]*emulatedGoveeDevice), arduinoAddr: arduinoAddr}
+
+	for _, t := range config.Triggers {
+		ip := net.ParseIP(t.GoveeDeviceIP)
+		if t.GoveeDeviceIP == "" || emu.govee[t.GoveeDeviceIP] != nil {
+			continue
+		}
+		if ip == nil || !ip.IsLoopback() {
+			log.Printf("DEV EMULATORS: Skipping Govee device %s for trigger '%s'; only loopback addresses (127.0.0.x) can be emulated.", t.GoveeDeviceIP, t.ID)
+			continue
+		}
+		if err := emu.startGoveeDevice(t.GoveeDeviceIP); err != nil {
+			return nil, err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trigger", emu.arduinoHandler)
+	listener, err := net.Listen("tcp", arduinoAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start fake arduino on %s: %w", arduinoAddr, err)
+	}
+	go http.Serve(listener, mux)
+	log.Printf("DEV EMULATORS: Fake Arduino listening on http://%s/trigger", arduinoAddr)
+
+	return emu, nil
+}
+
+func (emu *devEmulators) startGoveeDevice(ip string) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: goveePort})
+	if err != nil {
+		return fmt.Errorf("failed to start fake govee device on %s: %w", ip, err)
+	}
+
+	device := &emulatedGoveeDevice{
+		IP:    ip,
+		State: goveeState{On: 1, Brightness: 100, Color: goveeRGB{R: 255, G: 147, B: 41}},
+	}
+	emu.govee[ip] = device
+	log.Printf("DEV EMULATORS: Fake Govee device listening on %s:%d", ip, goveePort)
+
+	go func() {
+		defer conn.Close()
+		buffer := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				log.Printf("DEV EMULATORS: Fake Govee device %s stopped: %v", ip, err)
+				return
+			}
+			emu.handleGoveeCommand(device, buffer[:n], from)
+		}
+	}()
+	return nil
+}
+
+func (emu *devEmulators) handleGoveeCommand(device *emulatedGoveeDevice, payload []byte, from *net.UDPAddr) {
+	var msg struct {
+		Msg struct {
+			Cmd  string          `json:"cmd"`
+			Data json.RawMessage `json:"data"`
+		} `json:"msg"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("DEV EMULATORS: Fake Govee device %s received invalid payload: %v", device.IP, err)
+		return
+	}
+
+	emu.mu.Lock()
+	device.LastCommand = string(payload)
+	device.LastSeen = time.Now()
+	device.CommandCount++
+
+	switch msg.Msg.Cmd {
+	case "turn":
+		var data struct {
+			Value int `json:"value"`
+		}
+		if json.Unmarshal(msg.Msg.Data, &data) == nil {
+			device.State.On = data.Value
+		}
+	case "brightness":
+		var data struct {
+			Value int `json:"value"`
+		}
+		if json.Unmarshal(msg.Msg.Data, &data) == nil {
+			device.State.Brightness = data.Value
+		}
+	case "colorwc":
+		var data goveeColorWCData
+		if json.Unmarshal(msg.Msg.Data, &data) == nil {
+			device.State.Color = data.Color
+			device.State.ColorTemperature = data.ColorTemperature
+		}
+	}
+	state := device.State
+	emu.mu.Unlock()
+
+	if msg.Msg.Cmd != "devStatus" {
+		return
+	}
+
+	// Real devices answer status requests on the sender's address, port 4002.
+	reply := struct {
+		Msg struct {
+			Cmd  string     `json:"cmd"`
+			Data goveeState `json:"data"`
+		} `json:"msg"`
+	}{}
+	reply.Msg.Cmd = "devStatus"
+	reply.Msg.Data = state
+	replyBytes, _ := json.Marshal(reply)
+
+	conn, err := net.Dial("udp", net.JoinHostPort(from.IP.String(), strconv.Itoa(goveeListenPort)))
+	if err != nil {
+		log.Printf("DEV EMULATORS: Fake Govee device %s could not reply: %v", device.IP, err)
+		return
+	}
+	defer conn.Close()
+	conn.Write(replyBytes)
+}
+
+func (emu *devEmulators) arduinoHandler(w http.ResponseWriter, r *http.Request) {
+	hit := emulatedArduinoHit{Time: time.Now(), Host: r.Host, Key: r.URL.Query().Get("key")}
+
+	emu.mu.Lock()
+	emu.arduinoHits = append([]emulatedArduinoHit{hit}, emu.arduinoHits...)
+	if len(emu.arduinoHits) > maxEmulatedArduinoHits {
+		emu.arduinoHits = emu.arduinoHits[:maxEmulatedArduinoHits]
+	}
+	emu.mu.Unlock()
+
+	log.Printf("DEV EMULATORS: Fake Arduino triggered via %s", r.Host)
+	fmt.Fprintln(w, "triggered")
+}
+
+// emulatorSnapshot is the JSON view of every fake device.
+type emulatorSnapshot struct {
+	Govee       []emulatedGoveeDevice `json:"govee"`
+	ArduinoAddr string                `json:"arduino_addr"`
+	ArduinoHits []emulatedArduinoHit  `json:"arduino_hits"`
+}
+
+func (emu *devEmulators) snapshot() emulatorSnapshot {
+	emu.mu.Lock()
+	defer emu.mu.Unlock()
+
+	snap := emulatorSnapshot{ArduinoAddr: emu.arduinoAddr, ArduinoHits: append([]emulatedArduinoHit(nil), emu.arduinoHits...)}
+	for _, d := range emu.govee {
+		snap.Govee = append(snap.Govee, *d)
+	}
+	sort.Slice(snap.Govee, func(i, j int) bool { return snap.Govee[i].IP < snap.Govee[j].IP })
+	return snap
+}
+
+// stateHandler and pageHandler show the Arduino keys the emulator received, so they are for
+// admins only.
+func (emu *devEmulators) stateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireRole(w, r, roleViewer); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(emu.snapshot())
+	}
+}
+
+var emulatorPageTemplate = template.Must(template.New("emulators").Funcs(template.FuncMap{
+	// swatch renders what the light currently looks like, dimmed by brightness.
+	"swatch": func(s goveeState) template.CSS {
+		if s.On == 0 {
+			return "background-color: #000;"
+		}
+		r, g, b := s.Color.R, s.Color.G, s.Color.B
+		if s.ColorTemperature > 0 {
+			r, g, b = 255, 214, 170 // Approximate warm/neutral white for colour temperature mode.
+		}
+		return template.CSS(fmt.Sprintf("background-color: rgb(%d, %d, %d); opacity: %.2f;", r, g, b, 0.15+0.85*float64(s.Brightness)/100))
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<meta http-equiv="refresh" content="1">
+	<title>Device Emulators</title>
+	<link rel="stylesheet" href="/style.css">
+	<style>
+		.device { display: flex; align-items: center; gap: 1rem; text-align: left; }
+		.swatch { width: 64px; height: 64px; border-radius: 50%; border: 2px solid #444; flex-shrink: 0; }
+		code { word-break: break-all; color: #aaa; }
+		table { width: 100%; border-collapse: collapse; }
+		th, td { padding: 0.4rem; text-align: left; border-bottom: 1px solid #444; }
+	</style>
+</head>
+<body>
+	<div class="content-wrapper">
+		<h1>Device Emulators</h1>
+		<h2>Govee Lights</h2>
+		{{range .Govee}}
+		<div class="box device">
+			<div class="swatch" style="{{swatch .State}}"></div>
+			<div>
+				<strong>{{.IP}}</strong> &mdash; {{if eq .State.On 1}}On{{else}}Off{{end}}, brightness {{.State.Brightness}}%,
+				{{if gt .State.ColorTemperature 0}}{{.State.ColorTemperature}}K{{else}}rgb({{.State.Color.R}}, {{.State.Color.G}}, {{.State.Color.B}}){{end}}
+				<br>{{.CommandCount}} commands{{if .LastCommand}}, last: <code>{{.LastCommand}}</code>{{end}}
+			</div>
+		</div>
+		{{else}}
+		<div class="box">No Govee devices emulated. Use loopback addresses such as 127.0.0.2 for <code>govee_device_ip</code>.</div>
+		{{end}}
+		<h2>Arduino ({{.ArduinoAddr}})</h2>
+		<div class="box">
+			<table>
+				<tr><th>Time</th><th>Host</th><th>Key</th></tr>
+				{{range .ArduinoHits}}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Host}}</td><td>{{.Key}}</td></tr>
+				{{else}}<tr><td colspan="3">No requests yet.</td></tr>{{end}}
+			</table>
+		</div>
+	</div>
+</body>
+</html>`))
+
+func (emu *devEmulators) pageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireRole(w, r, roleViewer); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := emulatorPageTemplate.Execute(w, emu.snapshot()); err != nil {
+			log.Printf("ERROR: could not render emulator page: %v", err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// --- Philips Hue Local API Implementation ---
+// Talks to a Hue bridge (or any Zigbee bridge exposing the Hue v1 REST API, e.g. deCONZ)
+// on the local network using an application key created via the bridge's link button.
+
+// Hue brightness is 1-254, colour temperature is expressed in mireds (153-500).
+const (
+	hueMinBrightness = 1
+	hueMaxBrightness = 254
+	hueMinMired      = 153
+	hueMaxMired      = 500
+)
+
+// hueLightState mirrors the subset of a Hue light's "state" object that we read and write.
+// Pointer fields are omitted from PUT bodies when nil so only the requested aspects change.
+type hueLightState struct {
+	On             *bool       `json:"on,omitempty"`
+	Brightness     *int        `json:"bri,omitempty"`
+	XY             *[2]float64 `json:"xy,omitempty"`
+	Mired          *int        `json:"ct,omitempty"`
+	Alert          string      `json:"alert,omitempty"`
+	TransitionTime *int        `json:"transitiontime,omitempty"` // In multiples of 100ms.
+	ColorMode      string      `json:"colormode,omitempty"`      // Read-only: "xy", "ct" or "hs".
+}
+
+// hueLight adapts a single light on a Hue bridge to the Light interface.
+// When sim is set, requests are recorded to the simulation transcript instead of being sent.
+type hueLight struct {
+	client   *http.Client
+	bridgeIP string
+	appKey   string
+	lightID  string
+	sim      *simulation
+}
+
+func (l *hueLight) String() string {
+	return fmt.Sprintf("Hue light %s on %s", l.lightID, l.bridgeIP)
+}
+
+func (l *hueLight) url() string {
+	return fmt.Sprintf("http://%s/api/%s/lights/%s", l.bridgeIP, l.appKey, l.lightID)
+}
+
+// redactedURL is url() without the app key, for logs and simulation transcripts.
+func (l *hueLight) redactedURL() string {
+	return fmt.Sprintf("http://%s/api/REDACTED/lights/%s", l.bridgeIP, l.lightID)
+}
+
+// hueAPIError is the error element returned by the bridge inside a 200 OK response.
+type hueAPIError struct {
+	Error *struct {
+		Type        int    `json:"type"`
+		Address     string `json:"address"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+func (l *hueLight) getState() (*hueLightState, error) {
+	resp, err := l.client.Get(l.url())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hue bridge: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("hue bridge returned an error status: %s", resp.Status)
+	}
+
+	// On failure the bridge answers 200 with a JSON array of errors instead of the light object.
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode hue status response: %w", err)
+	}
+	if err := hueCheckErrors(raw); err != nil {
+		return nil, err
+	}
+
+	var light struct {
+		State hueLightState `json:"state"`
+	}
+	if err := json.Unmarshal(raw, &light); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hue status response: %w", err)
+	}
+
+	state := light.State
+	log.Printf("Hue Status Parsed: Power=%v, Brightness=%v, Mode=%s", state.On != nil && *state.On, state.Brightness, state.ColorMode)
+	return &state, nil
+}
+
+func (l *hueLight) setState(state hueLightState) error {
+	state.ColorMode = "" // Never send the read-only field back.
+	body, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hue state: %w", err)
+	}
+
+	if l.sim != nil {
+		l.sim.record("http", "PUT "+l.redactedURL()+"/state", string(body))
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, l.url()+"/state", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build hue request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Printf("Sending Hue state to %s: %s", l, string(body))
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to hue bridge: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("hue bridge returned an error status: %s", resp.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to decode hue response: %w", err)
+	}
+	return hueCheckErrors(raw)
+}
+
+// hueCheckErrors returns the first error reported by the bridge, if the payload is an error list.
+func hueCheckErrors(raw json.RawMessage) error {
+	var results []hueAPIError
+	if err := json.Unmarshal(raw, &results); err != nil {
+		return nil // Not an array, so not an error list.
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			return fmt.Errorf("hue bridge error %d at %s: %s", r.Error.Type, r.Error.Address, r.Error.Description)
+		}
+	}
+	return nil
+}
+
+func (l *hueLight) GetState() (*lightState, error) {
+	if l.sim != nil {
+		l.sim.record("http", "GET "+l.redactedURL(), "")
+		return simulatedLightState(), nil
+	}
+	state, err := l.getState()
+	if err != nil {
+		return nil, err
+	}
+	ls := &lightState{On: state.On != nil && *state.On}
+	if state.Brightness != nil {
+		ls.Brightness = max(1, int(math.Round(float64(*state.Brightness)*100/hueMaxBrightness)))
+	}
+	if state.ColorMode == "ct" && state.Mired != nil && *state.Mired > 0 {
+		ls.ColorTemp = int(math.Round(1_000_000 / float64(*state.Mired)))
+	} else if state.XY != nil {
+		r, g, b := hueRGB(state.XY[0], state.XY[1])
+		ls.Color = &GoveeColorCommandData{R: r, G: g, B: b}
+	}
+	return ls, nil
+}
+
+func (l *hueLight) SetPower(on bool) error {
+	return l.setState(hueLightState{On: &on})
+}
+
+func (l *hueLight) SetBrightness(percent int) error {
+	// Instant transitions; the bridge otherwise fades over 400ms and lightning flashes blur together.
+	bri, instant := hueBrightness(percent), 0
+	return l.setState(hueLightState{Brightness: &bri, TransitionTime: &instant})
+}
+
+func (l *hueLight) SetColor(r, g, b int) error {
+	xy := hueXY(r, g, b)
+	return l.setState(hueLightState{XY: &xy})
+}
+
+func (l *hueLight) SetColorTemp(kelvin int) error {
+	mired := hueMired(kelvin)
+	return l.setState(hueLightState{Mired: &mired})
+}
+
+// Alert runs the bridge's native alert: one breathe cycle, or 15 seconds of them when long is set.
+func (l *hueLight) Alert(long bool) error {
+	if long {
+		return l.setState(hueLightState{Alert: "lselect"})
+	}
+	return l.setState(hueLightState{Alert: "select"})
+}
+
+// hueBrightness converts a 1-100 percentage (the scale used for Govee) to Hue's 1-254 range.
+func hueBrightness(percent int) int {
+	bri := int(math.Round(float64(percent) * hueMaxBrightness / 100))
+	return max(hueMinBrightness, min(hueMaxBrightness, bri))
+}
+
+// hueMired converts a colour temperature in Kelvin to mireds, clamped to the range Hue accepts.
+func hueMired(kelvin int) int {
+	mired := int(math.Round(1_000_000 / float64(kelvin)))
+	return max(hueMinMired, min(hueMaxMired, mired))
+}
+
+// sRGB <-> CIE XYZ matrices for the Wide RGB D65 conversion recommended by Philips.
+var (
+	hueRGBToXYZ = [3][3]float64{
+		{0.4124, 0.3576, 0.1805},
+		{0.2126, 0.7152, 0.0722},
+		{0.0193, 0.1192, 0.9505},
+	}
+	hueXYZToRGB = [3][3]float64{
+		{3.2406, -1.5372, -0.4986},
+		{-0.9689, 1.8758, 0.0415},
+		{0.0557, -0.2040, 1.0570},
+	}
+)
+
+// hueXY converts an sRGB colour to CIE 1931 xy coordinates. Black maps to the D65 white
+// point since xy carries no brightness.
+func hueXY(r, g, b int) [2]float64 {
+	linear := func(c int) float64 {
+		v := float64(c) / 255
+		if v > 0.04045 {
+			return math.Pow((v+0.055)/1.055, 2.4)
+		}
+		return v / 12.92
+	}
+	rgb := [3]float64{linear(r), linear(g), linear(b)}
+
+	var xyz [3]float64
+	for i := range xyz {
+		xyz[i] = hueRGBToXYZ[i][0]*rgb[0] + hueRGBToXYZ[i][1]*rgb[1] + hueRGBToXYZ[i][2]*rgb[2]
+	}
+
+	sum := xyz[0] + xyz[1] + xyz[2]
+	if sum == 0 {
+		return [2]float64{0.3127, 0.3290}
+	}
+	round := func(f float64) float64 { return math.Round(f*10000) / 10000 }
+	return [2]float64{round(xyz[0] / sum), round(xyz[1] / sum)}
+}
+
+// hueRGB is the inverse of hueXY, returning the brightest sRGB colour with the given chromaticity.
+func hueRGB(x, y float64) (int, int, int) {
+	if y == 0 {
+		return 255, 255, 255
+	}
+	xyz := [3]float64{x / y, 1, (1 - x - y) / y}
+
+	var rgb [3]float64
+	for i := range rgb {
+		rgb[i] = max(0, hueXYZToRGB[i][0]*xyz[0]+hueXYZToRGB[i][1]*xyz[1]+hueXYZToRGB[i][2]*xyz[2])
+	}
+
+	// Scale so the strongest channel is at full intensity; brightness is carried separately.
+	peak := max(rgb[0], rgb[1], rgb[2])
+	if peak == 0 {
+		return 255, 255, 255
+	}
+	gamma := func(v float64) int {
+		v /= peak
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		return int(math.Round(max(0, min(1, v)) * 255))
+	}
+	return gamma(rgb[0]), gamma(rgb[1]), gamma(rgb[2])
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestHueConversions checks the brightness and colour temperature scales, including clamping
+// to the range the bridge accepts.
+func TestHueConversions(t *testing.T) {
+	brightness := []struct{ percent, want int }{
+		{0, hueMinBrightness},
+		{1, 3},
+		{50, 127},
+		{100, hueMaxBrightness},
+		{150, hueMaxBrightness},
+	}
+	for _, tt := range brightness {
+		if got := hueBrightness(tt.percent); got != tt.want {
+			t.Errorf("hueBrightness(%d) = %d, want %d", tt.percent, got, tt.want)
+		}
+	}
+
+	mired := []struct{ kelvin, want int }{
+		{2000, hueMaxMired}, // 500 exactly
+		{1000, hueMaxMired},
+		{2700, 370},
+		{4000, 250},
+		{6500, 154},
+		{10000, hueMinMired},
+	}
+	for _, tt := range mired {
+		if got := hueMired(tt.kelvin); got != tt.want {
+			t.Errorf("hueMired(%d) = %d, want %d", tt.kelvin, got, tt.want)
+		}
+	}
+}
+
+// TestHueColorRoundTrip converts sRGB colours to xy and back. xy carries no brightness, so
+// the result is the colour scaled until its strongest channel is at full intensity.
+func TestHueColorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		r, g, b int
+		wantXY  [2]float64 // Checked to 3 decimals, zero to skip
+		want    [3]int
+	}{
+		{name: "red", r: 255, wantXY: [2]float64{0.6400, 0.3300}, want: [3]int{255, 0, 0}},
+		{name: "green", g: 255, wantXY: [2]float64{0.3000, 0.6000}, want: [3]int{0, 255, 0}},
+		{name: "blue", b: 255, wantXY: [2]float64{0.1500, 0.0600}, want: [3]int{0, 0, 255}},
+		{name: "white", r: 255, g: 255, b: 255, wantXY: [2]float64{0.3127, 0.3290}, want: [3]int{255, 255, 255}},
+		{name: "black is the white point", wantXY: [2]float64{0.3127, 0.3290}, want: [3]int{255, 255, 255}},
+		{name: "dark red is scaled up", r: 128, want: [3]int{255, 0, 0}},
+		{name: "orange", r: 255, g: 128, want: [3]int{255, 128, 0}},
+		{name: "purple", r: 128, b: 255, want: [3]int{128, 0, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xy := hueXY(tt.r, tt.g, tt.b)
+			if tt.wantXY != [2]float64{} && (math.Abs(xy[0]-tt.wantXY[0]) > 0.001 || math.Abs(xy[1]-tt.wantXY[1]) > 0.001) {
+				t.Errorf("hueXY = %v, want %v", xy, tt.wantXY)
+			}
+			r, g, b := hueRGB(xy[0], xy[1])
+			for i, got := range [3]int{r, g, b} {
+				if d := got - tt.want[i]; d < -2 || d > 2 {
+					t.Errorf("hueRGB(hueXY) = (%d, %d, %d), want (%d, %d, %d) within 2", r, g, b, tt.want[0], tt.want[1], tt.want[2])
+					break
+				}
+			}
+		})
+	}
+
+	if r, g, b := hueRGB(0.3, 0); r != 255 || g != 255 || b != 255 {
+		t.Errorf("hueRGB with y = 0 is (%d, %d, %d), want white", r, g, b)
+	}
+}
+
+// TestHueCheckErrors checks that the first error in a bridge response is reported and that
+// success lists and non-list responses aren't errors.
+func TestHueCheckErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string // Empty for no error
+	}{
+		{name: "success", body: `[{"success": {"/lights/3/state/on": true}}]`},
+		{name: "object", body: `{"state": {"on": true}}`},
+		{name: "empty list", body: `[]`},
+		{
+			name:    "unauthorized",
+			body:    `[{"error": {"type": 1, "address": "/lights/3/state", "description": "unauthorized user"}}]`,
+			wantErr: "hue bridge error 1 at /lights/3/state: unauthorized user",
+		},
+		{
+			name: "first error after a success",
+			body: `[{"success": {"/lights/3/state/on": true}},
+				{"error": {"type": 201, "address": "/lights/3/state/bri", "description": "parameter, bri, is not modifiable. Device is set to off."}},
+				{"error": {"type": 3, "address": "/lights/9", "description": "resource not available"}}]`,
+			wantErr: "hue bridge error 201 at /lights/3/state/bri",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hueCheckErrors(json.RawMessage(tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Admin Invites ---
+// Owners give another device admin access with an invite link (shown as a QR code on the
+// dashboard) instead of the admin secret. An invite is a signed token naming a role and an
+// expiry. Its ID is recorded in admin_invites and it can be used once, so a leaked link or QR
+// code is only useful to whoever uses it first, and only for a few minutes. Opening the link
+// only shows a confirmation page; the invite is used, starting a new admin session with its
+// role, when that page is submitted. Link previews and prefetches therefore can't use it up
+// or receive the session themselves.
+//
+// Tokens are signed with HMAC-SHA256 using a key generated on first start and kept in the
+// signing_keys table, so they stay valid across restarts.
+
+const (
+	signingPurposeInvite = "invite"
+	defaultInviteTTL     = 15 * time.Minute
+	maxInviteTTL         = 24 * time.Hour
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// loadSigningKey returns the newest key for purpose, generating one if there is none yet.
+func loadSigningKey(db *sql.DB, purpose string) ([]byte, error) {
+	var secret []byte
+	err := db.QueryRow("SELECT secret FROM signing_keys WHERE purpose = ? ORDER BY created_at DESC, rowid DESC LIMIT 1", purpose).Scan(&secret)
+	if err == nil {
+		return secret, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	key, err := generateSigningKey(db, purpose)
+	if err != nil {
+		return nil, err
+	}
+	return key.secret, nil
+}
+
+// signingKey is a row of the signing_keys table.
+type signingKey struct {
+	kid       string
+	secret    []byte
+	createdAt time.Time
+}
+
+// generateSigningKey stores a new random key for purpose.
+func generateSigningKey(db *sql.DB, purpose string) (signingKey, error) {
+	key := signingKey{secret: make([]byte, 32), createdAt: time.Now().UTC()}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(key.secret); err != nil {
+		return signingKey{}, err
+	}
+	if _, err := rand.Read(kid); err != nil {
+		return signingKey{}, err
+	}
+	key.kid = hex.EncodeToString(kid)
+	if _, err := db.Exec("INSERT INTO signing_keys (kid, purpose, secret) VALUES (?, ?, ?)", key.kid, purpose, key.secret); err != nil {
+		return signingKey{}, err
+	}
+	log.Printf("Generated a new %s signing key.", purpose)
+	return key, nil
+}
+
+// signToken encodes claims as a token: base64url(JSON) "." base64url(HMAC-SHA256).
+func signToken(key []byte, claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken checks a token's signature and decodes its claims. It doesn't check expiry.
+func verifyToken(key []byte, token string, claims interface{}) error {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return errInvalidToken
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// inviteClaims is the content of an invite token.
+type inviteClaims struct {
+	ID        string `json:"jti"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// pendingInvite is an unused invite as listed by /api/admin/invites. The token itself isn't
+// stored.
+type pendingInvite struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createInvite records a new invite and returns its token.
+func (app *App) createInvite(admin *User, role string, ttl time.Duration) (string, time.Time, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, err
+	}
+	claims := inviteClaims{ID: hex.EncodeToString(id), Role: role, ExpiresAt: time.Now().Add(ttl).Unix()}
+	token, err := signToken(app.inviteKey, claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO admin_invites (id, role, created_by, expires_at) VALUES (?, ?, ?, ?)", claims.ID, role, admin.actor(), claims.ExpiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := recordAudit(tx, admin.actor(), "invite.create", claims.ID, map[string]interface{}{"role": role, "expires_at": claims.ExpiresAt}); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Unix(claims.ExpiresAt, 0), tx.Commit()
+}
+
+// checkInvite returns the claims of an invite that can still be used, without using it. It
+// returns errInvalidToken if the token is forged, expired, revoked or already used.
+func (app *App) checkInvite(token string) (*inviteClaims, error) {
+	var claims inviteClaims
+	if err := verifyToken(app.inviteKey, token, &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt <= now || roleRank[claims.Role] == 0 {
+		return nil, errInvalidToken
+	}
+	var pending bool
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM admin_invites WHERE id = ? AND used_at IS NULL AND expires_at > ?", claims.ID, now).Scan(&pending); err != nil {
+		return nil, err
+	}
+	if !pending {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// acceptInvite checks an invite token, marks it used and creates an admin session for it.
+// It returns errInvalidToken if the token is forged, expired, revoked or already used.
+func (app *App) acceptInvite(token string) (*User, error) {
+	claims, err := app.checkInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := app.insertUser(tx, &adminSession{role: claims.Role})
+	if err != nil {
+		return nil, err
+	}
+	// Marking the invite used is the check: only one request can do it.
+	res, err := tx.Exec("UPDATE admin_invites SET used_at = ?, used_by = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?", now, user.ID, claims.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return nil, errInvalidToken
+	}
+	if err := recordAudit(tx, user.ID, "invite.accept", claims.ID, map[string]string{"role": claims.Role}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// inviteHandler serves the invite links. GET /api/invite?token=... is what the link opens: it
+// only shows a page with a button that posts the token. POST accepts the invite and goes to
+// the dashboard.
+func (app *App) inviteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refuse := func(err error) {
+			if errors.Is(err, errInvalidToken) {
+				log.Printf("Refused an invalid, expired or used admin invite.")
+				app.renderInfoPage(w, http.StatusForbidden, "Invite Not Valid", "This admin invite has expired or has already been used. Ask an admin for a new one.")
+				return
+			}
+			log.Printf("ERROR: could not accept admin invite: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			token := r.URL.Query().Get("token")
+			claims, err := app.checkInvite(token)
+			if err != nil {
+				refuse(err)
+				return
+			}
+			form := fmt.Sprintf(`<p>Start an admin session with the <strong>%s</strong> role on this device?</p>
+		<form method="post" action="/api/invite">
+			<input type="hidden" name="token" value="%s">
+			<button type="submit" style="background-color: #e67e22; color: #121212; border: none; border-radius: 4px; padding: 0.75rem 1.5rem; font-size: 1rem; cursor: pointer;">Accept Invite</button>
+		</form>`, html.EscapeString(claims.Role), html.EscapeString(token))
+			app.renderInfoPage(w, http.StatusOK, "Admin Invite", form)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := app.acceptInvite(r.FormValue("token"))
+		if err != nil {
+			refuse(err)
+			return
+		}
+
+		if err := app.setUserCookie(w, r, user.ID); err != nil {
+			log.Printf("ERROR: could not issue session cookie for admin invite: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// The invite stands in for the public access key, which the new admin may not have.
+		if app.settings.PublicAccessKey != "" {
+			if err := app.setAccessCookie(w, r); err != nil {
+				log.Printf("ERROR: could not issue access cookie for admin invite: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Printf("Admin invite accepted: new %s admin session for user %s", user.Role, user.ID)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// adminInvitesHandler lists pending invites (GET), creates one (POST {"role", "valid_minutes"})
+// and revokes one (DELETE /api/admin/invites/{id}). Owners only.
+func (app *App) adminInvitesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := requireRole(w, r, roleOwner)
+		if !ok {
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/invites"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			rows, err := app.db.Query("SELECT id, role, created_at, created_by, expires_at FROM admin_invites WHERE used_at IS NULL AND expires_at > ? ORDER BY created_at DESC", time.Now().Unix())
+			if err != nil {
+				log.Printf("ERROR: could not query admin invites: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			invites := []pendingInvite{}
+			for rows.Next() {
+				var inv pendingInvite
+				var expiresAt int64
+				if err := rows.Scan(&inv.ID, &inv.Role, &inv.CreatedAt, &inv.CreatedBy, &expiresAt); err != nil {
+					log.Printf("ERROR: could not scan admin invite: %v", err)
+					continue
+				}
+				inv.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+				invites = append(invites, inv)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(invites)
+		case id == "" && r.Method == http.MethodPost:
+			var payload struct {
+				Role         string `json:"role"`
+				ValidMinutes int    `json:"valid_minutes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if payload.Role == "" {
+				payload.Role = roleOperator
+			}
+			if roleRank[payload.Role] == 0 {
+				http.Error(w, fmt.Sprintf("role must be %s, %s or %s", roleViewer, roleOperator, roleOwner), http.StatusBadRequest)
+				return
+			}
+			ttl := defaultInviteTTL
+			if payload.ValidMinutes != 0 {
+				ttl = time.Duration(payload.ValidMinutes) * time.Minute
+			}
+			if ttl <= 0 || ttl > maxInviteTTL {
+				http.Error(w, fmt.Sprintf("valid_minutes must be between 1 and %d", int(maxInviteTTL.Minutes())), http.StatusBadRequest)
+				return
+			}
+
+			token, expiresAt, err := app.createInvite(admin, payload.Role, ttl)
+			if err != nil {
+				log.Printf("ERROR: could not create admin invite: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Admin %s created a %s invite valid until %s.", admin.actor(), payload.Role, expiresAt.Format(time.Kitchen))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"path":       "/api/invite?token=" + token,
+				"role":       payload.Role,
+				"expires_at": expiresAt.UTC(),
+			})
+		case id != "" && r.Method == http.MethodDelete:
+			tx, err := app.db.Begin()
+			if err != nil {
+				log.Printf("ERROR: could not begin transaction: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			res, err := tx.Exec("DELETE FROM admin_invites WHERE id = ? AND used_at IS NULL", id)
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 0 {
+					http.Error(w, "Invite not found or already used", http.StatusNotFound)
+					return
+				}
+				err = recordAudit(tx, admin.actor(), "invite.revoke", id, nil)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				log.Printf("ERROR: could not revoke admin invite: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newInviteTestApp returns a test app with an invite signing key.
+func newInviteTestApp(t *testing.T) *App {
+	t.Helper()
+	app := newTestApp(t, nil)
+	var err error
+	if app.inviteKey, err = loadSigningKey(app.db, signingPurposeInvite); err != nil {
+		t.Fatalf("loadSigningKey: %v", err)
+	}
+	return app
+}
+
+var inviteOwner = &User{ID: "owner-session", IsAdmin: true, Role: roleOwner}
+
+// TestAcceptInvite checks that an invite starts one admin session with its role, and that
+// used, expired, revoked and forged invites start none. Opening the link, as a link preview
+// would, must not use the invite.
+func TestAcceptInvite(t *testing.T) {
+	invite := func(t *testing.T, app *App, role string, ttl time.Duration) string {
+		token, _, err := app.createInvite(inviteOwner, role, ttl)
+		if err != nil {
+			t.Fatalf("createInvite: %v", err)
+		}
+		return token
+	}
+	tests := []struct {
+		name       string
+		token      func(t *testing.T, app *App) string
+		wantRole   string // Empty if the invite must be refused
+		wantAdmins int    // Admin sessions afterwards
+	}{
+		{
+			name:       "valid",
+			token:      func(t *testing.T, app *App) string { return invite(t, app, roleOperator, time.Minute) },
+			wantRole:   roleOperator,
+			wantAdmins: 1,
+		},
+		{
+			name: "used",
+			token: func(t *testing.T, app *App) string {
+				token := invite(t, app, roleOwner, time.Minute)
+				if _, err := app.acceptInvite(token); err != nil {
+					t.Fatalf("first acceptInvite: %v", err)
+				}
+				return token
+			},
+			wantAdmins: 1,
+		},
+		{
+			name:  "expired",
+			token: func(t *testing.T, app *App) string { return invite(t, app, roleOwner, -time.Second) },
+		},
+		{
+			name: "revoked",
+			token: func(t *testing.T, app *App) string {
+				token := invite(t, app, roleOwner, time.Minute)
+				var id string
+				if err := app.db.QueryRow("SELECT id FROM admin_invites").Scan(&id); err != nil {
+					t.Fatalf("read invite: %v", err)
+				}
+				rec := httptest.NewRecorder()
+				app.adminInvitesHandler()(rec, requestAs(inviteOwner, http.MethodDelete, "/api/admin/invites/"+id, ""))
+				if rec.Code != http.StatusNoContent {
+					t.Fatalf("revoke answered %d: %s", rec.Code, rec.Body)
+				}
+				return token
+			},
+		},
+		{
+			name: "signed with another key",
+			token: func(t *testing.T, app *App) string {
+				token := invite(t, app, roleOwner, time.Minute)
+				var claims inviteClaims
+				if err := verifyToken(app.inviteKey, token, &claims); err != nil {
+					t.Fatalf("verifyToken: %v", err)
+				}
+				forged, err := signToken([]byte("not the invite key"), claims)
+				if err != nil {
+					t.Fatalf("signToken: %v", err)
+				}
+				return forged
+			},
+		},
+		{
+			name: "role changed",
+			token: func(t *testing.T, app *App) string {
+				token := invite(t, app, roleViewer, time.Minute)
+				var claims inviteClaims
+				if err := verifyToken(app.inviteKey, token, &claims); err != nil {
+					t.Fatalf("verifyToken: %v", err)
+				}
+				claims.Role = roleOwner
+				forged, err := signToken(app.inviteKey, claims)
+				if err != nil {
+					t.Fatalf("signToken: %v", err)
+				}
+				_, signature, _ := strings.Cut(token, ".")
+				payload, _, _ := strings.Cut(forged, ".")
+				return payload + "." + signature
+			},
+		},
+		{
+			name: "never issued",
+			token: func(t *testing.T, app *App) string {
+				token, err := signToken(app.inviteKey, inviteClaims{ID: "made-up", Role: roleOwner, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+				if err != nil {
+					t.Fatalf("signToken: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name:  "garbage",
+			token: func(t *testing.T, app *App) string { return "not-a-token" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newInviteTestApp(t)
+			token := tt.token(t, app)
+
+			countAdmins := func() int {
+				var admins int
+				if err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE is_admin = 1").Scan(&admins); err != nil {
+					t.Fatalf("count admins: %v", err)
+				}
+				return admins
+			}
+			adminsBefore := countAdmins()
+			for range 2 {
+				rec := httptest.NewRecorder()
+				app.inviteHandler()(rec, httptest.NewRequest(http.MethodGet, "/api/invite?token="+url.QueryEscape(token), nil))
+				wantCode := http.StatusOK
+				if tt.wantRole == "" {
+					wantCode = http.StatusForbidden
+				}
+				if rec.Code != wantCode || len(rec.Result().Cookies()) > 0 {
+					t.Fatalf("GET answered %d with cookies %v, want %d and no cookies", rec.Code, rec.Result().Cookies(), wantCode)
+				}
+				if tt.wantRole != "" && !strings.Contains(rec.Body.String(), `<form method="post" action="/api/invite">`) {
+					t.Errorf("GET page = %s, want a form that posts the invite", rec.Body)
+				}
+			}
+			if admins := countAdmins(); admins != adminsBefore {
+				t.Fatalf("opening the link started %d admin sessions", admins-adminsBefore)
+			}
+
+			user, err := app.acceptInvite(token)
+			if tt.wantRole == "" {
+				if !errors.Is(err, errInvalidToken) {
+					t.Errorf("got user %v and error %v, want errInvalidToken", user, err)
+				}
+			} else if err != nil {
+				t.Errorf("acceptInvite: %v", err)
+			} else if !user.IsAdmin || user.Role != tt.wantRole {
+				t.Errorf("got admin %v with role %q, want an admin with role %q", user.IsAdmin, user.Role, tt.wantRole)
+			}
+
+			if admins := countAdmins(); admins != tt.wantAdmins {
+				t.Errorf("%d admin sessions, want %d", admins, tt.wantAdmins)
+			}
+		})
+	}
+}
+
+// TestInviteHandlerPost checks that submitting the confirmation form starts the session and
+// that the invite can't be submitted twice.
+func TestInviteHandlerPost(t *testing.T) {
+	app := newInviteTestApp(t)
+	if err := app.loadSessionKeys(); err != nil {
+		t.Fatalf("loadSessionKeys: %v", err)
+	}
+	token, _, err := app.createInvite(inviteOwner, roleOperator, time.Minute)
+	if err != nil {
+		t.Fatalf("createInvite: %v", err)
+	}
+
+	for i, want := range []int{http.StatusFound, http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodPost, "/api/invite", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		app.inviteHandler()(rec, req)
+		if rec.Code != want {
+			t.Fatalf("POST %d answered %d, want %d: %s", i+1, rec.Code, want, rec.Body)
+		}
+		gotCookie := slices.ContainsFunc(rec.Result().Cookies(), func(c *http.Cookie) bool { return c.Name == userCookieName })
+		if gotCookie != (want == http.StatusFound) {
+			t.Errorf("POST %d set a session cookie: %v", i+1, gotCookie)
+		}
+	}
+}
+
+// TestInviteThroughPublicAccessGate checks that an invite link works for someone without the
+// public access key, and that accepting it lets them past the gate afterwards.
+func TestInviteThroughPublicAccessGate(t *testing.T) {
+	app := newInviteTestApp(t)
+	app.settings.PublicAccessKey = "trick-or-treat"
+	if err := app.loadSessionKeys(); err != nil {
+		t.Fatalf("loadSessionKeys: %v", err)
+	}
+	token, _, err := app.createInvite(inviteOwner, roleOperator, time.Minute)
+	if err != nil {
+		t.Fatalf("createInvite: %v", err)
+	}
+	invite := app.userAuthMiddleware(app.inviteHandler())
+
+	rec := httptest.NewRecorder()
+	invite.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/invite?token="+url.QueryEscape(token), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET answered %d (Location %q), want %d", rec.Code, rec.Header().Get("Location"), http.StatusOK)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/invite", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	invite.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("POST answered %d to %q, want %d to %q", rec.Code, rec.Header().Get("Location"), http.StatusFound, "/")
+	}
+
+	dashboard := app.userAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	dashboard.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("dashboard after accepting answered %d (Location %q), want it served", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+// TestAcceptInviteConcurrently uses one invite from many requests at once and checks that
+// exactly one of them gets an admin session.
+func TestAcceptInviteConcurrently(t *testing.T) {
+	const requests = 20
+	app := newInviteTestApp(t)
+	token, _, err := app.createInvite(inviteOwner, roleOwner, time.Minute)
+	if err != nil {
+		t.Fatalf("createInvite: %v", err)
+	}
+
+	errs := make(chan error, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := app.acceptInvite(token)
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, errInvalidToken):
+			t.Errorf("acceptInvite: %v", err)
+		}
+	}
+	var admins int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE is_admin = 1").Scan(&admins); err != nil {
+		t.Fatalf("count admins: %v", err)
+	}
+	if accepted != 1 || admins != 1 {
+		t.Errorf("%d requests accepted the invite and %d admin sessions exist, want 1 and 1", accepted, admins)
+	}
+}
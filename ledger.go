@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Token Ledger ---
+// Every change to a balance is recorded in the token_ledger table, in the same transaction as
+// the change, with the amount, the balance after it and why it happened. The tokens_remaining
+// column is kept as a running total so activations don't have to sum the ledger, and
+// checkLedger reports users whose balance doesn't match their ledger.
+
+// Ledger reasons.
+const (
+	ledgerOpeningBalance = "opening_balance" // Balance of a user created before the ledger existed
+	ledgerSignup         = "signup"
+	ledgerActivation     = "activation"
+	ledgerRefund         = "refund" // A failed activation
+	ledgerRecharge       = "recharge"
+	ledgerRedeem         = "redeem" // A redeemed code (see vouchers.go)
+	ledgerDrip           = "drip"   // Tokens that refill over time
+	ledgerAdminGrant     = "admin_grant"
+)
+
+const maxLedgerHistory = 100 // Entries returned by /api/user/history.
+
+// ledgerEntry is one row of the token ledger.
+type ledgerEntry struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Delta     int       `json:"delta"`
+	Balance   int       `json:"balance"` // After this entry
+	Reason    string    `json:"reason"`
+	ActionID  *int64    `json:"action_id,omitempty"`
+	TriggerID string    `json:"trigger_id,omitempty"`
+}
+
+// recordLedgerEntry records a change that has already been applied to the user's balance.
+// actionID is the activation it belongs to, or 0.
+func recordLedgerEntry(db dbExecer, userID string, delta int, reason string, actionID int64) error {
+	_, err := db.Exec(`INSERT INTO token_ledger (user_id, delta, balance, reason, action_id)
+		SELECT id, ?, tokens_remaining, ?, NULLIF(?, 0) FROM users WHERE id = ?`, delta, reason, actionID, userID)
+	return err
+}
+
+// adjustTokens adds delta (which may be negative) to a user's balance and records it in the
+// ledger.
+func adjustTokens(db dbExecer, userID string, delta int, reason string, actionID int64) error {
+	res, err := db.Exec("UPDATE users SET tokens_remaining = tokens_remaining + ? WHERE id = ?", delta, userID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("user %s not found", userID)
+	}
+	return recordLedgerEntry(db, userID, delta, reason, actionID)
+}
+
+// topUpTokens raises a user's balance to balance, such as on a recharge, and records the
+// difference in the ledger. A balance that is already at least that high, for example from a
+// redeemed code, is left alone and nothing is recorded. It reports whether it added tokens.
+func topUpTokens(db dbExecer, userID string, balance int, reason string) (bool, error) {
+	// Record the difference first, while the old balance is still there.
+	res, err := db.Exec(`INSERT INTO token_ledger (user_id, delta, balance, reason)
+		SELECT id, ? - tokens_remaining, ?, ? FROM users WHERE id = ? AND tokens_remaining < ?`, balance, balance, reason, userID, balance)
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return false, nil
+	}
+	_, err = db.Exec("UPDATE users SET tokens_remaining = ? WHERE id = ?", balance, userID)
+	return err == nil, err
+}
+
+// spendTokens takes cost tokens from a user for an activation in a single conditional update,
+// so the balance can never go negative however many activations run at once. If the balance
+// doesn't cover the cost nothing is spent, and the current balance is returned instead.
+func spendTokens(tx *sql.Tx, userID string, cost int, actionID int64) (spent bool, balance int, err error) {
+	res, err := tx.Exec("UPDATE users SET tokens_remaining = tokens_remaining - ? WHERE id = ? AND tokens_remaining >= ?", cost, userID, cost)
+	if err != nil {
+		return false, 0, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+		return true, 0, recordLedgerEntry(tx, userID, -cost, ledgerActivation, actionID)
+	}
+	if err := tx.QueryRow("SELECT tokens_remaining FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		return false, 0, fmt.Errorf("could not read balance: %w", err)
+	}
+	return false, balance, nil
+}
+
+// refundTokens gives back the tokens spent on a failed activation.
+func (app *App) refundTokens(userID string, amount int, actionID int64) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := adjustTokens(tx, userID, amount, ledgerRefund, actionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillLedger gives users created before the ledger existed an opening balance entry, so
+// every balance is accounted for.
+func backfillLedger(db *sql.DB) error {
+	res, err := db.Exec(`INSERT INTO token_ledger (user_id, delta, balance, reason)
+		SELECT id, tokens_remaining, tokens_remaining, ? FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM token_ledger l WHERE l.user_id = u.id)`, ledgerOpeningBalance)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Token ledger: recorded opening balances for %d existing users.", n)
+	}
+	return nil
+}
+
+// checkLedger logs how many users have a balance that doesn't match the sum of their ledger.
+func checkLedger(db *sql.DB) {
+	var mismatched int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users u
+		WHERE u.tokens_remaining != (SELECT COALESCE(SUM(delta), 0) FROM token_ledger l WHERE l.user_id = u.id)`).Scan(&mismatched)
+	if err != nil {
+		log.Printf("ERROR: could not check the token ledger: %v", err)
+		return
+	}
+	if mismatched > 0 {
+		log.Printf("WARNING: %d users have a token balance that doesn't match their ledger.", mismatched)
+	}
+}
+
+// userHistoryHandler serves the current user's most recent ledger entries, newest first.
+func (app *App) userHistoryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userContextKey).(*User)
+		if !ok {
+			http.Error(w, "Could not identify user", http.StatusInternalServerError)
+			return
+		}
+
+		entries, err := queryLedger(app.db, user.ID, maxLedgerHistory)
+		if err != nil {
+			log.Printf("ERROR: could not query token history: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// --- Light Abstraction ---
+// Every supported smart-light brand implements Light so effects such as lightning can run
+// on any of them. Brightness is always a 1-100 percentage and colour temperature is in Kelvin;
+// each implementation converts to its device's native ranges.
+
+// Effect names shared by every light brand. Govee triggers encode the effect in their
+// type ("govee_lightning", "govee_set_state", ...) while Hue triggers select it with the
+// "effect" field, but both resolve to the same vocabulary.
+const (
+	effectLightning = "lightning"
+	effectSetState  = "set_state"
+	effectStatus    = "status"
+	effectAlert     = "alert" // A single short flash.
+	effectFlash     = "flash" // Repeated flashing for ~15 seconds.
+)
+
+// lightState is a brand-neutral snapshot of a light.
+type lightState struct {
+	On         bool
+	Brightness int
+	Color      *GoveeColorCommandData // Nil when the light is in colour temperature mode.
+	ColorTemp  int                    // Kelvin; only meaningful when Color is nil.
+}
+
+// Light is implemented by every light brand that effects can drive.
+type Light interface {
+	String() string
+	GetState() (*lightState, error)
+	SetPower(on bool) error
+	SetBrightness(percent int) error
+	SetColor(r, g, b int) error
+	SetColorTemp(kelvin int) error
+}
+
+// alertingLight is implemented by lights with a native alert effect (e.g. Hue's "select"/"lselect").
+// Lights without one get an emulated flash built from brightness changes.
+type alertingLight interface {
+	Alert(long bool) error
+}
+
+// lightForTrigger builds the Light a trigger controls and the effect it should run.
+// The third return value is false if the trigger type is not a light trigger. A non-nil sim
+// makes the light record its commands instead of sending them.
+func (app *App) lightForTrigger(trigger *Trigger, sim *simulation) (Light, string, bool) {
+	switch trigger.Type {
+	case "govee_lightning":
+		return &goveeLight{ip: trigger.GoveeDeviceIP, sim: sim}, effectLightning, true
+	case "govee_status":
+		return &goveeLight{ip: trigger.GoveeDeviceIP, sim: sim}, effectStatus, true
+	case "govee_set_state":
+		return &goveeLight{ip: trigger.GoveeDeviceIP, sim: sim}, effectSetState, true
+	case "hue":
+		effect := trigger.Effect
+		if effect == "" {
+			effect = effectSetState
+		}
+		return &hueLight{client: app.httpClient, bridgeIP: trigger.HueBridgeIP, appKey: trigger.secrets.hueAppKey, lightID: trigger.HueLightID, sim: sim}, effect, true
+	}
+	return nil, "", false
+}
+
+// lightSettings returns the brightness, colour and colour temperature a set_state trigger
+// asks for, reading the fields that belong to the trigger's brand.
+func (t *Trigger) lightSettings() (brightness *int, color *GoveeColorCommandData, colorTemp *int) {
+	if t.Type == "hue" {
+		return t.HueBrightness, t.HueColor, t.HueColorTemp
+	}
+	return t.GoveeBrightness, t.GoveeColor, t.GoveeColorTemp
+}
+
+func (app *App) handleLightTrigger(trigger *Trigger, light Light, effect string) error {
+	log.Printf("Running '%s' effect on %s", effect, light)
+
+	switch effect {
+	case effectLightning:
+		return app.simulateLightning(light)
+	case effectSetState:
+		return app.handleSetStateTrigger(trigger, light)
+	case effectStatus:
+		_, err := light.GetState()
+		return err
+	case effectAlert, effectFlash:
+		if a, ok := light.(alertingLight); ok {
+			return a.Alert(effect == effectFlash)
+		}
+		pulses := 1
+		if effect == effectFlash {
+			pulses = 30 // Roughly 15 seconds, matching Hue's "lselect".
+		}
+		return flashLight(light, pulses)
+	default:
+		return fmt.Errorf("unknown light effect: %s", effect)
+	}
+}
+
+// applyLightState applies a desired state (on/off, brightness, color, color temperature) to a light.
+// Parameters can be nil if that aspect of the state should not be changed. When turning a light
+// off, power goes last because some bridges reject brightness or colour changes on an off light.
+func applyLightState(light Light, on *bool, brightness *int, color *GoveeColorCommandData, colorTemp *int) error {
+	if on != nil && *on {
+		if err := light.SetPower(true); err != nil {
+			return fmt.Errorf("failed to set power state: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond) // Small delay between commands
+	}
+
+	if brightness != nil {
+		if err := light.SetBrightness(*brightness); err != nil {
+			return fmt.Errorf("failed to set brightness: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond) // Small delay between commands
+	}
+
+	// Only set color temp if no RGB color is provided and temp is valid
+	if color != nil {
+		if err := light.SetColor(color.R, color.G, color.B); err != nil {
+			return fmt.Errorf("failed to set RGB color: %w", err)
+		}
+	} else if colorTemp != nil && *colorTemp > 0 {
+		if err := light.SetColorTemp(*colorTemp); err != nil {
+			return fmt.Errorf("failed to set color temperature: %w", err)
+		}
+	}
+
+	if on != nil && !*on {
+		time.Sleep(100 * time.Millisecond) // Small delay between commands
+		if err := light.SetPower(false); err != nil {
+			return fmt.Errorf("failed to set power state: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreLightState puts a light back into a state captured with GetState.
+func restoreLightState(light Light, state *lightState) error {
+	return applyLightState(light, &state.On, &state.Brightness, state.Color, &state.ColorTemp)
+}
+
+// flashLight emulates an alert effect by pulsing the brightness, then restores the light.
+func flashLight(light Light, pulses int) error {
+	initialState, err := light.GetState()
+	if err != nil {
+		return fmt.Errorf("could not get initial state for flash: %w", err)
+	}
+
+	if !initialState.On {
+		light.SetPower(true)
+	}
+	for i := 0; i < pulses; i++ {
+		light.SetBrightness(100)
+		time.Sleep(250 * time.Millisecond)
+		light.SetBrightness(1)
+		time.Sleep(250 * time.Millisecond)
+	}
+	return restoreLightState(light, initialState)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeLight records the commands sent to it and reports state as its current state.
+type fakeLight struct {
+	state    lightState
+	commands []string
+	failOn   string // Command that returns an error, e.g. "brightness"
+}
+
+func (l *fakeLight) String() string { return "fake light" }
+
+func (l *fakeLight) GetState() (*lightState, error) {
+	s := l.state
+	return &s, nil
+}
+
+func (l *fakeLight) do(command string) error {
+	l.commands = append(l.commands, command)
+	if l.failOn != "" && strings.HasPrefix(command, l.failOn) {
+		return errors.New("device unreachable")
+	}
+	return nil
+}
+
+func (l *fakeLight) SetPower(on bool) error {
+	l.state.On = on
+	return l.do(fmt.Sprintf("power %v", on))
+}
+
+func (l *fakeLight) SetBrightness(percent int) error {
+	l.state.Brightness = percent
+	return l.do(fmt.Sprintf("brightness %d", percent))
+}
+
+func (l *fakeLight) SetColor(r, g, b int) error {
+	l.state.Color = &GoveeColorCommandData{R: r, G: g, B: b}
+	return l.do(fmt.Sprintf("color %d,%d,%d", r, g, b))
+}
+
+func (l *fakeLight) SetColorTemp(kelvin int) error {
+	l.state.Color, l.state.ColorTemp = nil, kelvin
+	return l.do(fmt.Sprintf("temp %d", kelvin))
+}
+
+// TestApplyLightState checks the order commands are sent in: power on first, power off last,
+// and an RGB colour taking precedence over a colour temperature.
+func TestApplyLightState(t *testing.T) {
+	on, off := true, false
+	bri, temp, zeroTemp := 40, 2700, 0
+	red := &GoveeColorCommandData{R: 255}
+	tests := []struct {
+		name       string
+		on         *bool
+		brightness *int
+		color      *GoveeColorCommandData
+		colorTemp  *int
+		failOn     string
+		want       []string
+		wantErr    bool
+	}{
+		{name: "turn on with colour", on: &on, brightness: &bri, color: red, want: []string{"power true", "brightness 40", "color 255,0,0"}},
+		{name: "turn off last", on: &off, brightness: &bri, colorTemp: &temp, want: []string{"brightness 40", "temp 2700", "power false"}},
+		{name: "colour wins over temperature", color: red, colorTemp: &temp, want: []string{"color 255,0,0"}},
+		{name: "zero temperature is ignored", colorTemp: &zeroTemp},
+		{name: "nothing to change"},
+		{name: "stops at the first error", on: &off, brightness: &bri, color: red, failOn: "brightness", want: []string{"brightness 40"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			light := &fakeLight{failOn: tt.failOn}
+			err := applyLightState(light, tt.on, tt.brightness, tt.color, tt.colorTemp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error = %v", err, tt.wantErr)
+			}
+			if !slices.Equal(light.commands, tt.want) {
+				t.Errorf("got commands %q, want %q", light.commands, tt.want)
+			}
+		})
+	}
+}
+
+// TestFlashLightRestoresState checks that an emulated flash pulses the brightness and then
+// puts the light back the way it was, switching it off again if it was off.
+func TestFlashLightRestoresState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state lightState
+		want  []string
+	}{
+		{
+			name:  "on with a colour",
+			state: lightState{On: true, Brightness: 60, Color: &GoveeColorCommandData{R: 255, G: 128}},
+			want:  []string{"brightness 100", "brightness 1", "power true", "brightness 60", "color 255,128,0"},
+		},
+		{
+			name:  "off with a colour temperature",
+			state: lightState{On: false, Brightness: 30, ColorTemp: 4000},
+			want:  []string{"power true", "brightness 100", "brightness 1", "brightness 30", "temp 4000", "power false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			light := &fakeLight{state: tt.state}
+			if err := flashLight(light, 1); err != nil {
+				t.Fatalf("flashLight: %v", err)
+			}
+			if !slices.Equal(light.commands, tt.want) {
+				t.Errorf("got commands %q, want %q", light.commands, tt.want)
+			}
+			if light.state.On != tt.state.On || light.state.Brightness != tt.state.Brightness || light.state.ColorTemp != tt.state.ColorTemp {
+				t.Errorf("light ended as %+v, want %+v", light.state, tt.state)
+			}
+		})
+	}
+}
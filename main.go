@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"net"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -121,10 +128,8 @@ var halloweenFacts = []string{
 	"The 'Gorgon' of Greek mythology, like Medusa, could turn people to stone.",
 }
 
-var adminSecretKey = "SUPER_SECRET" // Default value, will be overridden by environment variable.
 const userCookieName = "spooky-user-id"
 const publicAccessCookieName = "spooky-public-access"
-const defaultTokens = 10
 
 // contextKey is a custom type to avoid key collisions in context.
 type contextKey string
@@ -133,9 +138,11 @@ const userContextKey = contextKey("user")
 
 // User defines the structure for a user in our system.
 type User struct {
-	ID              string `json:"id"`
+	ID              string `json:"id,omitempty"` // Empty for a visitor who isn't stored yet
 	TokensRemaining int    `json:"tokens_remaining"`
 	IsAdmin         bool   `json:"is_admin"`
+	Role            string `json:"role,omitempty"`     // Admin role; see adminaccounts.go
+	Username        string `json:"username,omitempty"` // Admin account, if the session has one
 }
 
 // Trigger defines the structure for a single trigger object from the config.
@@ -143,21 +150,93 @@ type Trigger struct {
 	ID             string `json:"id"`
 	Name           string `json:"name"`
 	Description    string `json:"description"`
-	Type           string `json:"type"` // e.g., "arduino", "govee_lightning"
+	Type           string `json:"type"` // e.g., "arduino", "govee_lightning", "hue"
 	ArduinoIP      string `json:"arduino_ip,omitempty"`
 	GoveeDeviceIP  string `json:"govee_device_ip,omitempty"`
 	GoveeModel     string `json:"govee_model,omitempty"`
 	GoveeColor     *GoveeColorCommandData `json:"govee_color,omitempty"`
 	GoveeColorTemp  *int                   `json:"govee_color_temp,omitempty"`
 	GoveeBrightness *int                   `json:"govee_brightness,omitempty"`
-	SecretKey      string `json:"secret_key"`
+	HueBridgeIP    string `json:"hue_bridge_ip,omitempty"`
+	HueAppKey      string `json:"hue_app_key,omitempty"`
+	HueLightID     string `json:"hue_light_id,omitempty"`
+	HueColor       *GoveeColorCommandData `json:"hue_color,omitempty"`
+	HueColorTemp   *int                   `json:"hue_color_temp,omitempty"`
+	HueBrightness  *int                   `json:"hue_brightness,omitempty"`
+	Effect         string `json:"effect,omitempty"` // For "hue": lightning, set_state, status, alert or flash
+	Command        string            `json:"command,omitempty"` // For "command": must be listed in allowed_commands
+	Args           []string          `json:"args,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+	Simulate       bool   `json:"simulate,omitempty"` // Dry-run: record what would be sent instead of sending it
+	SecretKey      string `json:"secret_key"` // A literal secret, or an "env:NAME" or "file:/path" reference
 	IsAdminOnly    bool   `json:"is_admin_only,omitempty"`
+	Zone           string `json:"zone,omitempty"`     // Maze area the trigger is in; the dashboard groups by zone
+	Category       string `json:"category,omitempty"` // Free-form label shown on the card, e.g. "Sound" or "Lights"
+	Order          int    `json:"order,omitempty"`    // Lower values are shown first
+	Icon           string `json:"icon,omitempty"`     // An emoji or short text shown on the card
+	Color          string `json:"color,omitempty"`    // Card accent colour as #rgb or #rrggbb
+	Availability   *Availability `json:"availability,omitempty"` // Show hours; always available if unset
+	Cost           *int   `json:"cost,omitempty"`     // Tokens per activation; 1 if unset, 0 makes the trigger free
+
+	secrets    triggerSecrets // Resolved secret references, set when the config is loaded
+	schedule   *schedule      // Parsed Availability, set when the config is loaded
+	positioned bool           // Ordered on the Manage Triggers page, which takes precedence over Order
+}
+
+// publicTrigger is what /api/triggers serves: only what the dashboard needs to draw a button,
+// never secrets, device addresses or models.
+type publicTrigger struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	IsAdminOnly     bool       `json:"is_admin_only,omitempty"`
+	Category        string     `json:"category,omitempty"`
+	Icon            string     `json:"icon,omitempty"`
+	Color           string     `json:"color,omitempty"`
+	Cost            int        `json:"cost"`
+	Disabled        bool       `json:"disabled,omitempty"` // Taken offline by an admin
+	Reason          string     `json:"reason,omitempty"`
+	OutsideHours    bool       `json:"outside_hours,omitempty"`     // Outside its availability windows
+	NextAvailableAt *time.Time `json:"next_available_at,omitempty"` // When it opens, if it does again
+}
+
+func (t *Trigger) public() publicTrigger {
+	return publicTrigger{
+		ID:          t.ID,
+		Name:        t.Name,
+		Description: t.Description,
+		IsAdminOnly: t.IsAdminOnly,
+		Category:    t.Category,
+		Icon:        t.Icon,
+		Color:       t.Color,
+		Cost:        t.cost(),
+	}
+}
+
+// cost is the number of tokens an activation of the trigger takes from a visitor.
+func (t *Trigger) cost() int {
+	if t.Cost == nil {
+		return 1
+	}
+	return *t.Cost
 }
 
 // Config defines the top-level structure of the configuration file.
 type Config struct {
 	Triggers      []Trigger `json:"triggers"`
 	LivestreamURL string    `json:"livestream_url,omitempty"`
+	AllowedCommands []string `json:"allowed_commands,omitempty"` // Executables "command" triggers may run
+	Simulate      bool      `json:"simulate,omitempty"` // Dry-run every trigger without contacting devices
+	Include       []string  `json:"include,omitempty"` // Globs of extra trigger files, relative to the main file
+
+	path    string          // Main config file, set by loadConfigFile
+	files   []string        // Every file merged into this config, main file first
+	sources []triggerSource // Where each of Triggers was defined
+	hash    string          // SHA-256 over all files, set by loadConfigFile
+
+	secretFiles []string // Files referenced by file: secrets, set by resolveSecrets
+	secretHash  string   // SHA-256 over the resolved secret references, never shown
 }
 
 // UserStat holds statistics for a single user.
@@ -202,11 +281,22 @@ type GoveeColorCommandData struct {
 
 // App holds application-wide state.
 type App struct {
-	config     *Config
+	settings   *Settings
+	config     *Config // The file config merged with the triggers stored in the database.
+	fileConfig *Config // The config as loaded from disk.
+	zones      map[string]offlineState // Closed zones by name, guarded by configMutex.
+	triggerStates map[string]offlineState // Offline triggers by ID, guarded by configMutex.
+	dashboardState map[string]offlineState // Maintenance mode, guarded by configMutex.
 	db         *sql.DB
 	httpClient *http.Client
-
-	configMutex sync.RWMutex
+	simulations *simulationRecorder
+	inviteKey  []byte // Signs admin invites; see invites.go.
+	sessionKeys sessionKeyring // Signs session cookies; see sessions.go.
+	activations sync.WaitGroup // Activations handed to delegateTrigger that are still running.
+
+	configMutex     sync.RWMutex
+	configLoadedAt  time.Time // Guarded by configMutex, like config.
+	configLastError string    // Most recent failed reload, cleared by a successful one.
 }
 
 // --- Govee LAN Control Implementation ---
@@ -245,16 +335,24 @@ type goveeState struct {
 	ColorTemperature int      `json:"colorTemInKelvin"`
 }
 
-func sendGoveeCommand(ip string, cmd string, data interface{}) error {
+func marshalGoveeCommand(cmd string, data interface{}) ([]byte, error) {
 	c := goveeCommand{}
 	c.Msg.Cmd = cmd
 	c.Msg.Data = data
 	jsonBytes, err := json.Marshal(c)
 	if err != nil {
-		return fmt.Errorf("failed to marshal govee command: %w", err)
+		return nil, fmt.Errorf("failed to marshal govee command: %w", err)
+	}
+	return jsonBytes, nil
+}
+
+func sendGoveeCommand(ip string, cmd string, data interface{}) error {
+	jsonBytes, err := marshalGoveeCommand(cmd, data)
+	if err != nil {
+		return err
 	}
 
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", ip, goveePort))
+	conn, err := net.Dial("udp", net.JoinHostPort(ip, strconv.Itoa(goveePort)))
 	if err != nil {
 		return fmt.Errorf("failed to connect to govee device: %w", err)
 	}
@@ -309,60 +407,94 @@ func getGoveeStatus(ip string) (*goveeState, error) {
 	return &state, nil
 }
 
-// setGoveeColor is a helper to correctly set an RGB color using the 'colorwc' command.
-// It ensures ColorTemperature is set to 0, which is required for RGB values to take effect.
-func setGoveeColor(ip string, r, g, b int) error {
-	colorData := goveeColorWCData{Color: goveeRGB{R: r, G: g, B: b}, ColorTemperature: 0}
-	return sendGoveeCommand(ip, "colorwc", colorData)
+// goveeLight adapts a Govee LAN device to the Light interface.
+// When sim is set, commands are recorded to the simulation transcript instead of being sent.
+type goveeLight struct {
+	ip  string
+	sim *simulation
 }
 
-// applyGoveeLightState applies a desired state (on/off, brightness, color, color temperature) to a Govee device.
-// It handles the command sequence and ensures correct payload formatting.
-// Parameters can be nil if that aspect of the state should not be changed. Note: color is the config struct.
-func applyGoveeLightState(ip string, onOff *int, brightness *int, color *GoveeColorCommandData, colorTemp *int) error {
-	// 1. Turn on/off if specified
-	if onOff != nil {
-		if err := sendGoveeCommand(ip, "turn", map[string]int{"value": *onOff}); err != nil {
-			return fmt.Errorf("failed to set power state: %w", err)
+func (l *goveeLight) String() string {
+	return fmt.Sprintf("Govee light %s", l.ip)
+}
+
+func (l *goveeLight) send(cmd string, data interface{}) error {
+	if l.sim != nil {
+		payload, err := marshalGoveeCommand(cmd, data)
+		if err != nil {
+			return err
 		}
-		time.Sleep(100 * time.Millisecond) // Small delay between commands
+		l.sim.record("govee_udp", net.JoinHostPort(l.ip, strconv.Itoa(goveePort)), string(payload))
+		return nil
 	}
+	return sendGoveeCommand(l.ip, cmd, data)
+}
 
-	// 2. Set brightness if specified
-	if brightness != nil {
-		if err := sendGoveeCommand(ip, "brightness", map[string]int{"value": *brightness}); err != nil {
-			return fmt.Errorf("failed to set brightness: %w", err)
-		}
-		time.Sleep(100 * time.Millisecond) // Small delay between commands
+func (l *goveeLight) GetState() (*lightState, error) {
+	if l.sim != nil {
+		l.send("devStatus", struct{}{})
+		return simulatedLightState(), nil
 	}
+	state, err := getGoveeStatus(l.ip)
+	if err != nil {
+		return nil, err
+	}
+	ls := &lightState{On: state.On == 1, Brightness: state.Brightness}
+	if state.ColorTemperature > 0 {
+		ls.ColorTemp = state.ColorTemperature
+	} else {
+		ls.Color = &GoveeColorCommandData{R: state.Color.R, G: state.Color.G, B: state.Color.B}
+	}
+	return ls, nil
+}
 
-	// 3. Set color or color temperature if specified
-	if color != nil {
-		if err := setGoveeColor(ip, color.R, color.G, color.B); err != nil {
-			return fmt.Errorf("failed to set RGB color: %w", err)
-		}
-	} else if colorTemp != nil && *colorTemp > 0 { // Only set color temp if no RGB color is provided and temp is valid
-		colorData := goveeColorWCData{Color: goveeRGB{}, ColorTemperature: *colorTemp} // Empty RGB for color temp only
-		if err := sendGoveeCommand(ip, "colorwc", colorData); err != nil {
-			return fmt.Errorf("failed to set color temperature: %w", err)
-		}
+func (l *goveeLight) SetPower(on bool) error {
+	value := 0
+	if on {
+		value = 1
 	}
-	return nil
+	return l.send("turn", map[string]int{"value": value})
+}
+
+func (l *goveeLight) SetBrightness(percent int) error {
+	return l.send("brightness", map[string]int{"value": percent})
+}
+
+// SetColor sets an RGB color. ColorTemperature must be 0 for the RGB values to take effect.
+func (l *goveeLight) SetColor(r, g, b int) error {
+	return l.send("colorwc", goveeColorWCData{Color: goveeRGB{R: r, G: g, B: b}, ColorTemperature: 0})
+}
+
+func (l *goveeLight) SetColorTemp(kelvin int) error {
+	colorData := goveeColorWCData{Color: goveeRGB{}, ColorTemperature: kelvin} // Empty RGB for color temp only
+	return l.send("colorwc", colorData)
 }
+
 // --- End Govee Implementation ---
 
 // --- Database and Config Functions ---
 
-func loadConfig() (*Config, error) {
-	file, err := os.ReadFile("./config/config.json")
+// loadConfig reads and validates the config file. Warnings are logged; if there are any
+// errors, none of the config is used and every problem is returned in a *configError.
+func loadConfig(path string) (*Config, error) {
+	config, problems, err := loadConfigFile(path, true)
 	if err != nil {
 		return nil, err
 	}
-	var config Config
-	err = json.Unmarshal(file, &config)
-	return &config, err
+	for _, p := range problems {
+		log.Printf("WARNING: %s", p)
+	}
+	return config, nil
 }
 
+// configReloadDebounce groups the burst of events produced by a single save into one reload.
+const configReloadDebounce = 300 * time.Millisecond
+
+// watchConfig reloads the config when it changes. It watches directories rather than files:
+// editors that write a temp file and rename it, and Kubernetes ConfigMap updates (which swap
+// the "..data" symlink the file points through), replace the file and would silently end a
+// watch on the file itself. The directories of every included file, the triggers.d directory
+// and the targets of symlinked files are watched too.
 func (app *App) watchConfig() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -371,33 +503,59 @@ func (app *App) watchConfig() {
 	}
 	defer watcher.Close()
 
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Has(fsnotify.Write) {
-					log.Println("Config file modified. Reloading...")
-					app.reloadConfig()
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Printf("ERROR: Config watcher error: %v", err)
+	watched := make(map[string]bool)
+	watchDirs := func() {
+		app.configMutex.RLock()
+		files := append(slices.Clone(app.config.files), app.config.secretFiles...)
+		app.configMutex.RUnlock()
+
+		for _, dir := range configWatchDirs(app.settings.ConfigPath, files) {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("ERROR: Failed to add %s to config watcher: %v", dir, err)
+				continue
 			}
+			watched[dir] = true
+		}
+	}
+	watchDirs()
+
+	// The debounce timer only signals; reloads run on this goroutine so they never overlap.
+	reload := make(chan struct{}, 1)
+	var debounce *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// Any change in a watched directory may affect what the config resolves to;
+			// reloadConfig skips the reload if the content hash hasn't changed.
+			if debounce == nil {
+				debounce = time.AfterFunc(configReloadDebounce, func() {
+					select {
+					case reload <- struct{}{}:
+					default: // A reload is already pending.
+					}
+				})
+			} else {
+				debounce.Reset(configReloadDebounce)
+			}
+		case <-reload:
+			app.reloadConfig()
+			watchDirs() // A symlink swap or new include may add directories.
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("ERROR: Config watcher error: %v", err)
 		}
-	}()
-
-	err = watcher.Add("./config/config.json")
-	if err != nil {
-		log.Printf("ERROR: Failed to add config file to watcher: %v", err)
 	}
-
-	// Block forever
-	<-make(chan struct{})
 }
 
 func initDB(filepath string) (*sql.DB, error) {
@@ -425,6 +583,25 @@ func initDB(filepath string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Unix time the user's drip clock last moved; see applyDrip.
+	if err := ensureColumn(db, "users", "last_drip_at", "INTEGER"); err != nil {
+		return nil, err
+	}
+	// Set by admins; see useradmin.go. sessions_reset_at is Unix time. admin_account is the
+	// admin account an admin session belongs to, and admin_role the role of one without an
+	// account; see adminaccounts.go.
+	userColumns := []struct{ name, definition string }{
+		{"banned", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"ban_reason", "TEXT"},
+		{"sessions_reset_at", "INTEGER"},
+		{"admin_account", "TEXT"},
+		{"admin_role", "TEXT"},
+	}
+	for _, c := range userColumns {
+		if err := ensureColumn(db, "users", c.name, c.definition); err != nil {
+			return nil, err
+		}
+	}
 
 	actionsTableSQL := `CREATE TABLE IF NOT EXISTS actions (
 		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
@@ -439,32 +616,80 @@ func initDB(filepath string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	// --- Schema Migration: Add 'success' column to 'actions' table if it doesn't exist ---
-	rows, err := db.Query("PRAGMA table_info(actions)")
+	// --- Schema Migrations: Add columns introduced after the original schema ---
+	actionColumns := []struct{ name, definition string }{
+		{"success", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"stdout", "TEXT"}, // Captured output of "command" triggers
+		{"stderr", "TEXT"},
+		{"exit_code", "INTEGER"},
+		{"cost", "INTEGER NOT NULL DEFAULT 1"}, // Tokens spent on the action; 0 for admins and free triggers
+	}
+	for _, c := range actionColumns {
+		if err := ensureColumn(db, "actions", c.name, c.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	dbTriggersTableSQL := `CREATE TABLE IF NOT EXISTS db_triggers (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"definition" TEXT, -- Trigger JSON; NULL if the row only positions or disables a file trigger
+		"position" INTEGER,
+		"disabled" BOOLEAN NOT NULL DEFAULT 0,
+		"updated_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"updated_by" TEXT NOT NULL
+	);`
+	_, err = db.Exec(dbTriggersTableSQL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get table info for actions: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var successColumnExists bool
-	for rows.Next() {
-		var cid int
-		var name string
-		var typeName string
-		var notnull int
-		var dfltValue sql.NullString
-		var pk int
-		if err := rows.Scan(&cid, &name, &typeName, &notnull, &dfltValue, &pk); err == nil && name == "success" {
-			successColumnExists = true
-			break
-		}
+	auditLogTableSQL := `CREATE TABLE IF NOT EXISTS audit_log (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"timestamp" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"actor" TEXT NOT NULL,
+		"action" TEXT NOT NULL,
+		"target" TEXT NOT NULL,
+		"details" TEXT
+	);`
+	_, err = db.Exec(auditLogTableSQL)
+	if err != nil {
+		return nil, err
 	}
-	if !successColumnExists {
-		log.Println("Schema migration: Adding 'success' column to 'actions' table.")
-		_, err = db.Exec(`ALTER TABLE actions ADD COLUMN success BOOLEAN NOT NULL DEFAULT 0`)
-		if err != nil {
-			return nil, fmt.Errorf("failed to alter actions table: %w", err)
-		}
+
+	zonesTableSQL := `CREATE TABLE IF NOT EXISTS zones (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"disabled" BOOLEAN NOT NULL DEFAULT 0,
+		"reason" TEXT,
+		"updated_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"updated_by" TEXT NOT NULL
+	);`
+	_, err = db.Exec(zonesTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	triggerStatesTableSQL := `CREATE TABLE IF NOT EXISTS trigger_states (
+		"trigger_id" TEXT NOT NULL PRIMARY KEY,
+		"disabled" BOOLEAN NOT NULL DEFAULT 0,
+		"reason" TEXT,
+		"updated_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"updated_by" TEXT NOT NULL
+	);`
+	_, err = db.Exec(triggerStatesTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboardStateTableSQL := `CREATE TABLE IF NOT EXISTS dashboard_state (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"disabled" BOOLEAN NOT NULL DEFAULT 0,
+		"reason" TEXT,
+		"updated_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"updated_by" TEXT NOT NULL
+	);`
+	_, err = db.Exec(dashboardStateTableSQL)
+	if err != nil {
+		return nil, err
 	}
 
 	rechargesTableSQL := `CREATE TABLE IF NOT EXISTS recharges (
@@ -476,21 +701,175 @@ func initDB(filepath string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Redeemed codes are recorded as recharges too, with the code they used.
+	if err := ensureColumn(db, "recharges", "source", "TEXT NOT NULL DEFAULT 'recharge'"); err != nil {
+		return nil, err
+	}
+	if err := ensureColumn(db, "recharges", "code_id", "INTEGER"); err != nil {
+		return nil, err
+	}
+
+	adminAccountsTableSQL := `CREATE TABLE IF NOT EXISTS admin_accounts (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"password_hash" TEXT NOT NULL,
+		"role" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"created_by" TEXT NOT NULL,
+		"last_login_at" DATETIME
+	);`
+	_, err = db.Exec(adminAccountsTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKeysTableSQL := `CREATE TABLE IF NOT EXISTS signing_keys (
+		"kid" TEXT NOT NULL PRIMARY KEY,
+		"purpose" TEXT NOT NULL,
+		"secret" BLOB NOT NULL,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err = db.Exec(signingKeysTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	adminInvitesTableSQL := `CREATE TABLE IF NOT EXISTS admin_invites (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"role" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"created_by" TEXT NOT NULL,
+		"expires_at" INTEGER NOT NULL,
+		"used_at" INTEGER,
+		"used_by" TEXT
+	);`
+	_, err = db.Exec(adminInvitesTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	redeemCodesTableSQL := `CREATE TABLE IF NOT EXISTS redeem_codes (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"code_hash" TEXT NOT NULL UNIQUE,
+		"batch" TEXT NOT NULL,
+		"label" TEXT,
+		"tokens" INTEGER NOT NULL,
+		"max_uses" INTEGER NOT NULL DEFAULT 1,
+		"uses" INTEGER NOT NULL DEFAULT 0,
+		"revoked" BOOLEAN NOT NULL DEFAULT 0,
+		"created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"created_by" TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS redeem_codes_batch ON redeem_codes (batch);`
+	_, err = db.Exec(redeemCodesTableSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenLedgerTableSQL := `CREATE TABLE IF NOT EXISTS token_ledger (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"user_id" TEXT NOT NULL,
+		"timestamp" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		"delta" INTEGER NOT NULL,
+		"balance" INTEGER NOT NULL,
+		"reason" TEXT NOT NULL,
+		"action_id" INTEGER,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS token_ledger_user_id ON token_ledger (user_id);`
+	_, err = db.Exec(tokenLedgerTableSQL)
+	if err != nil {
+		return nil, err
+	}
+	if err := backfillLedger(db); err != nil {
+		return nil, fmt.Errorf("failed to record opening balances: %w", err)
+	}
 
 	log.Println("Database tables created or already exist.")
 	return db, nil
 }
 
+// ensureColumn adds a column to an existing table if it isn't there yet.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to get table info for %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name string
+		var typeName string
+		var notnull int
+		var dfltValue sql.NullString
+		var pk int
+		if err := rows.Scan(&cid, &name, &typeName, &notnull, &dfltValue, &pk); err == nil && name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	log.Printf("Schema migration: Adding '%s' column to '%s' table.", column, table)
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to alter %s table: %w", table, err)
+	}
+	return nil
+}
+
 // --- Middleware ---
 
+// adminSession describes the admin session a new user is created for: one that belongs to an
+// admin account, or one with a role and no account (see adminaccounts.go).
+type adminSession struct {
+	account string
+	role    string
+}
+
+// createUser creates a user with the default number of tokens. admin is nil for visitors.
+func (app *App) createUser(admin *adminSession) (*User, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	user, err := app.insertUser(tx, admin)
+	if err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+// insertUser creates a user in tx, for callers that make other changes in the same transaction.
+func (app *App) insertUser(tx *sql.Tx, admin *adminSession) (*User, error) {
+	user := &User{ID: uuid.New().String(), TokensRemaining: app.settings.DefaultTokens}
+	var account, accountRole, sessionRole string
+	if admin != nil {
+		user.IsAdmin = true
+		account = admin.account
+		if account != "" {
+			accountRole = admin.role // Read from the account on later requests
+		} else {
+			sessionRole = admin.role
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO users (id, tokens_remaining, is_admin, last_drip_at, admin_account, admin_role) VALUES (?, 0, ?, ?, NULLIF(?, ''), NULLIF(?, ''))",
+		user.ID, user.IsAdmin, time.Now().Unix(), account, sessionRole); err != nil {
+		return nil, err
+	}
+	if err := adjustTokens(tx, user.ID, user.TokensRemaining, ledgerSignup, 0); err != nil {
+		return nil, err
+	}
+	resolveAdminRole(user, account, accountRole, sessionRole)
+	return user, nil
+}
+
 func (app *App) userAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// --- Public Access Gate ---
 		// If a public access key is configured, all access is denied by default.
-		if publicAccessKey != "" {
+		if publicAccessKey := app.settings.PublicAccessKey; publicAccessKey != "" {
 			// Check for a valid access cookie first.
-			accessCookie, err := r.Cookie(publicAccessCookieName)
-			hasValidCookie := err == nil && accessCookie.Value == publicAccessKey
+			hasValidCookie := app.hasAccessCookie(w, r)
 
 			// If no valid cookie, check for the key in the URL.
 			if !hasValidCookie {
@@ -502,14 +881,11 @@ func (app *App) userAuthMiddleware(next http.Handler) http.Handler {
 					}
 
 					// The key is correct. Set the access cookie.
-					http.SetCookie(w, &http.Cookie{
-						Name:     publicAccessCookieName,
-						Value:    publicAccessKey,
-						Path:     "/",
-						Expires:  time.Now().Add(365 * 24 * time.Hour),
-						HttpOnly: true,
-						SameSite: http.SameSiteLaxMode,
-					})
+					if err := app.setAccessCookie(w, r); err != nil {
+						log.Printf("ERROR: Failed to issue access cookie: %v", err)
+						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+						return
+					}
 
 					// Redirect to remove the key from the URL for security.
 					q := r.URL.Query()
@@ -521,8 +897,9 @@ func (app *App) userAuthMiddleware(next http.Handler) http.Handler {
 
 				// If we reach here, the user has no valid cookie and no valid key in the URL.
 				// If they aren't already on the locked page, redirect them.
-				// Also, allow requests for static assets to pass through.
-				isAllowedPublic := r.URL.Path == "/locked.html" || r.URL.Path == "/out-of-tokens.html" || isStaticAsset(r.URL.Path) || r.URL.Path == "/api/halloween-fact"
+				// Also, allow requests for static assets to pass through, and admin invites,
+				// which are checked on their own and let the new admin past the gate.
+				isAllowedPublic := r.URL.Path == "/locked.html" || r.URL.Path == "/out-of-tokens.html" || isStaticAsset(r.URL.Path) || r.URL.Path == "/api/halloween-fact" || r.URL.Path == "/api/invite"
 				if !isAllowedPublic {
 					http.Redirect(w, r, "/locked.html", http.StatusFound)
 					return // Stop here only if we are redirecting.
@@ -535,69 +912,61 @@ func (app *App) userAuthMiddleware(next http.Handler) http.Handler {
 
 		var user *User
 
-		// Check for admin key in URL parameters for easy admin promotion.
-		if adminKeyParam := r.URL.Query().Get("admin_key"); adminKeyParam != "" {
-			secret := adminSecretKey
-			if envSecret := os.Getenv("ADMIN_SECRET_KEY"); envSecret != "" {
-				secret = envSecret
+		session, staleSession, err := app.readSession(r, userCookieName, sessionKindUser)
+		if errors.Is(err, errInvalidToken) {
+			// Forged, expired or signed with a retired key: start over as a new visitor.
+			log.Printf("Ignoring an invalid or expired session cookie.")
+			app.clearCookie(w, r, userCookieName)
+		}
+		if err != nil {
+			// The user is only created once they use their tokens; see visitors.go.
+			user = app.newVisitor()
+		} else {
+			userID := session.Subject
+			row := app.db.QueryRow(`SELECT u.id, u.tokens_remaining, u.is_admin, u.last_drip_at, u.banned, COALESCE(u.ban_reason, ''), u.sessions_reset_at,
+					COALESCE(u.admin_account, ''), COALESCE(a.role, ''), COALESCE(u.admin_role, '')
+				FROM users u LEFT JOIN admin_accounts a ON a.username = u.admin_account
+				WHERE u.id = ?`, userID)
+			user = &User{}
+			var lastDrip, sessionsResetAt sql.NullInt64
+			var banned bool
+			var banReason, adminAccount, accountRole, sessionRole string
+			err = row.Scan(&user.ID, &user.TokensRemaining, &user.IsAdmin, &lastDrip, &banned, &banReason, &sessionsResetAt, &adminAccount, &accountRole, &sessionRole)
+			if errors.Is(err, sql.ErrNoRows) {
+				// Deleted for never using their tokens (see visitors.go): a new visitor again.
+				log.Printf("User %s from cookie no longer exists, continuing as a new visitor.", userID)
+				app.clearCookie(w, r, userCookieName)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, app.newVisitor())))
+				return
 			}
-
-			if adminKeyParam == secret {
-				log.Println("Valid admin key provided in URL. Upgrading session.")
-				if cookie, err := r.Cookie(userCookieName); err == nil {
-					// Upgrade existing user to admin.
-					userID := cookie.Value
-					if _, dbErr := app.db.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", userID); dbErr != nil {
-						log.Printf("ERROR: Failed to upgrade user %s to admin via URL key: %v", userID, dbErr)
-					} else {
-						log.Printf("User %s upgraded to admin.", userID)
-					}
-				}
-
-				// Redirect to the same URL without the admin_key to prevent it from being bookmarked or shared.
-				q := r.URL.Query()
-				q.Del("admin_key")
-				r.URL.RawQuery = q.Encode()
-				http.Redirect(w, r, r.URL.String(), http.StatusFound)
+			if err != nil {
+				log.Printf("ERROR: could not look up user from cookie: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
 				return
-			} else {
-				log.Printf("An invalid admin key was provided in the URL: '%s'", adminKeyParam)
 			}
-		} 
-
-		cookie, err := r.Cookie(userCookieName)
-		if err != nil {
-			newUUID := uuid.New().String()
-			user = &User{ID: newUUID, TokensRemaining: defaultTokens, IsAdmin: false}
-
-			_, dbErr := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES (?, ?, ?)", user.ID, user.TokensRemaining, user.IsAdmin)
-			if dbErr != nil {
-				log.Printf("ERROR: Failed to create new user: %v", dbErr)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			resolveAdminRole(user, adminAccount, accountRole, sessionRole)
+			if sessionsResetAt.Valid && session.IssuedAt <= sessionsResetAt.Int64 {
+				log.Printf("Refused a reset session for user %s.", user.ID)
+				app.clearCookie(w, r, userCookieName)
+				http.Error(w, "Your session was reset, please refresh", http.StatusUnauthorized)
 				return
 			}
-
-			http.SetCookie(w, &http.Cookie{
-				Name:     userCookieName,
-				Value:    user.ID,
-				Path:     "/",
-				Expires:  time.Now().Add(365 * 24 * time.Hour),
-				HttpOnly: true,
-				SameSite: http.SameSiteLaxMode,
-			})
-			log.Printf("New user created: ID=%s, Tokens=%d", user.ID, user.TokensRemaining)
-
-		} else {
-			userID := cookie.Value
-			row := app.db.QueryRow("SELECT id, tokens_remaining, is_admin FROM users WHERE id = ?", userID)
-			user = &User{}
-			err = row.Scan(&user.ID, &user.TokensRemaining, &user.IsAdmin)
-			if err != nil {
-				log.Printf("ERROR: User ID from cookie not found in DB: %v", err)
-				http.SetCookie(w, &http.Cookie{Name: userCookieName, Path: "/", MaxAge: -1})
-				http.Error(w, "Invalid session, please refresh", http.StatusUnauthorized)
+			if banned && !isStaticAsset(r.URL.Path) {
+				msg := "You have been banned from the dashboard."
+				if banReason != "" {
+					msg += " " + html.EscapeString(banReason)
+				}
+				app.renderInfoPage(w, http.StatusForbidden, "Banned", msg)
 				return
 			}
+			if err := app.applyDrip(user, lastDrip, time.Now()); err != nil {
+				log.Printf("ERROR: could not apply token drip for user %s: %v", user.ID, err)
+			}
+			if staleSession {
+				if err := app.setUserCookie(w, r, user.ID); err != nil {
+					log.Printf("ERROR: could not renew session cookie for user %s: %v", user.ID, err)
+				}
+			}
 			log.Printf("Returning user identified: ID=%s, Tokens=%d", user.ID, user.TokensRemaining)
 		}
 
@@ -619,21 +988,17 @@ func (app *App) triggersHandler() http.HandlerFunc {
 
 		user, _ := r.Context().Value(userContextKey).(*User)
 
-		var triggersToSend []Trigger
-		if user != nil && user.IsAdmin {
-			// Admins get all triggers
-			triggersToSend = app.config.Triggers
-		} else {
-			// Public users only get non-admin triggers
-			for _, t := range app.config.Triggers {
-				if !t.IsAdminOnly {
-					triggersToSend = append(triggersToSend, t)
-				}
-			}
-		}
+		// Public users only get non-admin triggers; admins get all of them.
+		zones := app.groupTriggers(func(t *Trigger) bool {
+			return !t.IsAdminOnly || (user != nil && user.IsAdmin)
+		})
 
+		m := app.maintenance()
+		maintenance := offlineState{Disabled: m.Disabled, Reason: m.Reason} // Without who set it.
+
+		// Admins can still activate triggers during maintenance and in closed zones.
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(triggersToSend)
+		json.NewEncoder(w).Encode(map[string]interface{}{"zones": zones, "maintenance": maintenance, "admin": user != nil && user.IsAdmin})
 	}
 }
 
@@ -644,8 +1009,23 @@ func (app *App) userStatusHandler() http.HandlerFunc {
 			http.Error(w, "Could not identify user", http.StatusInternalServerError)
 			return
 		}
+		// Admins have unlimited tokens, so the recharge policy doesn't apply to them.
+		status := struct {
+			*User
+			Recharge *rechargeStatus `json:"recharge,omitempty"`
+		}{User: user}
+		if !user.IsAdmin {
+			recharge, err := app.userRechargeStatus(user)
+			if err != nil {
+				log.Printf("ERROR: could not get recharge status for user %s: %v", user.ID, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			status.Recharge = &recharge
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(user)
+		json.NewEncoder(w).Encode(status)
 	}
 }
 
@@ -657,11 +1037,6 @@ func (app *App) activateHandler() http.HandlerFunc {
 			return
 		}
 
-		if !user.IsAdmin && user.TokensRemaining <= 0 {
-			http.Error(w, "You are out of tokens!", http.StatusForbidden)
-			return
-		}
-
 		triggerID := r.URL.Path[len("/api/activate/"):]
 		app.configMutex.RLock()
 		var targetTrigger *Trigger
@@ -671,13 +1046,34 @@ func (app *App) activateHandler() http.HandlerFunc {
 				break
 			}
 		}
+		var unavailable string
+		if targetTrigger != nil {
+			unavailable = app.unavailableReason(targetTrigger, user)
+		}
 		app.configMutex.RUnlock()
 		if targetTrigger == nil {
 			http.Error(w, "Trigger not found", http.StatusNotFound)
 			return
 		}
+		// Offline triggers are refused before any token is spent.
+		if unavailable != "" {
+			http.Error(w, unavailable, http.StatusServiceUnavailable)
+			return
+		}
+
+		cost := targetTrigger.cost()
+		if user.IsAdmin {
+			cost = 0
+		}
+		if err := app.ensureUser(w, r, user); err != nil {
+			log.Printf("ERROR: Failed to create new user: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-		// --- Step 1: Spend the token and log the action as pending (success=0) ---
+		// --- Step 1: Spend the tokens and log the action as pending (success=0) ---
+		// The balance is checked by the spending update itself rather than from the middleware's
+		// earlier read, so parallel activations can't spend the same tokens twice.
 		tx, err := app.db.Begin()
 		if err != nil {
 			log.Printf("ERROR: activateHandler could not begin transaction: %v", err)
@@ -685,33 +1081,34 @@ func (app *App) activateHandler() http.HandlerFunc {
 			return
 		}
 
-		if !user.IsAdmin {
-			res, err := tx.Exec("UPDATE users SET tokens_remaining = tokens_remaining - 1 WHERE id = ?", user.ID)
+		actionRes, err := tx.Exec("INSERT INTO actions (user_id, trigger_id, success, cost) VALUES (?, ?, 0, ?)", user.ID, triggerID, cost)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("ERROR: activateHandler could not insert action: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		actionID, _ := actionRes.LastInsertId()
+
+		if cost > 0 {
+			spent, balance, err := spendTokens(tx, user.ID, cost, actionID)
 			if err != nil {
 				tx.Rollback()
-				log.Printf("ERROR: activateHandler could not decrement tokens: %v", err)
+				log.Printf("ERROR: activateHandler could not spend tokens for user %s: %v", user.ID, err)
 				http.Error(w, "Database error", http.StatusInternalServerError)
 				return
 			}
-			// Verify that a row was actually updated
-			rowsAffected, _ := res.RowsAffected()
-			if rowsAffected == 0 {
+			if !spent {
 				tx.Rollback()
-				log.Printf("ERROR: activateHandler failed to update tokens for user %s (user not found?)", user.ID)
-				http.Error(w, "User not found for token update", http.StatusInternalServerError)
+				if balance <= 0 {
+					http.Error(w, "You are out of tokens!", http.StatusForbidden)
+				} else {
+					http.Error(w, fmt.Sprintf("%s costs %d tokens, but you only have %d.", targetTrigger.Name, cost, balance), http.StatusForbidden)
+				}
 				return
 			}
 		}
 
-		actionRes, err := tx.Exec("INSERT INTO actions (user_id, trigger_id, success) VALUES (?, ?, 0)", user.ID, triggerID)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("ERROR: activateHandler could not insert action: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-		actionID, _ := actionRes.LastInsertId()
-
 		if err = tx.Commit(); err != nil {
 			log.Printf("ERROR: activateHandler could not commit transaction: %v", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
@@ -719,7 +1116,7 @@ func (app *App) activateHandler() http.HandlerFunc {
 		}
 
 		// --- Step 2: Delegate to the correct trigger type handler ---
-		go app.delegateTrigger(targetTrigger, user, actionID)
+		app.activations.Go(func() { app.delegateTrigger(targetTrigger, user, actionID, cost) })
 
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Trigger '%s' activation initiated!", triggerID)
@@ -745,7 +1142,7 @@ func (app *App) halloweenFactHandler() http.HandlerFunc {
 		}
 
 		// Only add the contact email for non-admin users.
-		if contactEmail != "" && (user == nil || !user.IsAdmin) {
+		if contactEmail := app.settings.ContactEmail; contactEmail != "" && (user == nil || !user.IsAdmin) {
 			response["contact_email"] = contactEmail
 		}
 
@@ -821,7 +1218,7 @@ func (app *App) renderInfoPage(w http.ResponseWriter, statusCode int, title stri
 		fmt.Fprintf(w, `<div class="box">%s</div>`, msg)
 	}
 
-	if contactEmail != "" {
+	if contactEmail := app.settings.ContactEmail; contactEmail != "" {
 		feedbackMsg := fmt.Sprintf(`Have feedback or cool pictures? Send them to <a href="mailto:%s" style="color: #ffb74d;">%s</a>!`, contactEmail, contactEmail)
 		fmt.Fprintf(w, `<div class="box">%s</div>`, feedbackMsg)
 	}
@@ -839,6 +1236,16 @@ func (app *App) rechargeHandler() http.HandlerFunc {
 			return
 		}
 
+		if code := app.settings.RechargeCode; code != "" && subtle.ConstantTimeCompare([]byte(r.FormValue("code")), []byte(code)) != 1 {
+			app.renderInfoPage(w, http.StatusForbidden, "No Recharge", "This recharge code isn't valid. Find a recharge QR code in the maze to get more tokens.")
+			return
+		}
+		if err := app.ensureUser(w, r, user); err != nil {
+			log.Printf("ERROR: Failed to create new user: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
 		// Use a transaction to ensure both updates happen or neither do.
 		tx, err := app.db.Begin()
 		if err != nil {
@@ -847,8 +1254,26 @@ func (app *App) rechargeHandler() http.HandlerFunc {
 			return
 		}
 
-		// Reset user's tokens
-		_, err = tx.Exec("UPDATE users SET tokens_remaining = ? WHERE id = ?", defaultTokens, user.ID)
+		// Check the recharge policy in the same transaction, so parallel recharges can't both pass.
+		status, err := app.rechargeAllowed(tx, user.ID, time.Now())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("ERROR: could not check recharge policy: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !status.Available {
+			tx.Rollback()
+			msg := status.Reason
+			if status.NextRechargeAt != nil {
+				msg += fmt.Sprintf(" You can recharge again in %s.", formatWait(time.Until(*status.NextRechargeAt)))
+			}
+			app.renderInfoPage(w, http.StatusTooManyRequests, "No Recharge Yet", msg)
+			return
+		}
+
+		// Top the user's tokens up to the default, keeping any extra they redeemed
+		toppedUp, err := topUpTokens(tx, user.ID, app.settings.DefaultTokens, ledgerRecharge)
 		if err != nil {
 			tx.Rollback()
 			log.Printf("ERROR: could not update user tokens on recharge: %v", err)
@@ -871,7 +1296,11 @@ func (app *App) rechargeHandler() http.HandlerFunc {
 			return
 		}
 
-		log.Printf("User %s recharged tokens.", user.ID)
+		if toppedUp {
+			log.Printf("User %s recharged tokens.", user.ID)
+		} else {
+			log.Printf("User %s recharged but already had at least %d tokens.", user.ID, app.settings.DefaultTokens)
+		}
 		// Redirect the user back to the main dashboard after a successful recharge.
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
@@ -879,9 +1308,7 @@ func (app *App) rechargeHandler() http.HandlerFunc {
 
 func (app *App) statsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, ok := r.Context().Value(userContextKey).(*User)
-		if !ok || !user.IsAdmin {
-			http.Error(w, "Forbidden: Admins only", http.StatusForbidden)
+		if _, ok := requireRole(w, r, roleViewer); !ok {
 			return
 		}
 
@@ -891,11 +1318,11 @@ func (app *App) statsHandler() http.HandlerFunc {
 		// Get total users
 		app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&stats.TotalUsers)
 		// Get total recharges
-		app.db.QueryRow("SELECT COUNT(*) FROM recharges").Scan(&stats.TotalRecharges)
+		app.db.QueryRow("SELECT COUNT(*) FROM recharges WHERE source = 'recharge'").Scan(&stats.TotalRecharges)
 
 		// Get all user stats
 		userRows, err := app.db.Query(`
-			SELECT u.id, u.created_at, u.is_admin, COUNT(a.id)
+			SELECT u.id, u.created_at, u.is_admin, COALESCE(SUM(CASE WHEN a.success = 1 THEN a.cost ELSE 0 END), 0)
 			FROM users u
 			LEFT JOIN actions a ON u.id = a.user_id
 			GROUP BY u.id
@@ -1005,20 +1432,57 @@ func (app *App) statsHandler() http.HandlerFunc {
 }
 
 func (app *App) reloadConfig() {
-	newConfig, err := loadConfig()
+	newConfig, err := loadConfig(app.settings.ConfigPath)
 	if err != nil {
-		log.Printf("ERROR: Failed to reload config.json: %v. Keeping old configuration.", err)
+		log.Printf("ERROR: Failed to reload config.json. Keeping old configuration. %v", err)
+		app.configMutex.Lock()
+		app.configLastError = err.Error()
+		app.configMutex.Unlock()
 		return
 	}
 
 	app.configMutex.Lock()
-	app.config = newConfig
-	app.configMutex.Unlock()
+	defer app.configMutex.Unlock()
+	if newConfig.hash == app.fileConfig.hash && newConfig.secretHash == app.fileConfig.secretHash {
+		app.configLastError = ""
+		return // Touched or re-linked, but the content and secrets are the same.
+	}
+	// Stored triggers may not be valid against the new file (e.g. a removed allowed_commands entry).
+	if err := app.applyFileConfig(newConfig); err != nil {
+		log.Printf("ERROR: Reloaded config conflicts with stored triggers. Keeping old configuration. %v", err)
+		app.configLastError = err.Error()
+		return
+	}
+	app.configLastError = ""
+	app.configLoadedAt = time.Now()
 
-	log.Printf("Successfully reloaded configuration. Found %d triggers.", len(newConfig.Triggers))
+	log.Printf("Successfully reloaded configuration (sha256 %.12s). Found %d triggers.", newConfig.hash, len(newConfig.Triggers))
 }
 
-func (app *App) delegateTrigger(trigger *Trigger, user *User, actionID int64) {
+func (app *App) configInfoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireRole(w, r, roleViewer); !ok {
+			return
+		}
+
+		app.configMutex.RLock()
+		defer app.configMutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":              app.settings.ConfigPath,
+			"files":             app.config.files,
+			"sha256":            app.config.hash,
+			"loaded_at":         app.configLoadedAt,
+			"trigger_count":     len(app.config.Triggers),
+			"file_trigger_count": len(app.fileConfig.Triggers),
+			"last_reload_error": app.configLastError,
+		})
+	}
+}
+
+// delegateTrigger runs an activation and refunds the cost tokens spent on it if it fails.
+func (app *App) delegateTrigger(trigger *Trigger, user *User, actionID int64, cost int) {
 	var err error
 	triggerType := trigger.Type
 	if triggerType == "" {
@@ -1027,26 +1491,34 @@ func (app *App) delegateTrigger(trigger *Trigger, user *User, actionID int64) {
 
 	log.Printf("Delegating action ID %d to handler for type '%s'", actionID, triggerType)
 
-	switch triggerType {
-	case "arduino":
-		err = app.handleArduinoTrigger(trigger)
-	case "govee_lightning":
-		err = app.handleGoveeLightningTrigger(trigger)
-	case "govee_status":
-		err = app.handleGoveeStatusTrigger(trigger)
-	case "govee_set_state":
-		err = app.handleGoveeSetStateTrigger(trigger)
-	default:
-		err = fmt.Errorf("unknown trigger type: %s", trigger.Type)
+	sim := app.simulationFor(trigger, actionID)
+	if sim != nil {
+		log.Printf("Action ID %d is running in simulate mode; no devices will be contacted.", actionID)
+	}
+
+	if light, effect, ok := app.lightForTrigger(trigger, sim); ok {
+		err = app.handleLightTrigger(trigger, light, effect)
+	} else {
+		switch triggerType {
+		case "arduino":
+			err = app.handleArduinoTrigger(trigger, sim)
+		case "command":
+			err = app.handleCommandTrigger(trigger, actionID, sim)
+		default:
+			err = fmt.Errorf("unknown trigger type: %s", trigger.Type)
+		}
 	}
 
 	// --- Step 3: Update status based on success or failure ---
 	if err != nil {
 		log.Printf("ERROR: Action ID %d failed: %v", actionID, err)
-		// Failure case: Refund the token if the user is not an admin
-		if !user.IsAdmin {
-			app.db.Exec("UPDATE users SET tokens_remaining = tokens_remaining + 1 WHERE id = ?", user.ID)
-			log.Printf("REFUND: Trigger failed for user %s. Token refunded. Tokens now: %d", user.ID, user.TokensRemaining)
+		// Failure case: Refund whatever the activation cost (nothing for admins and free triggers)
+		if cost > 0 {
+			if err := app.refundTokens(user.ID, cost, actionID); err != nil {
+				log.Printf("ERROR: could not refund action ID %d: %v", actionID, err)
+			} else {
+				log.Printf("REFUND: Trigger failed for user %s. %d token(s) refunded.", user.ID, cost)
+			}
 		}
 		// Note: The 'success' column in the 'actions' table remains 0 (the default)
 	} else {
@@ -1056,8 +1528,12 @@ func (app *App) delegateTrigger(trigger *Trigger, user *User, actionID int64) {
 	}
 }
 
-func (app *App) handleArduinoTrigger(trigger *Trigger) error {
-	url := fmt.Sprintf("http://%s/trigger?key=%s", trigger.ArduinoIP, trigger.SecretKey)
+func (app *App) handleArduinoTrigger(trigger *Trigger, sim *simulation) error {
+	url := fmt.Sprintf("http://%s/trigger?key=%s", trigger.ArduinoIP, trigger.secrets.secretKey)
+	if sim != nil {
+		sim.record("http", "GET "+redactQuery(url, "key"), "")
+		return nil
+	}
 	resp, err := app.httpClient.Get(url)
 	if err != nil {
 		return fmt.Errorf("failed to send request to Arduino: %w", err)
@@ -1070,22 +1546,20 @@ func (app *App) handleArduinoTrigger(trigger *Trigger) error {
 	return nil
 }
 
-func (app *App) handleGoveeLightningTrigger(trigger *Trigger) (err error) {
-	log.Printf("Handling Govee lightning for model '%s'", trigger.GoveeModel)
-	return app.simulateGoveeLightning(trigger)
-}
+func (app *App) simulateLightning(light Light) error {
+	log.Printf("Simulating lightning storm on %s", light)
 
-func (app *App) simulateGoveeLightning(trigger *Trigger) error {
-	log.Printf("Simulating Govee lightning storm on %s", trigger.GoveeDeviceIP)
-
-	initialState, err := getGoveeStatus(trigger.GoveeDeviceIP)
+	initialState, err := light.GetState()
 	if err != nil {
-		return fmt.Errorf("could not get initial Govee state for simulation: %w", err)
+		return fmt.Errorf("could not get initial light state for simulation: %w", err)
 	}
-	log.Printf("Govee initial state captured: Power=%d, Brightness=%d", initialState.On, initialState.Brightness)
+	log.Printf("Initial light state captured: Power=%v, Brightness=%d", initialState.On, initialState.Brightness)
 
 	// Set a cool white color for the flicker effect.
-	if err := setGoveeColor(trigger.GoveeDeviceIP, 200, 200, 255); err != nil { // Using the corrected helper
+	if !initialState.On {
+		light.SetPower(true)
+	}
+	if err := light.SetColor(200, 200, 255); err != nil {
 		log.Printf("Warning: failed to set initial color for flicker: %v", err)
 	}
 	time.Sleep(100 * time.Millisecond)
@@ -1093,50 +1567,49 @@ func (app *App) simulateGoveeLightning(trigger *Trigger) error {
 	effectDuration := 10 * time.Second
 	startTime := time.Now()
 	for time.Since(startTime) < effectDuration {
-		sendGoveeCommand(trigger.GoveeDeviceIP, "brightness", map[string]int{"value": 100})
+		light.SetBrightness(100)
 		time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
 
-		sendGoveeCommand(trigger.GoveeDeviceIP, "brightness", map[string]int{"value": 1})
+		light.SetBrightness(1)
 		time.Sleep(time.Duration(80+rand.Intn(300)) * time.Millisecond)
 	}
 
-	log.Printf("Restoring Govee light to initial state.")
-
-	turnValue := 0
-	if initialState.On == 1 {
-		turnValue = 1
-	}
-	return applyGoveeLightState(
-		trigger.GoveeDeviceIP,
-		&turnValue,
-		&initialState.Brightness, // brightness
-		&GoveeColorCommandData{R: initialState.Color.R, G: initialState.Color.G, B: initialState.Color.B}, // color
-		&initialState.ColorTemperature, // colorTemp
-	)
+	log.Printf("Restoring %s to initial state.", light)
+	return restoreLightState(light, initialState)
 }
 
-func (app *App) handleGoveeSetStateTrigger(trigger *Trigger) error {
-	log.Printf("Setting Govee state for trigger '%s'", trigger.Name)
-	// Default to turning on if not explicitly specified.
-	onVal := 1
-	return applyGoveeLightState(
-		trigger.GoveeDeviceIP,
-		&onVal, // Always try to turn on for set_state
-		trigger.GoveeBrightness,
-		trigger.GoveeColor,
-		trigger.GoveeColorTemp,
+func (app *App) handleSetStateTrigger(trigger *Trigger, light Light) error {
+	log.Printf("Setting light state for trigger '%s'", trigger.Name)
+	brightness, color, colorTemp := trigger.lightSettings()
+	on := true
+	return applyLightState(
+		light,
+		&on, // Always try to turn on for set_state
+		brightness,
+		color,
+		colorTemp,
 	)
 }
 
-func (app *App) handleGoveeStatusTrigger(trigger *Trigger) (err error) {
-	_, err = getGoveeStatus(trigger.GoveeDeviceIP)
-	return err
-}
-
 func (app *App) adminLoginHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		hasAccounts, err := app.hasAdminAccounts()
+		if err != nil {
+			log.Printf("ERROR: could not check for admin accounts: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// The login page asks whether to show the username and password or the secret key.
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]bool{"accounts": hasAccounts})
+			return
+		}
+
 		var payload struct {
 			AdminKey string `json:"admin_key"`
+			Username string `json:"username"`
+			Password string `json:"password"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -1144,175 +1617,190 @@ func (app *App) adminLoginHandler() http.HandlerFunc {
 			return
 		}
 
-		// Use the adminSecretKey from env var if available, otherwise the default.
-		secret := adminSecretKey
-		if envSecret := os.Getenv("ADMIN_SECRET_KEY"); envSecret != "" {
-			secret = envSecret
-		}
-		if payload.AdminKey != secret {
+		// Once an admin account exists, only accounts can log in.
+		var account, role string
+		if hasAccounts {
+			role, err = app.authenticateAdmin(payload.Username, payload.Password)
+			if err != nil {
+				log.Printf("ERROR: could not check admin login: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if role == "" {
+				log.Printf("Failed admin login for account '%s'.", payload.Username)
+				http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+				return
+			}
+			account = payload.Username
+		} else if !app.sharedAdminKeyValid(payload.AdminKey) {
 			http.Error(w, "Invalid secret key", http.StatusUnauthorized)
 			return
 		}
 
-		// Key is correct. Create a new admin user and session.
-		newUUID := uuid.New().String()
-		user := &User{ID: newUUID, TokensRemaining: defaultTokens, IsAdmin: true}
-
-		_, dbErr := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES (?, ?, ?)", user.ID, user.TokensRemaining, user.IsAdmin)
+		// Credentials are correct. Create a new admin user and session.
+		session := &adminSession{account: account, role: role}
+		if account == "" {
+			session.role = roleOwner
+		}
+		user, dbErr := app.createUser(session)
 		if dbErr != nil {
 			log.Printf("ERROR: Failed to create new admin user: %v", dbErr)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     userCookieName,
-			Value:    user.ID,
-			Path:     "/",
-			Expires:  time.Now().Add(365 * 24 * time.Hour),
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
-
-		log.Printf("New admin session created for user %s", user.ID)
-		w.WriteHeader(http.StatusOK)
-	}
-}
-
-func (app *App) adminLogoutHandler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// On logout, create a new public user and issue a new cookie for them.
-		// This ensures a clean break from the admin session.
-		newUUID := uuid.New().String()
-		user := &User{ID: newUUID, TokensRemaining: defaultTokens, IsAdmin: false}
-
-		_, dbErr := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES (?, ?, ?)", user.ID, user.TokensRemaining, user.IsAdmin)
-		if dbErr != nil {
-			log.Printf("ERROR: Failed to create new public user on logout: %v", dbErr)
+		if err := app.setUserCookie(w, r, user.ID); err != nil {
+			log.Printf("ERROR: Failed to issue admin session cookie: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     userCookieName,
-			Value:    user.ID,
-			Path:     "/",
-			Expires:  time.Now().Add(365 * 24 * time.Hour),
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
-
-		log.Printf("Admin logged out. New public session created for user %s", user.ID)
+		log.Printf("New %s admin session created for user %s", user.Role, user.ID)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func (app *App) adminSecretHandler() http.HandlerFunc {
+func (app *App) adminLogoutHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, ok := r.Context().Value(userContextKey).(*User)
-		if !ok || !user.IsAdmin {
-			http.Error(w, "Forbidden: Admins only", http.StatusForbidden)
-			return
-		}
-
-		secret := adminSecretKey
-		if envSecret := os.Getenv("ADMIN_SECRET_KEY"); envSecret != "" {
-			secret = envSecret
-		}
+		// On logout, drop the session cookie. This ensures a clean break from the admin
+		// session: the next request is from a new visitor.
+		app.clearCookie(w, r, userCookieName)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"admin_secret_key": secret,
-		})
+		log.Printf("Admin logged out.")
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (app *App) publicAccessKeyHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, ok := r.Context().Value(userContextKey).(*User)
-		if !ok || !user.IsAdmin {
-			http.Error(w, "Forbidden: Admins only", http.StatusForbidden)
+		if _, ok := requireRole(w, r, roleViewer); !ok {
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
-			"public_access_key": publicAccessKey,
+			"public_access_key": app.settings.PublicAccessKey,
+			"recharge_code":     app.settings.RechargeCode,
 		})
 	}
 }
 
-var publicAccessKey = ""
-var contactEmail = ""
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(runValidateConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		os.Exit(runCreateAdmin(os.Args[2:]))
+	}
+
 	log.Printf("Starting Haunted Maze Control Dashboard version: %s", version)
 
+	settings, err := loadSettings(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+	settings.logSettings()
+
 	// Seed the random number generator for more natural random effects.
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	// Override default admin secret if environment variable is set.
-	if envSecret := os.Getenv("ADMIN_SECRET_KEY"); envSecret != "" {
-		adminSecretKey = envSecret
-		log.Printf("Loaded ADMIN_SECRET_KEY from environment: %v", adminSecretKey)
-	}
-	// Load the public access key if it's set.
-	if envAccessKey := os.Getenv("PUBLIC_ACCESS_KEY"); envAccessKey != "" {
-		publicAccessKey = envAccessKey
-		log.Printf("Loaded PUBLIC_ACCESS_KEY from environment: %s. Public access will be restricted.", publicAccessKey)
-	}
-	// Load the contact email if it's set.
-	if envContactEmail := os.Getenv("CONTACT_EMAIL"); envContactEmail != "" {
-		contactEmail = envContactEmail
-		log.Printf("Loaded CONTACT_EMAIL from environment: %s", contactEmail)
-	}
-
 	// Ensure the data directory exists for the database.
-	if err := os.MkdirAll("./data", 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(settings.DBPath), 0755); err != nil {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
-	config, err := loadConfig()
+	config, err := loadConfig(settings.ConfigPath)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 	log.Printf("Configuration loaded. Found %d triggers.", len(config.Triggers))
 
-	db, err := initDB("./data/dashboard.db")
+	db, err := initDB(settings.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
 	app := &App{
-		config:     config,
 		db:         db,
-		httpClient: &http.Client{Timeout: 10 * time.Second},
+		settings:   settings,
+		httpClient: &http.Client{Timeout: settings.HTTPClientTimeout},
+		simulations: &simulationRecorder{},
+		configLoadedAt: time.Now(),
+	}
+	if err := app.applyFileConfig(config); err != nil {
+		log.Fatalf("Failed to merge stored triggers into the configuration: %v", err)
+	}
+	if err := app.loadOfflineStates(); err != nil {
+		log.Fatalf("Failed to load trigger availability: %v", err)
+	}
+	checkLedger(db)
+	if app.inviteKey, err = loadSigningKey(db, signingPurposeInvite); err != nil {
+		log.Fatalf("Failed to load the invite signing key: %v", err)
 	}
+	if err := app.loadSessionKeys(); err != nil {
+		log.Fatalf("Failed to load the session signing keys: %v", err)
+	}
+	go app.rotateSessionKeys()
+	go app.cleanUpInactiveUsers()
 
 	go app.watchConfig()
 
 	mux := http.NewServeMux()
-	fs := http.FileServer(http.Dir("./static"))
+	fs := http.FileServer(http.Dir(settings.StaticDir))
 
 	// Register API handlers first, so they take precedence over the file server.
 	mux.Handle("/api/triggers", app.userAuthMiddleware(app.triggersHandler()))
 	mux.Handle("/api/activate/", app.userAuthMiddleware(app.activateHandler()))
 	mux.Handle("/api/user/status", app.userAuthMiddleware(app.userStatusHandler()))
+	mux.Handle("/api/user/history", app.userAuthMiddleware(app.userHistoryHandler()))
 	mux.Handle("/api/recharge", app.userAuthMiddleware(app.rechargeHandler()))
+	mux.Handle("/api/redeem", app.userAuthMiddleware(app.redeemHandler()))
 	mux.Handle("/api/stats", app.userAuthMiddleware(app.statsHandler()))
 	mux.Handle("/api/admin/login", app.adminLoginHandler())
 	mux.Handle("/api/admin/logout", app.adminLogoutHandler())
 	mux.Handle("/api/version", versionHandler()) // This handler doesn't need app context
 	mux.Handle("/api/halloween-fact", app.userAuthMiddleware(app.halloweenFactHandler()))
 	mux.Handle("/api/build-id", buildIDHandler())
-	mux.Handle("/api/admin/secret", app.userAuthMiddleware(app.adminSecretHandler()))
+	mux.Handle("/api/invite", app.userAuthMiddleware(app.inviteHandler()))
+	mux.Handle("/api/admin/invites", app.userAuthMiddleware(app.adminInvitesHandler()))
+	mux.Handle("/api/admin/invites/", app.userAuthMiddleware(app.adminInvitesHandler()))
 	mux.Handle("/api/admin/public-access-key", app.userAuthMiddleware(app.publicAccessKeyHandler()))
+	mux.Handle("/api/admin/redeem-codes", app.userAuthMiddleware(app.adminRedeemCodesHandler()))
+	mux.Handle("/api/admin/redeem-codes/", app.userAuthMiddleware(app.adminRedeemCodesHandler()))
+	mux.Handle("/api/admin/accounts", app.userAuthMiddleware(app.adminAccountsHandler()))
+	mux.Handle("/api/admin/accounts/", app.userAuthMiddleware(app.adminAccountsHandler()))
+	mux.Handle("/api/admin/users/", app.userAuthMiddleware(app.adminUsersHandler()))
+	mux.Handle("/api/admin/simulation", app.userAuthMiddleware(app.simulationHandler()))
+	mux.Handle("/api/admin/config", app.userAuthMiddleware(app.configInfoHandler()))
+	mux.Handle("/api/admin/triggers", app.userAuthMiddleware(app.adminTriggersHandler()))
+	mux.Handle("/api/admin/triggers/", app.userAuthMiddleware(app.adminTriggersHandler()))
+	mux.Handle("/api/admin/audit", app.userAuthMiddleware(app.auditLogHandler()))
+	mux.Handle("/api/admin/zones", app.userAuthMiddleware(app.adminZonesHandler()))
+	mux.Handle("/api/admin/zones/", app.userAuthMiddleware(app.adminZonesHandler()))
+	mux.Handle("/api/admin/trigger-states", app.userAuthMiddleware(app.triggerStatesHandler()))
+	mux.Handle("/api/admin/trigger-states/", app.userAuthMiddleware(app.triggerStatesHandler()))
+	mux.Handle("/api/admin/maintenance", app.userAuthMiddleware(app.maintenanceHandler()))
 	mux.Handle("/alive", livenessHandler()) // Note: /alive should not have auth middleware
 	mux.Handle("/ready", readinessHandler(db))
 	mux.Handle("/", app.userAuthMiddleware(fs)) // The file server should be last to act as a catch-all.
 
-	log.Println("Listening on :8080...")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	// Development mode: fake Govee devices and Arduino so everything can be exercised without hardware.
+	if settings.DevEmulators {
+		emulators, err := startDevEmulators(app.config, settings.DevEmulatorArduinoAddr)
+		if err != nil {
+			log.Fatalf("Failed to start device emulators: %v", err)
+		}
+		mux.Handle("/dev/emulators", app.userAuthMiddleware(emulators.pageHandler()))
+		mux.Handle("/api/dev/emulators", app.userAuthMiddleware(emulators.stateHandler()))
+		log.Println("DEV EMULATORS: Enabled. View simulated device state at /dev/emulators")
+	}
+
+	log.Printf("Listening on %s...", settings.ListenAddr)
+	if err := http.ListenAndServe(settings.ListenAddr, mux); err != nil {
 		log.Fatal(err)
 	}
 }
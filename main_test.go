@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestApp returns an App with the default settings, a fresh database and config (an empty
+// one if config is nil) merged with the stored triggers. Activations still running at the
+// end of the test are waited for before the database is closed.
+func newTestApp(t *testing.T, config *Config) *App {
+	t.Helper()
+	db, err := initDB(filepath.Join(t.TempDir(), "dashboard.db"))
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if config == nil {
+		config = &Config{}
+	}
+	app := &App{settings: defaultSettings(), db: db, simulations: &simulationRecorder{}}
+	t.Cleanup(app.activations.Wait)
+	if err := app.applyFileConfig(config); err != nil {
+		t.Fatalf("applyFileConfig: %v", err)
+	}
+	return app
+}
+
+// requestAs returns a request made by user, as the middleware would pass it on. user may be nil.
+func requestAs(user *User, method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != nil {
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+	}
+	return req
+}
+
+// TestActivateConcurrentSpending fires many simultaneous activations for one user and checks
+// that exactly as many succeed as the balance pays for, and that it never goes negative.
+func TestActivateConcurrentSpending(t *testing.T) {
+	tests := []struct {
+		name        string
+		cost        int
+		tokens      int
+		requests    int
+		wantSuccess int
+	}{
+		{name: "one token each", cost: 1, tokens: 25, requests: 300, wantSuccess: 25},
+		{name: "cost doesn't divide balance", cost: 3, tokens: 50, requests: 200, wantSuccess: 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := initDB(filepath.Join(t.TempDir(), "dashboard.db"))
+			if err != nil {
+				t.Fatalf("initDB: %v", err)
+			}
+			defer db.Close()
+
+			cost := tt.cost
+			app := &App{
+				settings:    &Settings{},
+				config:      &Config{Triggers: []Trigger{{ID: "scream", Name: "Scream", Type: "arduino", Simulate: true, Cost: &cost}}},
+				db:          db,
+				simulations: &simulationRecorder{},
+			}
+			defer app.activations.Wait() // Runs before db.Close, so no refund races the close.
+			user := &User{ID: "visitor", TokensRemaining: tt.tokens}
+			if _, err := db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES (?, ?, 0)", user.ID, tt.tokens); err != nil {
+				t.Fatalf("insert user: %v", err)
+			}
+
+			// Every request carries the same stale balance, like requests that all passed the
+			// middleware before any of them spent anything.
+			handler := app.activateHandler()
+			codes := make(chan int, tt.requests)
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < tt.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest(http.MethodPost, "/api/activate/scream", nil)
+					req = req.WithContext(context.WithValue(req.Context(), userContextKey, &User{ID: user.ID, TokensRemaining: user.TokensRemaining}))
+					rec := httptest.NewRecorder()
+					<-start
+					handler(rec, req)
+					codes <- rec.Code
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(codes)
+
+			counts := make(map[int]int)
+			for code := range codes {
+				counts[code]++
+			}
+			if counts[http.StatusOK] != tt.wantSuccess || counts[http.StatusForbidden] != tt.requests-tt.wantSuccess {
+				t.Errorf("got status counts %v, want %d x 200 and %d x 403", counts, tt.wantSuccess, tt.requests-tt.wantSuccess)
+			}
+
+			var balance, actions, spent int
+			if err := db.QueryRow("SELECT tokens_remaining FROM users WHERE id = ?", user.ID).Scan(&balance); err != nil {
+				t.Fatalf("read balance: %v", err)
+			}
+			if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(cost), 0) FROM actions WHERE user_id = ?", user.ID).Scan(&actions, &spent); err != nil {
+				t.Fatalf("count actions: %v", err)
+			}
+			if want := tt.tokens - tt.wantSuccess*tt.cost; balance != want {
+				t.Errorf("balance = %d, want %d", balance, want)
+			}
+			if actions != tt.wantSuccess || spent != tt.wantSuccess*tt.cost {
+				t.Errorf("recorded %d actions costing %d tokens, want %d costing %d", actions, spent, tt.wantSuccess, tt.wantSuccess*tt.cost)
+			}
+
+			var debited int
+			if err := db.QueryRow("SELECT COALESCE(SUM(delta), 0) FROM token_ledger WHERE user_id = ? AND reason = ?", user.ID, ledgerActivation).Scan(&debited); err != nil {
+				t.Fatalf("sum ledger: %v", err)
+			}
+			if debited != -tt.wantSuccess*tt.cost {
+				t.Errorf("ledger debited %d tokens, want %d", -debited, tt.wantSuccess*tt.cost)
+			}
+		})
+	}
+}
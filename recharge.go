@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// --- Recharge Policy ---
+// Visitors get tokens back in two ways. A recharge (the QR code in the maze) tops the
+// balance up to default_tokens, limited by a cooldown, a maximum per day and per session (one
+// user cookie), and optionally a code printed on the QR. The drip adds a token every
+// drip_interval up to drip_cap without any action from the visitor. All limits are off by
+// default, which keeps the old unlimited recharge.
+
+// dbRowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type dbRowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rechargeStatus is the recharge policy as it applies to one user, for /api/user/status.
+type rechargeStatus struct {
+	Available           bool       `json:"available"` // Whether a recharge would succeed now (given the code, if one is needed)
+	Reason              string     `json:"reason,omitempty"`
+	NeedsCode           bool       `json:"needs_code,omitempty"`
+	NextRechargeAt      *time.Time `json:"next_recharge_at,omitempty"` // When the cooldown or daily limit allows the next one
+	RemainingToday      *int       `json:"remaining_today,omitempty"`
+	RemainingSession    *int       `json:"remaining_session,omitempty"`
+	NextTokenAt         *time.Time `json:"next_token_at,omitempty"` // When the drip adds the next token
+	DripIntervalSeconds int        `json:"drip_interval_seconds,omitempty"`
+	DripCap             int        `json:"drip_cap,omitempty"`
+}
+
+// dripCap is the balance the drip refills up to.
+func (s *Settings) dripCap() int {
+	if s.DripCap > 0 {
+		return s.DripCap
+	}
+	return s.DefaultTokens
+}
+
+// rechargeAllowed checks the recharge limits for a user at now. If a recharge isn't allowed it
+// explains why and, if it will be allowed later, when.
+func (app *App) rechargeAllowed(db dbRowQuerier, userID string, now time.Time) (status rechargeStatus, err error) {
+	s := app.settings
+	status.NeedsCode = s.RechargeCode != ""
+	status.Available = true
+
+	// Timestamps are compared as Unix seconds. A visitor who isn't stored yet (see visitors.go)
+	// has no recharges to count.
+	var total, today int
+	var last, firstToday sql.NullInt64
+	if userID != "" {
+		dayAgo := now.Add(-24 * time.Hour).Unix()
+		err = db.QueryRow(`SELECT COUNT(*), MAX(CAST(strftime('%s', timestamp) AS INTEGER)),
+				COALESCE(SUM(CASE WHEN CAST(strftime('%s', timestamp) AS INTEGER) > ? THEN 1 ELSE 0 END), 0),
+				MIN(CASE WHEN CAST(strftime('%s', timestamp) AS INTEGER) > ? THEN CAST(strftime('%s', timestamp) AS INTEGER) END)
+			FROM recharges WHERE user_id = ? AND source = 'recharge'`, dayAgo, dayAgo, userID).Scan(&total, &last, &today, &firstToday)
+		if err != nil {
+			return status, fmt.Errorf("could not count recharges: %w", err)
+		}
+	}
+
+	refuse := func(reason string, next time.Time) {
+		if !status.Available {
+			return // Keep the first reason
+		}
+		status.Available = false
+		status.Reason = reason
+		if !next.IsZero() {
+			status.NextRechargeAt = &next
+		}
+	}
+	if s.RechargeMaxPerSession > 0 {
+		remaining := max(s.RechargeMaxPerSession-total, 0)
+		status.RemainingSession = &remaining
+		if remaining == 0 {
+			refuse(fmt.Sprintf("You've used all %d recharges.", s.RechargeMaxPerSession), time.Time{})
+		}
+	}
+	if s.RechargeMaxPerDay > 0 {
+		remaining := max(s.RechargeMaxPerDay-today, 0)
+		status.RemainingToday = &remaining
+		if remaining == 0 {
+			refuse(fmt.Sprintf("You've used all %d recharges for today.", s.RechargeMaxPerDay), time.Unix(firstToday.Int64, 0).Add(24*time.Hour))
+		}
+	}
+	if s.RechargeCooldown > 0 && last.Valid {
+		if next := time.Unix(last.Int64, 0).Add(s.RechargeCooldown); now.Before(next) {
+			refuse("You recharged recently.", next)
+		}
+	}
+	return status, nil
+}
+
+// userRechargeStatus reports the recharge policy and drip for a user.
+func (app *App) userRechargeStatus(user *User) (rechargeStatus, error) {
+	now := time.Now()
+	status, err := app.rechargeAllowed(app.db, user.ID, now)
+	if err != nil || app.settings.DripInterval <= 0 {
+		return status, err
+	}
+
+	status.DripIntervalSeconds = int(app.settings.DripInterval.Seconds())
+	status.DripCap = app.settings.dripCap()
+	if user.TokensRemaining < status.DripCap {
+		// A visitor who isn't stored yet starts their drip clock when they are.
+		var lastDrip sql.NullInt64
+		if user.ID != "" {
+			if err := app.db.QueryRow("SELECT last_drip_at FROM users WHERE id = ?", user.ID).Scan(&lastDrip); err != nil {
+				return status, fmt.Errorf("could not read last drip: %w", err)
+			}
+		}
+		next := now.Add(app.settings.DripInterval)
+		if lastDrip.Valid {
+			next = time.Unix(lastDrip.Int64, 0).Add(app.settings.DripInterval)
+		}
+		status.NextTokenAt = &next
+	}
+	return status, nil
+}
+
+// applyDrip adds the tokens a user has earned from the drip between lastDrip (Unix seconds, or
+// NULL if the user's clock hasn't started) and now. The drip clock only runs while the balance is below
+// the cap, so a visitor who has been full for an hour doesn't get a burst of tokens when they
+// start spending.
+func (app *App) applyDrip(user *User, lastDrip sql.NullInt64, now time.Time) error {
+	interval := app.settings.DripInterval
+	if interval <= 0 || user.IsAdmin {
+		return nil
+	}
+	capacity := app.settings.dripCap()
+	last := time.Unix(lastDrip.Int64, 0)
+
+	var grant int
+	next := now
+	switch {
+	case !lastDrip.Valid:
+		// Users from before the drip was enabled start their clock now.
+	case user.TokensRemaining >= capacity:
+		if now.Sub(last) < interval {
+			return nil // Restarting the clock once per interval is enough.
+		}
+	default:
+		earned := int(now.Sub(last) / interval)
+		if earned == 0 {
+			return nil
+		}
+		grant = min(earned, capacity-user.TokensRemaining)
+		if grant == earned {
+			next = last.Add(time.Duration(earned) * interval) // Keep progress towards the next token.
+		}
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the request that moves the clock grants the tokens, so parallel requests don't
+	// grant them twice.
+	var previous interface{}
+	if lastDrip.Valid {
+		previous = lastDrip.Int64
+	}
+	res, err := tx.Exec("UPDATE users SET last_drip_at = ? WHERE id = ? AND last_drip_at IS ?", next.Unix(), user.ID, previous)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return nil
+	}
+	if grant > 0 {
+		if err := adjustTokens(tx, user.ID, grant, ledgerDrip, 0); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.TokensRemaining += grant
+	return nil
+}
+
+// formatWait describes a wait for visitors, rounded up to the minute: "1 hour 5 minutes".
+func formatWait(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case minutes < 60:
+		return plural(max(minutes, 1), "minute")
+	case minutes%60 == 0:
+		return plural(minutes/60, "hour")
+	default:
+		return plural(minutes/60, "hour") + " " + plural(minutes%60, "minute")
+	}
+}
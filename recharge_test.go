@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestRechargeAllowed checks the cooldown and the daily and per-session limits against a fixed
+// time, given the recharges a user made before it.
+func TestRechargeAllowed(t *testing.T) {
+	now := time.Date(2025, 10, 31, 20, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	tests := []struct {
+		name          string
+		cooldown      time.Duration
+		maxPerDay     int
+		maxPerSession int
+		recharges     []time.Duration // How long before now each recharge was made
+		redeems       []time.Duration // Redeemed codes, which don't count
+		wantAvailable bool
+		wantReason    string
+		wantNext      time.Time // Zero for none
+		wantToday     int       // -1 if not reported
+		wantSession   int       // -1 if not reported
+	}{
+		{
+			name:          "no limits",
+			recharges:     []time.Duration{time.Minute, 2 * time.Minute},
+			wantAvailable: true,
+			wantToday:     -1,
+			wantSession:   -1,
+		},
+		{
+			name:        "in cooldown",
+			cooldown:    30 * time.Minute,
+			recharges:   []time.Duration{2 * time.Hour, 10 * time.Minute},
+			wantReason:  "You recharged recently.",
+			wantNext:    ago(10 * time.Minute).Add(30 * time.Minute),
+			wantToday:   -1,
+			wantSession: -1,
+		},
+		{
+			name:          "cooldown over",
+			cooldown:      30 * time.Minute,
+			recharges:     []time.Duration{30 * time.Minute},
+			wantAvailable: true,
+			wantToday:     -1,
+			wantSession:   -1,
+		},
+		{
+			name:        "daily limit reached",
+			maxPerDay:   2,
+			recharges:   []time.Duration{30 * time.Hour, 20 * time.Hour, time.Hour},
+			wantReason:  "You've used all 2 recharges for today.",
+			wantNext:    ago(20 * time.Hour).Add(24 * time.Hour),
+			wantToday:   0,
+			wantSession: -1,
+		},
+		{
+			name:          "recharges over a day ago don't count for today",
+			maxPerDay:     2,
+			recharges:     []time.Duration{30 * time.Hour, 25 * time.Hour, time.Hour},
+			wantAvailable: true,
+			wantToday:     1,
+			wantSession:   -1,
+		},
+		{
+			name:          "session limit reached",
+			maxPerSession: 3,
+			recharges:     []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour},
+			wantReason:    "You've used all 3 recharges.",
+			wantToday:     -1,
+			wantSession:   0,
+		},
+		{
+			name:          "redeemed codes don't count",
+			cooldown:      time.Hour,
+			maxPerDay:     1,
+			maxPerSession: 1,
+			redeems:       []time.Duration{time.Minute},
+			wantAvailable: true,
+			wantToday:     1,
+			wantSession:   1,
+		},
+		{
+			name:          "first reason is kept",
+			cooldown:      time.Hour,
+			maxPerDay:     1,
+			maxPerSession: 1,
+			recharges:     []time.Duration{time.Minute},
+			wantReason:    "You've used all 1 recharges.",
+			wantToday:     0,
+			wantSession:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			app.settings.RechargeCooldown = tt.cooldown
+			app.settings.RechargeMaxPerDay = tt.maxPerDay
+			app.settings.RechargeMaxPerSession = tt.maxPerSession
+			insert := func(d time.Duration, source string) {
+				_, err := app.db.Exec("INSERT INTO recharges (user_id, timestamp, source) VALUES (?, ?, ?)",
+					"visitor", ago(d).Format("2006-01-02 15:04:05"), source)
+				if err != nil {
+					t.Fatalf("insert recharge: %v", err)
+				}
+			}
+			for _, d := range tt.recharges {
+				insert(d, "recharge")
+			}
+			for _, d := range tt.redeems {
+				insert(d, "redeem")
+			}
+
+			status, err := app.rechargeAllowed(app.db, "visitor", now)
+			if err != nil {
+				t.Fatalf("rechargeAllowed: %v", err)
+			}
+			if status.Available != tt.wantAvailable || status.Reason != tt.wantReason {
+				t.Errorf("got available %v (%q), want %v (%q)", status.Available, status.Reason, tt.wantAvailable, tt.wantReason)
+			}
+			var next time.Time
+			if status.NextRechargeAt != nil {
+				next = *status.NextRechargeAt
+			}
+			if !next.Equal(tt.wantNext) {
+				t.Errorf("next recharge at %v, want %v", next, tt.wantNext)
+			}
+			remaining := func(n *int) int {
+				if n == nil {
+					return -1
+				}
+				return *n
+			}
+			if got := remaining(status.RemainingToday); got != tt.wantToday {
+				t.Errorf("remaining today = %d, want %d", got, tt.wantToday)
+			}
+			if got := remaining(status.RemainingSession); got != tt.wantSession {
+				t.Errorf("remaining session = %d, want %d", got, tt.wantSession)
+			}
+		})
+	}
+}
+
+// TestApplyDrip checks the tokens the drip grants at a fixed time and where it leaves the
+// user's clock, with a drip of one token every 10 minutes up to 10 tokens.
+func TestApplyDrip(t *testing.T) {
+	now := time.Date(2025, 10, 31, 20, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) sql.NullInt64 { return sql.NullInt64{Int64: now.Add(-d).Unix(), Valid: true} }
+	tests := []struct {
+		name        string
+		tokens      int
+		admin       bool
+		lastDrip    sql.NullInt64
+		wantTokens  int
+		wantDripped int           // Sum of the drip ledger entries
+		wantLast    sql.NullInt64 // last_drip_at afterwards
+	}{
+		{
+			name:       "clock starts",
+			tokens:     3,
+			wantTokens: 3,
+			wantLast:   ago(0),
+		},
+		{
+			name:       "less than an interval",
+			tokens:     3,
+			lastDrip:   ago(9 * time.Minute),
+			wantTokens: 3,
+			wantLast:   ago(9 * time.Minute),
+		},
+		{
+			name:        "progress towards the next token is kept",
+			tokens:      3,
+			lastDrip:    ago(25 * time.Minute),
+			wantTokens:  5,
+			wantDripped: 2,
+			wantLast:    ago(5 * time.Minute),
+		},
+		{
+			name:        "grant stops at the cap",
+			tokens:      8,
+			lastDrip:    ago(2 * time.Hour),
+			wantTokens:  10,
+			wantDripped: 2,
+			wantLast:    ago(0),
+		},
+		{
+			name:       "at the cap the clock restarts once per interval",
+			tokens:     10,
+			lastDrip:   ago(5 * time.Minute),
+			wantTokens: 10,
+			wantLast:   ago(5 * time.Minute),
+		},
+		{
+			name:       "at the cap for a long time",
+			tokens:     10,
+			lastDrip:   ago(3 * time.Hour),
+			wantTokens: 10,
+			wantLast:   ago(0),
+		},
+		{
+			name:       "above the cap",
+			tokens:     25,
+			lastDrip:   ago(3 * time.Hour),
+			wantTokens: 25,
+			wantLast:   ago(0),
+		},
+		{
+			name:       "admins are left alone",
+			tokens:     0,
+			admin:      true,
+			lastDrip:   ago(3 * time.Hour),
+			wantTokens: 0,
+			wantLast:   ago(3 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			app.settings.DripInterval = 10 * time.Minute
+			app.settings.DripCap = 10
+			user := &User{ID: "visitor", TokensRemaining: tt.tokens, IsAdmin: tt.admin}
+			var lastDrip interface{}
+			if tt.lastDrip.Valid {
+				lastDrip = tt.lastDrip.Int64
+			}
+			if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin, last_drip_at) VALUES (?, ?, ?, ?)",
+				user.ID, tt.tokens, tt.admin, lastDrip); err != nil {
+				t.Fatalf("insert user: %v", err)
+			}
+
+			if err := app.applyDrip(user, tt.lastDrip, now); err != nil {
+				t.Fatalf("applyDrip: %v", err)
+			}
+			var tokens, dripped int
+			var last sql.NullInt64
+			if err := app.db.QueryRow("SELECT tokens_remaining, last_drip_at FROM users WHERE id = ?", user.ID).Scan(&tokens, &last); err != nil {
+				t.Fatalf("read user: %v", err)
+			}
+			if err := app.db.QueryRow("SELECT COALESCE(SUM(delta), 0) FROM token_ledger WHERE user_id = ? AND reason = ?", user.ID, ledgerDrip).Scan(&dripped); err != nil {
+				t.Fatalf("read ledger: %v", err)
+			}
+			if tokens != tt.wantTokens || user.TokensRemaining != tt.wantTokens {
+				t.Errorf("balance = %d (user %d), want %d", tokens, user.TokensRemaining, tt.wantTokens)
+			}
+			if dripped != tt.wantDripped {
+				t.Errorf("drip ledger entries add up to %d, want %d", dripped, tt.wantDripped)
+			}
+			if last != tt.wantLast {
+				t.Errorf("last_drip_at = %v, want %v", last, tt.wantLast)
+			}
+		})
+	}
+}
+
+// TestRechargeTopsUp checks that a recharge raises the balance to the default but keeps tokens
+// above it, such as from a redeemed code, without recording a negative recharge.
+func TestRechargeTopsUp(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     int
+		wantTokens int
+		wantLedger []int // Deltas of the recharge ledger entries
+	}{
+		{name: "below the default", tokens: 2, wantTokens: 10, wantLedger: []int{8}},
+		{name: "at the default", tokens: 10, wantTokens: 10},
+		{name: "above the default", tokens: 25, wantTokens: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			app.settings.DefaultTokens = 10
+			user := &User{ID: "visitor", TokensRemaining: tt.tokens}
+			if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin) VALUES (?, ?, 0)", user.ID, tt.tokens); err != nil {
+				t.Fatalf("insert user: %v", err)
+			}
+
+			rec := httptest.NewRecorder()
+			app.rechargeHandler()(rec, requestAs(user, http.MethodGet, "/api/recharge", ""))
+			if rec.Code != http.StatusFound {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+			}
+
+			var tokens, recharges int
+			if err := app.db.QueryRow("SELECT tokens_remaining, (SELECT COUNT(*) FROM recharges WHERE user_id = users.id) FROM users WHERE id = ?", user.ID).Scan(&tokens, &recharges); err != nil {
+				t.Fatalf("read user: %v", err)
+			}
+			if tokens != tt.wantTokens || recharges != 1 {
+				t.Errorf("got balance %d and %d recharges, want %d and 1", tokens, recharges, tt.wantTokens)
+			}
+			rows, err := app.db.Query("SELECT delta FROM token_ledger WHERE user_id = ? AND reason = ? ORDER BY id", user.ID, ledgerRecharge)
+			if err != nil {
+				t.Fatalf("read ledger: %v", err)
+			}
+			defer rows.Close()
+			var deltas []int
+			for rows.Next() {
+				var delta int
+				if err := rows.Scan(&delta); err != nil {
+					t.Fatalf("scan ledger: %v", err)
+				}
+				deltas = append(deltas, delta)
+			}
+			if !slices.Equal(deltas, tt.wantLedger) {
+				t.Errorf("recharge ledger deltas = %v, want %v", deltas, tt.wantLedger)
+			}
+		})
+	}
+}
+
+// TestUserStatusWithoutCookie checks the status of a visitor who isn't stored yet: the default
+// balance with every recharge still available and the drip clock starting now, without adding
+// a user.
+func TestUserStatusWithoutCookie(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.settings.DefaultTokens = 10
+	app.settings.DripInterval = 10 * time.Minute
+	app.settings.DripCap = 20
+	app.settings.RechargeMaxPerDay = 3
+	app.settings.RechargeCooldown = time.Hour
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	app.userAuthMiddleware(app.userStatusHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var status struct {
+		TokensRemaining int            `json:"tokens_remaining"`
+		Recharge        rechargeStatus `json:"recharge"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	r := status.Recharge
+	if status.TokensRemaining != 10 || !r.Available || r.RemainingToday == nil || *r.RemainingToday != 3 || r.DripCap != 20 {
+		t.Errorf("got balance %d and recharge status %+v, want 10 tokens and all 3 recharges available", status.TokensRemaining, r)
+	}
+	if r.NextTokenAt == nil || r.NextTokenAt.Before(start.Add(10*time.Minute).Truncate(time.Second)) || r.NextTokenAt.After(time.Now().Add(10*time.Minute)) {
+		t.Errorf("next token at %v, want 10 minutes from now", r.NextTokenAt)
+	}
+
+	var users int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		t.Fatalf("count users: %v", err)
+	}
+	if users != 0 {
+		t.Errorf("%d users were created, want none", users)
+	}
+}
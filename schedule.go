@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Availability Windows ---
+// A trigger can be limited to show hours with an "availability" block. Outside its windows the
+// trigger stays on the dashboard with a countdown to when it opens, and activateHandler refuses
+// it before a token is spent:
+//
+//	"availability": {
+//	  "timezone": "America/New_York",
+//	  "days": ["fri", "sat"],
+//	  "times": ["19:00-23:30", "23:30-01:00"],
+//	  "from": "2025-10-01",
+//	  "until": "2025-11-01"
+//	}
+//
+// A time range that ends before it starts runs past midnight and belongs to the day it starts
+// on, so "fri" with "20:00-02:00" is open until 2am on Saturday. Days and the date range also
+// refer to the day a window starts.
+
+// Availability restricts when a trigger can be activated. Empty fields don't restrict anything.
+type Availability struct {
+	Timezone string   `json:"timezone,omitempty"` // IANA name; defaults to the server's local time
+	Days     []string `json:"days,omitempty"`     // "mon" to "sun" (or full names)
+	Times    []string `json:"times,omitempty"`    // "HH:MM-HH:MM" ranges; "24:00" ends at midnight
+	From     string   `json:"from,omitempty"`     // First day, "YYYY-MM-DD"
+	Until    string   `json:"until,omitempty"`    // Last day (inclusive), "YYYY-MM-DD"
+}
+
+// schedule is a parsed Availability.
+type schedule struct {
+	location    *time.Location
+	days        [7]bool // Indexed by time.Weekday
+	windows     []timeWindow
+	from, until time.Time // Midnight in location; zero when unbounded
+}
+
+// timeWindow is a range of minutes since midnight. end <= start runs past midnight.
+type timeWindow struct {
+	start, end int
+}
+
+const maxScheduleLookahead = 400 // Days to search for the next window, enough for a yearly event.
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parseClock parses "HH:MM" into minutes since midnight. "24:00" is allowed as an end time.
+func parseClock(s string) (int, bool) {
+	if len(s) != 5 || s[2] != ':' || strings.Trim(s[:2]+s[3:], "0123456789") != "" {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(s[:2])
+	m, _ := strconv.Atoi(s[3:])
+	if m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// parse checks an Availability and converts it into a schedule. Every problem is reported
+// through add with the field it belongs to.
+func (a *Availability) parse(add func(field, format string, args ...interface{})) *schedule {
+	s := &schedule{location: time.Local}
+	ok := true
+	if a.Timezone != "" {
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			add("timezone", "unknown time zone %q", a.Timezone)
+			ok = false
+		} else {
+			s.location = loc
+		}
+	}
+
+	for i, name := range a.Days {
+		day, known := weekdayNames[strings.ToLower(name)]
+		if !known {
+			add(fmt.Sprintf("days[%d]", i), "unknown day %q (expected mon, tue, wed, thu, fri, sat or sun)", name)
+			ok = false
+			continue
+		}
+		s.days[day] = true
+	}
+	if len(a.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	for i, r := range a.Times {
+		startText, endText, _ := strings.Cut(r, "-")
+		start, startOK := parseClock(strings.TrimSpace(startText))
+		end, endOK := parseClock(strings.TrimSpace(endText))
+		if !startOK || !endOK || start == 24*60 {
+			add(fmt.Sprintf("times[%d]", i), "must be a range like \"18:00-23:30\", got %q", r)
+			ok = false
+			continue
+		}
+		if start == end {
+			add(fmt.Sprintf("times[%d]", i), "starts and ends at the same time")
+			ok = false
+			continue
+		}
+		s.windows = append(s.windows, timeWindow{start: start, end: end})
+	}
+	if len(a.Times) == 0 {
+		s.windows = []timeWindow{{start: 0, end: 24 * 60}}
+	}
+
+	parseDate := func(field, value string) time.Time {
+		if value == "" {
+			return time.Time{}
+		}
+		d, err := time.ParseInLocation(time.DateOnly, value, s.location)
+		if err != nil {
+			add(field, "must be a date like 2025-10-31, got %q", value)
+			ok = false
+		}
+		return d
+	}
+	s.from = parseDate("from", a.From)
+	s.until = parseDate("until", a.Until)
+	if !s.from.IsZero() && !s.until.IsZero() && s.until.Before(s.from) {
+		add("until", "is before from")
+		ok = false
+	}
+
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// openAt reports whether the schedule is open at now. If it isn't, next is the start of the
+// next window, or zero if the schedule never opens again.
+func (s *schedule) openAt(now time.Time) (open bool, next time.Time) {
+	now = now.In(s.location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.location)
+
+	// Start a day early for windows that began yesterday and run past midnight.
+	for offset := -1; offset <= maxScheduleLookahead; offset++ {
+		day := today.AddDate(0, 0, offset)
+		if !s.until.IsZero() && day.After(s.until) {
+			break
+		}
+		if !s.days[day.Weekday()] || (!s.from.IsZero() && day.Before(s.from)) {
+			continue
+		}
+		for _, w := range s.windows {
+			// time.Date normalises minutes past the end of the day and keeps wall-clock times
+			// correct across daylight saving changes.
+			endMinutes := w.end
+			if w.end <= w.start {
+				endMinutes += 24 * 60
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, s.location)
+			end := time.Date(day.Year(), day.Month(), day.Day(), 0, endMinutes, 0, 0, s.location)
+			if !now.Before(start) && now.Before(end) {
+				return true, time.Time{}
+			}
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		// Windows that contain now start today at the latest, so once today has been checked
+		// the first day with a later window has the earliest one.
+		if offset >= 0 && !next.IsZero() {
+			break
+		}
+	}
+	return false, next
+}
+
+// compileSchedules parses the availability of every trigger in the config and reports the
+// ones that are invalid.
+func compileSchedules(config *Config) []configProblem {
+	var problems []configProblem
+	for i := range config.Triggers {
+		t := &config.Triggers[i]
+		t.schedule = nil
+		if t.Availability == nil {
+			continue
+		}
+		file, path := config.triggerLocation(i)
+		t.schedule = t.Availability.parse(func(field, format string, args ...interface{}) {
+			problems = append(problems, configProblem{File: file, Path: path + ".availability." + field, Message: fmt.Sprintf(format, args...)})
+		})
+	}
+	return problems
+}
+
+// availableAt reports whether the trigger's availability windows allow it to be activated at
+// now, and when it opens next if they don't.
+func (t *Trigger) availableAt(now time.Time) (bool, time.Time) {
+	if t.schedule == nil {
+		return true, time.Time{}
+	}
+	return t.schedule.openAt(now)
+}
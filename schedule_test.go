@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScheduleOpenAt checks when a schedule is open and when it opens next, including windows
+// that run past midnight, the from and until dates and daylight saving changes. The times are
+// in New York, where 2025 daylight saving time starts on March 9 and ends on November 2.
+func TestScheduleOpenAt(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04 -0700", s)
+		if err != nil {
+			t.Fatalf("bad test time %q: %v", s, err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name     string
+		avail    Availability
+		now      string
+		wantOpen bool
+		wantNext string // Empty for none
+	}{
+		{
+			name:     "inside a window",
+			avail:    Availability{Days: []string{"fri"}, Times: []string{"19:00-23:30"}},
+			now:      "2025-10-03 20:00 -0400",
+			wantOpen: true,
+		},
+		{
+			name:     "before a window on the same day",
+			avail:    Availability{Days: []string{"fri"}, Times: []string{"19:00-23:30"}},
+			now:      "2025-10-03 18:59 -0400",
+			wantNext: "2025-10-03 19:00 -0400",
+		},
+		{
+			name:     "end is exclusive",
+			avail:    Availability{Days: []string{"fri"}, Times: []string{"19:00-23:30"}},
+			now:      "2025-10-03 23:30 -0400",
+			wantNext: "2025-10-10 19:00 -0400",
+		},
+		{
+			name:     "earliest of several windows",
+			avail:    Availability{Times: []string{"21:00-22:00", "12:00-13:00"}},
+			now:      "2025-10-03 14:00 -0400",
+			wantNext: "2025-10-03 21:00 -0400",
+		},
+		{
+			name:     "until midnight",
+			avail:    Availability{Times: []string{"18:00-24:00"}},
+			now:      "2025-10-03 23:59 -0400",
+			wantOpen: true,
+		},
+		{
+			name:     "window past midnight belongs to the day it starts",
+			avail:    Availability{Days: []string{"fri"}, Times: []string{"20:00-02:00"}},
+			now:      "2025-10-04 01:00 -0400", // Saturday
+			wantOpen: true,
+		},
+		{
+			name:     "window past midnight has ended",
+			avail:    Availability{Days: []string{"fri"}, Times: []string{"20:00-02:00"}},
+			now:      "2025-10-04 02:00 -0400",
+			wantNext: "2025-10-10 20:00 -0400",
+		},
+		{
+			name:     "early morning of a listed day isn't the previous night's window",
+			avail:    Availability{Days: []string{"sat"}, Times: []string{"20:00-02:00"}},
+			now:      "2025-10-04 01:00 -0400", // Saturday, but the window started on Friday
+			wantNext: "2025-10-04 20:00 -0400",
+		},
+		{
+			name:     "before from",
+			avail:    Availability{From: "2025-10-10", Times: []string{"19:00-23:00"}},
+			now:      "2025-10-01 20:00 -0400",
+			wantNext: "2025-10-10 19:00 -0400",
+		},
+		{
+			name:     "last night's window runs past until",
+			avail:    Availability{Until: "2025-10-31", Times: []string{"20:00-02:00"}},
+			now:      "2025-11-01 01:00 -0400",
+			wantOpen: true,
+		},
+		{
+			name:  "after until",
+			avail: Availability{Until: "2025-10-31", Times: []string{"20:00-02:00"}},
+			now:   "2025-11-01 02:00 -0400",
+		},
+		{
+			name:     "other time zone",
+			avail:    Availability{Timezone: "Europe/London", Times: []string{"19:00-23:00"}},
+			now:      "2025-10-03 15:00 -0400", // 20:00 in London
+			wantOpen: true,
+		},
+		{
+			name:     "window past midnight when clocks go back",
+			avail:    Availability{Days: []string{"sat"}, Times: []string{"20:00-02:00"}},
+			now:      "2025-11-02 01:30 -0500", // The second 1:30, after clocks went back
+			wantOpen: true,
+		},
+		{
+			name:     "window past midnight ends at 2am after clocks go back",
+			avail:    Availability{Days: []string{"sat"}, Times: []string{"20:00-02:00"}},
+			now:      "2025-11-02 02:00 -0500",
+			wantNext: "2025-11-08 20:00 -0500",
+		},
+		{
+			name:     "window past midnight when clocks go forward",
+			avail:    Availability{Days: []string{"sat"}, Times: []string{"22:00-04:00"}},
+			now:      "2025-03-09 03:30 -0400",
+			wantOpen: true,
+		},
+		{
+			name:     "next window after clocks go forward",
+			avail:    Availability{Times: []string{"03:00-05:00"}},
+			now:      "2025-03-09 01:00 -0500",
+			wantNext: "2025-03-09 03:00 -0400",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.avail.Timezone == "" {
+				tt.avail.Timezone = "America/New_York"
+			}
+			s := tt.avail.parse(func(field, format string, args ...interface{}) {
+				t.Fatalf("invalid availability: %s: "+format, append([]interface{}{field}, args...)...)
+			})
+			open, next := s.openAt(at(tt.now))
+			if open != tt.wantOpen {
+				t.Errorf("open = %v, want %v", open, tt.wantOpen)
+			}
+			var wantNext time.Time
+			if tt.wantNext != "" {
+				wantNext = at(tt.wantNext)
+			}
+			if !next.Equal(wantNext) {
+				t.Errorf("next = %v, want %v", next, wantNext)
+			}
+		})
+	}
+}
+
+// TestAvailabilityParseProblems checks that invalid availability blocks are reported against
+// the field to fix.
+func TestAvailabilityParseProblems(t *testing.T) {
+	tests := []struct {
+		name  string
+		avail Availability
+		want  string
+	}{
+		{name: "unknown time zone", avail: Availability{Timezone: "Mars/Olympus"}, want: "timezone"},
+		{name: "unknown day", avail: Availability{Days: []string{"fri", "caturday"}}, want: "days[1]"},
+		{name: "bad range", avail: Availability{Times: []string{"19:00"}}, want: "times[0]"},
+		{name: "bad minutes", avail: Availability{Times: []string{"19:60-20:00"}}, want: "times[0]"},
+		{name: "starts at 24:00", avail: Availability{Times: []string{"24:00-02:00"}}, want: "times[0]"},
+		{name: "empty range", avail: Availability{Times: []string{"19:00-19:00"}}, want: "times[0]"},
+		{name: "bad date", avail: Availability{From: "31/10/2025"}, want: "from"},
+		{name: "until before from", avail: Availability{From: "2025-10-31", Until: "2025-10-01"}, want: "until"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			s := tt.avail.parse(func(field, format string, args ...interface{}) { fields = append(fields, field) })
+			if s != nil || len(fields) != 1 || fields[0] != tt.want {
+				t.Errorf("got schedule %v and problems at %q, want no schedule and one problem at %q", s, fields, tt.want)
+			}
+		})
+	}
+}
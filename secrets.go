@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// --- Secret References ---
+// Secret fields (secret_key, hue_app_key and command env values) may hold a reference instead
+// of the secret itself: "env:NAME" reads an environment variable and "file:/run/secrets/x"
+// reads a file, such as a Docker or Kubernetes secret. References are resolved whenever the
+// config is loaded or reloaded; the config keeps the reference so it is never shown or stored
+// in place of the secret. validate-config runs where the secrets usually aren't, so it only
+// checks the syntax of references and warns about the ones it can't resolve.
+//
+// Only the config files may use references. Admins who can edit triggers could otherwise point
+// one at any environment variable or file and send it to a host of their choosing, so stored
+// triggers may only keep the reference of the file trigger they override, and get its secret.
+
+const redactedSecret = "[REDACTED]"
+
+// triggerSecrets holds a trigger's resolved secret values.
+type triggerSecrets struct {
+	secretKey string
+	hueAppKey string
+	env       map[string]string
+}
+
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "file:")
+}
+
+// checkSecretReference reports a reference that can't refer to anything, whatever machine it
+// is resolved on.
+func checkSecretReference(value string) error {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			return fmt.Errorf("%q is not a valid environment variable name", name)
+		}
+	case strings.HasPrefix(value, "file:"):
+		if strings.TrimPrefix(value, "file:") == "" {
+			return fmt.Errorf("file: reference has no path")
+		}
+	}
+	return nil
+}
+
+// resolveSecret returns the value a secret field refers to. Values without an env: or file:
+// prefix are literal secrets and returned as-is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		path := strings.TrimPrefix(value, "file:")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file: %w", err)
+		}
+		secret := strings.TrimRight(string(data), "\r\n") // Secret files usually end with a newline.
+		if secret == "" {
+			return "", fmt.Errorf("secret file %s is empty", path)
+		}
+		return secret, nil
+	default:
+		return value, nil
+	}
+}
+
+// resolveSecrets resolves the secret references of every trigger in the config and reports
+// the ones that can't be resolved: as errors if required is set, as warnings otherwise. It
+// also records the referenced files, so they are watched, and a hash of the resolved values,
+// so a rotated secret counts as a change on reload. The hash is kept apart from the config
+// hash, which admins can see.
+func resolveSecrets(config *Config, required bool) []configProblem {
+	var problems []configProblem
+	sum := sha256.New()
+	config.secretFiles = nil
+	for i := range config.Triggers {
+		t := &config.Triggers[i]
+		file, path := config.triggerLocation(i)
+		resolve := func(field, value string) string {
+			if !isSecretReference(value) {
+				return value
+			}
+			if err := checkSecretReference(value); err != nil {
+				problems = append(problems, configProblem{File: file, Path: path + "." + field, Message: err.Error()})
+				return ""
+			}
+			if name, ok := strings.CutPrefix(value, "file:"); ok {
+				config.secretFiles = append(config.secretFiles, name)
+			}
+			secret, err := resolveSecret(value)
+			if err != nil {
+				p := configProblem{File: file, Path: path + "." + field, Message: err.Error()}
+				if !required {
+					p.Message += " here; it must be available where the server runs"
+					p.Warning = true
+				}
+				problems = append(problems, p)
+			}
+			fmt.Fprintf(sum, "%s\x00%s\x00%d\x00%s", value, path+"."+field, len(secret), secret)
+			return secret
+		}
+
+		t.secrets = triggerSecrets{
+			secretKey: resolve("secret_key", t.SecretKey),
+			hueAppKey: resolve("hue_app_key", t.HueAppKey),
+		}
+		if len(t.Env) > 0 {
+			t.secrets.env = make(map[string]string, len(t.Env))
+			for _, k := range slices.Sorted(maps.Keys(t.Env)) { // Sorted so the hash is stable.
+				t.secrets.env[k] = resolve("env."+k, t.Env[k])
+			}
+		}
+	}
+	config.secretHash = hex.EncodeToString(sum.Sum(nil))
+	return problems
+}
+
+// resolveStoredSecrets sets the secrets of the triggers stored in the database. Their literal
+// secrets are used as they are. A reference is only allowed if the file trigger with the same
+// id uses it for the same field and sends it to the same place, and then that trigger's
+// resolved secret is used.
+func resolveStoredSecrets(config *Config, file *Config) []configProblem {
+	fileTriggers := make(map[string]*Trigger, len(file.Triggers))
+	for i := range file.Triggers {
+		fileTriggers[file.Triggers[i].ID] = &file.Triggers[i]
+	}
+
+	var problems []configProblem
+	for i := range config.Triggers {
+		if i >= len(config.sources) || config.sources[i].file != storedTriggerFile {
+			continue // File triggers were resolved when their file was loaded.
+		}
+		t := &config.Triggers[i]
+		ft := fileTriggers[t.ID]
+		if ft == nil {
+			ft = &Trigger{}
+		}
+		_, path := config.triggerLocation(i)
+		resolve := func(field, value, fileValue, fileSecret string) string {
+			if !isSecretReference(value) {
+				return value
+			}
+			if value != fileValue {
+				problems = append(problems, configProblem{File: storedTriggerFile, Path: path + "." + field, Message: "secret references (env: and file:) can only be used in config files"})
+				return ""
+			}
+			if !sameSecretTarget(t, ft) {
+				problems = append(problems, configProblem{File: storedTriggerFile, Path: path + "." + field, Message: "secret references can only be kept while arduino_ip, hue_bridge_ip and command match the config file; enter the secret instead"})
+				return ""
+			}
+			return fileSecret
+		}
+
+		t.secrets = triggerSecrets{
+			secretKey: resolve("secret_key", t.SecretKey, ft.SecretKey, ft.secrets.secretKey),
+			hueAppKey: resolve("hue_app_key", t.HueAppKey, ft.HueAppKey, ft.secrets.hueAppKey),
+		}
+		if len(t.Env) > 0 {
+			t.secrets.env = make(map[string]string, len(t.Env))
+			for k, v := range t.Env {
+				t.secrets.env[k] = resolve("env."+k, v, ft.Env[k], ft.secrets.env[k])
+			}
+		}
+	}
+	return problems
+}
+
+// sameSecretTarget reports whether two definitions of a trigger send their secrets to the same
+// device or command, so that one may inherit the other's secrets.
+func sameSecretTarget(a, b *Trigger) bool {
+	return a.ArduinoIP == b.ArduinoIP && a.HueBridgeIP == b.HueBridgeIP && a.Command == b.Command
+}
+
+// secretReferenceField returns the first secret field of t that holds a reference, or "".
+func secretReferenceField(t *Trigger) string {
+	if isSecretReference(t.SecretKey) {
+		return "secret_key"
+	}
+	if isSecretReference(t.HueAppKey) {
+		return "hue_app_key"
+	}
+	for k, v := range t.Env {
+		if isSecretReference(v) {
+			return "env." + k
+		}
+	}
+	return ""
+}
+
+// withRedactedSecrets returns a copy of the trigger with its secrets replaced by a placeholder.
+// References are replaced too, so that saving an edited trigger keeps them through
+// restoreRedactedSecrets rather than sending them back, which isn't allowed.
+func withRedactedSecrets(t Trigger) Trigger {
+	redact := func(value string) string {
+		if value == "" {
+			return value
+		}
+		return redactedSecret
+	}
+	t.SecretKey = redact(t.SecretKey)
+	t.HueAppKey = redact(t.HueAppKey)
+	if len(t.Env) > 0 {
+		env := make(map[string]string, len(t.Env))
+		for k, v := range t.Env {
+			env[k] = redact(v)
+		}
+		t.Env = env
+	}
+	t.secrets = triggerSecrets{}
+	return t
+}
+
+func hasRedactedSecret(t *Trigger) bool {
+	for _, v := range t.Env {
+		if v == redactedSecret {
+			return true
+		}
+	}
+	return t.SecretKey == redactedSecret || t.HueAppKey == redactedSecret
+}
+
+// restoreRedactedSecrets puts back the previous values of secret fields an editor left as the
+// placeholder, so a redacted trigger can be edited and saved without re-entering its secrets.
+// Nothing is restored if the trigger now points somewhere else, as that would send the
+// previous secrets there.
+func restoreRedactedSecrets(t *Trigger, previous *Trigger) {
+	if previous == nil || !sameSecretTarget(t, previous) {
+		return
+	}
+	if t.SecretKey == redactedSecret {
+		t.SecretKey = previous.SecretKey
+	}
+	if t.HueAppKey == redactedSecret {
+		t.HueAppKey = previous.HueAppKey
+	}
+	for k, v := range t.Env {
+		if v == redactedSecret {
+			t.Env[k] = previous.Env[k]
+		}
+	}
+}
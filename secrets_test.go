@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestLoadConfigFileSecretReferences checks that unresolvable references only fail the load
+// when the secrets are required, and that malformed ones always do.
+func TestLoadConfigFileSecretReferences(t *testing.T) {
+	t.Setenv("DOOR_KEY", "door-secret")
+	tests := []struct {
+		name           string
+		secretKey      string
+		requireSecrets bool
+		want           []string // "error: path" or "warning: path"
+	}{
+		{name: "resolvable", secretKey: "env:DOOR_KEY", requireSecrets: true},
+		{name: "missing when required", secretKey: "env:NO_SUCH_KEY", requireSecrets: true, want: []string{"error: triggers[0].secret_key"}},
+		{name: "missing when validating", secretKey: "env:NO_SUCH_KEY", want: []string{"warning: triggers[0].secret_key"}},
+		{name: "missing file when validating", secretKey: "file:/nonexistent/door_key", want: []string{"warning: triggers[0].secret_key"}},
+		{name: "empty variable name", secretKey: "env:", want: []string{"error: triggers[0].secret_key"}},
+		{name: "empty file path", secretKey: "file:", want: []string{"error: triggers[0].secret_key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			config := `{"triggers": [{"id": "door", "name": "Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "` + tt.secretKey + `"}]}`
+			if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, problems, err := loadConfigFile(path, tt.requireSecrets)
+			var cerr *configError
+			if errors.As(err, &cerr) {
+				problems = cerr.Problems
+			} else if err != nil {
+				t.Fatalf("loadConfigFile: %v", err)
+			}
+			var got []string
+			for _, p := range problems {
+				severity := "error"
+				if p.Warning {
+					severity = "warning"
+				}
+				got = append(got, severity+": "+p.Path)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got problems %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReloadConfigRotatedSecretFile checks that a changed secret file is picked up on reload
+// even though the config files themselves are unchanged.
+func TestReloadConfigRotatedSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "door_key")
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(secretPath, []byte("old-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"triggers": [{"id": "door", "name": "Door", "description": "Creak", "arduino_ip": "10.0.0.5", "secret_key": "file:` + secretPath + `"}]}`
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !slices.Contains(file.secretFiles, secretPath) {
+		t.Errorf("secret files = %q, want %q watched", file.secretFiles, secretPath)
+	}
+	app := newTestApp(t, file)
+	app.settings.ConfigPath = configPath
+
+	if err := os.WriteFile(secretPath, []byte("new-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	app.reloadConfig()
+	if got := app.config.Triggers[0].secrets.secretKey; got != "new-secret" {
+		t.Errorf("secret after reload = %q, want %q", got, "new-secret")
+	}
+	if app.config.hash != file.hash {
+		t.Errorf("config hash changed from %s to %s, want it to cover the config files only", file.hash, app.config.hash)
+	}
+}
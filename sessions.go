@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Sessions ---
+// The user and public access cookies hold signed session tokens instead of the user ID and the
+// access key themselves, so they can't be forged or made up from a leaked user ID. A token is
+// the ID of the key that signed it, then the signed claims (see signToken): who it is for, when
+// it was issued and when it expires.
+//
+// Session keys are rotated every session-key-rotation. Older keys are kept, so cookies they
+// signed stay valid, until every cookie they could have signed has expired. A cookie signed
+// with an older key, or issued more than a day ago, is replaced with a fresh one when it is
+// used, so visitors who keep coming back never get logged out.
+
+const (
+	signingPurposeSession = "session"
+	sessionKindUser       = "user"
+	sessionKindAccess     = "access"
+	sessionRefreshAfter   = 24 * time.Hour // Reissue cookies older than this.
+	sessionRotationCheck  = time.Hour
+)
+
+// sessionClaims is the content of a session token.
+type sessionClaims struct {
+	Subject   string `json:"sub"` // The user ID, or a fingerprint of the public access key
+	Kind      string `json:"typ"`
+	IssuedAt  int64  `json:"iat"` // Unix time
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// sessionKeyring holds the keys that session tokens are signed and checked with.
+type sessionKeyring struct {
+	mu      sync.RWMutex
+	current signingKey
+	keys    map[string][]byte // By kid
+}
+
+// loadSessionKeys generates a new session key if the current one is due for rotation, deletes
+// keys that can no longer have signed a valid cookie and loads the rest.
+func (app *App) loadSessionKeys() error {
+	rows, err := app.db.Query("SELECT kid, secret, created_at FROM signing_keys WHERE purpose = ? ORDER BY created_at, rowid", signingPurposeSession)
+	if err != nil {
+		return err
+	}
+	var keys []signingKey
+	for rows.Next() {
+		var key signingKey
+		if err := rows.Scan(&key.kid, &key.secret, &key.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rotation := app.settings.SessionKeyRotation
+	if len(keys) == 0 || (rotation > 0 && time.Since(keys[len(keys)-1].createdAt) >= rotation) {
+		key, err := generateSigningKey(app.db, signingPurposeSession)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	// A key stops signing when the next one is created, and its cookies expire at most one
+	// cookie lifetime after that.
+	lifetime := app.settings.UserCookieLifetime
+	if app.settings.AccessCookieLifetime > lifetime {
+		lifetime = app.settings.AccessCookieLifetime
+	}
+	kept := make(map[string][]byte)
+	for i, key := range keys {
+		if i < len(keys)-1 && time.Since(keys[i+1].createdAt) > lifetime {
+			if _, err := app.db.Exec("DELETE FROM signing_keys WHERE kid = ?", key.kid); err != nil {
+				return err
+			}
+			log.Printf("Deleted expired session signing key %s.", key.kid)
+			continue
+		}
+		kept[key.kid] = key.secret
+	}
+
+	app.sessionKeys.mu.Lock()
+	defer app.sessionKeys.mu.Unlock()
+	app.sessionKeys.current = keys[len(keys)-1]
+	app.sessionKeys.keys = kept
+	return nil
+}
+
+// rotateSessionKeys checks for a due session key rotation every hour.
+func (app *App) rotateSessionKeys() {
+	ticker := time.NewTicker(sessionRotationCheck)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := app.loadSessionKeys(); err != nil {
+			log.Printf("ERROR: could not rotate session signing keys: %v", err)
+		}
+	}
+}
+
+// issueSession returns a session token for subject, valid for lifetime.
+func (app *App) issueSession(kind, subject string, lifetime time.Duration) (string, error) {
+	app.sessionKeys.mu.RLock()
+	key := app.sessionKeys.current
+	app.sessionKeys.mu.RUnlock()
+
+	now := time.Now()
+	token, err := signToken(key.secret, sessionClaims{Subject: subject, Kind: kind, IssuedAt: now.Unix(), ExpiresAt: now.Add(lifetime).Unix()})
+	if err != nil {
+		return "", err
+	}
+	return key.kid + "." + token, nil
+}
+
+// readSession checks the session token in a cookie. It returns http.ErrNoCookie if there is no
+// such cookie and errInvalidToken if the token is forged, expired, signed with a deleted key or
+// of another kind. stale reports that the cookie should be replaced with a fresh one.
+func (app *App) readSession(r *http.Request, cookieName, kind string) (claims *sessionClaims, stale bool, err error) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil, false, err
+	}
+	kid, token, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return nil, false, errInvalidToken
+	}
+
+	app.sessionKeys.mu.RLock()
+	secret, known := app.sessionKeys.keys[kid]
+	current := app.sessionKeys.current.kid
+	app.sessionKeys.mu.RUnlock()
+	if !known {
+		return nil, false, errInvalidToken
+	}
+
+	claims = &sessionClaims{}
+	if err := verifyToken(secret, token, claims); err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	if claims.Kind != kind || claims.ExpiresAt <= now.Unix() {
+		return nil, false, errInvalidToken
+	}
+	stale = kid != current || now.Sub(time.Unix(claims.IssuedAt, 0)) > sessionRefreshAfter
+	return claims, stale, nil
+}
+
+// accessKeyFingerprint identifies the public access key in access cookies without storing it,
+// so that changing the key locks out everyone who got in with the old one.
+func accessKeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// isSecureRequest reports whether the request came over HTTPS, directly or, with trust-proxy,
+// through a reverse proxy. Without trust-proxy the X-Forwarded-Proto header is ignored, since
+// any client could send it.
+func (app *App) isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || (app.settings.TrustProxy && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"))
+}
+
+// setSessionCookie sets a cookie holding a new session token.
+func (app *App) setSessionCookie(w http.ResponseWriter, r *http.Request, name, kind, subject string, lifetime time.Duration) error {
+	token, err := app.issueSession(kind, subject, lifetime)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(lifetime),
+		HttpOnly: true,
+		Secure:   app.isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// setUserCookie signs the request's client in as userID.
+func (app *App) setUserCookie(w http.ResponseWriter, r *http.Request, userID string) error {
+	return app.setSessionCookie(w, r, userCookieName, sessionKindUser, userID, app.settings.UserCookieLifetime)
+}
+
+// setAccessCookie lets the request's client past the public access gate.
+func (app *App) setAccessCookie(w http.ResponseWriter, r *http.Request) error {
+	return app.setSessionCookie(w, r, publicAccessCookieName, sessionKindAccess, accessKeyFingerprint(app.settings.PublicAccessKey), app.settings.AccessCookieLifetime)
+}
+
+// hasAccessCookie reports whether the request has a valid access cookie for the current public
+// access key, and renews the cookie if it is stale.
+func (app *App) hasAccessCookie(w http.ResponseWriter, r *http.Request) bool {
+	claims, stale, err := app.readSession(r, publicAccessCookieName, sessionKindAccess)
+	if err != nil || claims.Subject != accessKeyFingerprint(app.settings.PublicAccessKey) {
+		return false
+	}
+	if stale {
+		if err := app.setAccessCookie(w, r); err != nil {
+			log.Printf("ERROR: could not renew access cookie: %v", err)
+		}
+	}
+	return true
+}
+
+// clearCookie tells the client to delete a cookie.
+func (app *App) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, HttpOnly: true, Secure: app.isSecureRequest(r)})
+}
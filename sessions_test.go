@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSessionTestApp returns a test app with three session keys: a retired one that has been
+// deleted, an older one that still checks cookies and the current one.
+func newSessionTestApp(t *testing.T) (app *App, retired, older signingKey) {
+	t.Helper()
+	app = newTestApp(t, nil)
+	app.settings.UserCookieLifetime = 30 * 24 * time.Hour
+	app.settings.AccessCookieLifetime = 30 * 24 * time.Hour
+	for _, k := range []struct {
+		key *signingKey
+		age string
+	}{{&retired, "-40 days"}, {&older, "-35 days"}} {
+		var err error
+		if *k.key, err = generateSigningKey(app.db, signingPurposeSession); err != nil {
+			t.Fatalf("generateSigningKey: %v", err)
+		}
+		if _, err := app.db.Exec("UPDATE signing_keys SET created_at = datetime('now', ?) WHERE kid = ?", k.age, k.key.kid); err != nil {
+			t.Fatalf("age signing key: %v", err)
+		}
+	}
+	if err := app.loadSessionKeys(); err != nil {
+		t.Fatalf("loadSessionKeys: %v", err)
+	}
+	if _, ok := app.sessionKeys.keys[retired.kid]; ok || len(app.sessionKeys.keys) != 2 || app.sessionKeys.current.kid == older.kid {
+		t.Fatalf("got keys %v, want the older and a new current key", app.sessionKeys.keys)
+	}
+	return app, retired, older
+}
+
+// sessionToken signs claims the way issueSession does, with any key.
+func sessionToken(t *testing.T, key signingKey, claims sessionClaims) string {
+	t.Helper()
+	token, err := signToken(key.secret, claims)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	return key.kid + "." + token
+}
+
+// TestReadSession checks which session cookies are accepted, and which are stale and should
+// be replaced.
+func TestReadSession(t *testing.T) {
+	app, retired, older := newSessionTestApp(t)
+	current := app.sessionKeys.current
+	now := time.Now()
+	claims := func(kind string, issued time.Duration) sessionClaims {
+		return sessionClaims{Subject: "visitor", Kind: kind, IssuedAt: now.Add(-issued).Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+	}
+	valid := sessionToken(t, current, claims(sessionKindUser, 0))
+	payload, signature, _ := strings.Cut(strings.TrimPrefix(valid, current.kid+"."), ".")
+
+	tests := []struct {
+		name      string
+		cookie    string // Empty for no cookie
+		wantErr   error
+		wantStale bool
+	}{
+		{name: "fresh", cookie: valid},
+		{name: "issued over a day ago", cookie: sessionToken(t, current, claims(sessionKindUser, 25*time.Hour)), wantStale: true},
+		{name: "signed with an older key", cookie: sessionToken(t, older, claims(sessionKindUser, 0)), wantStale: true},
+		{name: "signed with a retired key", cookie: sessionToken(t, retired, claims(sessionKindUser, 0)), wantErr: errInvalidToken},
+		{name: "unknown kid", cookie: "0123456789abcdef." + payload + "." + signature, wantErr: errInvalidToken},
+		{
+			name: "tampered payload",
+			cookie: func() string {
+				forged := sessionToken(t, current, sessionClaims{Subject: "someone-else", Kind: sessionKindUser, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+				forgedPayload, _, _ := strings.Cut(strings.TrimPrefix(forged, current.kid+"."), ".")
+				return current.kid + "." + forgedPayload + "." + signature
+			}(),
+			wantErr: errInvalidToken,
+		},
+		{
+			name: "tampered signature",
+			cookie: func() string {
+				first := "A"
+				if signature[0] == 'A' {
+					first = "B"
+				}
+				return current.kid + "." + payload + "." + first + signature[1:]
+			}(),
+			wantErr: errInvalidToken,
+		},
+		{
+			name: "expired",
+			cookie: sessionToken(t, current, sessionClaims{Subject: "visitor", Kind: sessionKindUser,
+				IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()}),
+			wantErr: errInvalidToken,
+		},
+		{name: "access cookie as user cookie", cookie: sessionToken(t, current, claims(sessionKindAccess, 0)), wantErr: errInvalidToken},
+		{name: "no kid", cookie: payload + "." + signature, wantErr: errInvalidToken},
+		{name: "no cookie", wantErr: http.ErrNoCookie},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: userCookieName, Value: tt.cookie})
+			}
+			got, stale, err := app.readSession(req, userCookieName, sessionKindUser)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Subject != "visitor" || stale != tt.wantStale) {
+				t.Errorf("got subject %q and stale %v, want %q and %v", got.Subject, stale, "visitor", tt.wantStale)
+			}
+		})
+	}
+}
+
+// TestSessionMiddleware checks that the middleware renews stale cookies, refuses sessions
+// issued before an admin reset them and treats forged cookies as a new visitor.
+func TestSessionMiddleware(t *testing.T) {
+	app, _, older := newSessionTestApp(t)
+	current := app.sessionKeys.current
+	now := time.Now()
+	if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin, sessions_reset_at) VALUES ('visitor', 5, 0, ?)", now.Add(-time.Hour).Unix()); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	issued := func(key signingKey, ago time.Duration) string {
+		return sessionToken(t, key, sessionClaims{Subject: "visitor", Kind: sessionKindUser, IssuedAt: now.Add(-ago).Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	}
+
+	tests := []struct {
+		name       string
+		cookie     string
+		wantCode   int
+		wantUser   string // ID the handler sees
+		wantCookie string // "renewed", "cleared" or empty for untouched
+	}{
+		{name: "fresh", cookie: issued(current, 0), wantCode: http.StatusOK, wantUser: "visitor"},
+		{name: "stale is renewed", cookie: issued(older, 0), wantCode: http.StatusOK, wantUser: "visitor", wantCookie: "renewed"},
+		{name: "issued before the reset", cookie: issued(current, 2*time.Hour), wantCode: http.StatusUnauthorized, wantCookie: "cleared"},
+		{name: "stale and issued before the reset", cookie: issued(older, 2*time.Hour), wantCode: http.StatusUnauthorized, wantCookie: "cleared"},
+		{name: "forged", cookie: current.kid + ".bm90.c2lnbmVk", wantCode: http.StatusOK, wantUser: "", wantCookie: "cleared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen *User
+			handler := app.userAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(userContextKey).(*User)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/user/status", nil)
+			req.AddCookie(&http.Cookie{Name: userCookieName, Value: tt.cookie})
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode == http.StatusOK && (seen == nil || seen.ID != tt.wantUser) {
+				t.Errorf("handler saw user %v, want ID %q", seen, tt.wantUser)
+			}
+			var gotCookie string
+			for _, c := range rec.Result().Cookies() {
+				switch {
+				case c.Name != userCookieName:
+				case c.MaxAge < 0:
+					gotCookie = "cleared"
+				case strings.HasPrefix(c.Value, current.kid+"."):
+					gotCookie = "renewed"
+				default:
+					gotCookie = "set with " + c.Value
+				}
+			}
+			if gotCookie != tt.wantCookie {
+				t.Errorf("cookie %q, want %q", gotCookie, tt.wantCookie)
+			}
+		})
+	}
+}
+
+// TestIsSecureRequest checks that X-Forwarded-Proto only counts with trust-proxy.
+func TestIsSecureRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        bool
+		forwarded  string
+		trustProxy bool
+		want       bool
+	}{
+		{name: "plain HTTP"},
+		{name: "direct HTTPS", tls: true, want: true},
+		{name: "forwarded HTTPS without trust-proxy", forwarded: "https"},
+		{name: "forwarded HTTPS with trust-proxy", forwarded: "HTTPS", trustProxy: true, want: true},
+		{name: "forwarded HTTP with trust-proxy", forwarded: "http", trustProxy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{settings: &Settings{TrustProxy: tt.trustProxy}}
+			req := httptest.NewRequest(http.MethodGet, "http://dashboard/", nil)
+			if tt.tls {
+				req = httptest.NewRequest(http.MethodGet, "https://dashboard/", nil)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.forwarded)
+			}
+			if got := app.isSecureRequest(req); got != tt.want {
+				t.Errorf("isSecureRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
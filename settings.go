@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Settings ---
+// Server settings (as opposed to the trigger config, which is hot-reloaded) come from, in
+// increasing order of precedence: built-in defaults, an optional JSON settings file, environment
+// variables and command-line flags.
+
+// Settings holds the process-wide settings resolved at startup.
+type Settings struct {
+	ListenAddr             string
+	ConfigPath             string
+	DBPath                 string
+	StaticDir              string
+	DefaultTokens          int
+	UserCookieLifetime     time.Duration
+	AccessCookieLifetime   time.Duration
+	SessionKeyRotation     time.Duration
+	TrustProxy             bool
+	HTTPClientTimeout      time.Duration
+	AdminSecretKey         string
+	PublicAccessKey        string
+	ContactEmail           string
+	DevEmulators           bool
+	DevEmulatorArduinoAddr string
+	RechargeCooldown       time.Duration
+	RechargeMaxPerDay      int
+	RechargeMaxPerSession  int
+	RechargeCode           string
+	DripInterval           time.Duration
+	DripCap                int
+	InactiveUserRetention  time.Duration
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		ListenAddr:             ":8080",
+		ConfigPath:             "./config/config.json",
+		DBPath:                 "./data/dashboard.db",
+		StaticDir:              "./static",
+		DefaultTokens:          10,
+		UserCookieLifetime:     365 * 24 * time.Hour,
+		AccessCookieLifetime:   365 * 24 * time.Hour,
+		SessionKeyRotation:     30 * 24 * time.Hour,
+		InactiveUserRetention:  7 * 24 * time.Hour,
+		HTTPClientTimeout:      10 * time.Second,
+		AdminSecretKey:         "SUPER_SECRET",
+		DevEmulatorArduinoAddr: defaultEmulatedArduinoAddr,
+	}
+}
+
+// settingDef describes one setting and where it can be set from. The settings file key is
+// the flag name with dashes replaced by underscores.
+type settingDef struct {
+	flag   string
+	env    string
+	usage  string
+	secret bool // Redacted when the settings are printed.
+	value  flag.Value
+}
+
+func (s *Settings) defs() []settingDef {
+	return []settingDef{
+		{"listen-addr", "LISTEN_ADDR", "address the HTTP server listens on", false, (*stringSetting)(&s.ListenAddr)},
+		{"config", "CONFIG_PATH", "path to the trigger config file", false, (*stringSetting)(&s.ConfigPath)},
+		{"db", "DB_PATH", "path to the SQLite database", false, (*stringSetting)(&s.DBPath)},
+		{"static-dir", "STATIC_DIR", "directory of static web assets", false, (*stringSetting)(&s.StaticDir)},
+		{"default-tokens", "DEFAULT_TOKENS", "tokens given to new users and on recharge", false, (*intSetting)(&s.DefaultTokens)},
+		{"user-cookie-lifetime", "USER_COOKIE_LIFETIME", "lifetime of the user session cookie", false, (*durationSetting)(&s.UserCookieLifetime)},
+		{"access-cookie-lifetime", "ACCESS_COOKIE_LIFETIME", "lifetime of the public access cookie", false, (*durationSetting)(&s.AccessCookieLifetime)},
+		{"session-key-rotation", "SESSION_KEY_ROTATION", "how often cookies are signed with a new key (0 never)", false, (*durationSetting)(&s.SessionKeyRotation)},
+		{"trust-proxy", "TRUST_PROXY", "trust X-Forwarded-Proto from a reverse proxy in front of the server", false, (*boolSetting)(&s.TrustProxy)},
+		{"http-client-timeout", "HTTP_CLIENT_TIMEOUT", "timeout for requests to devices", false, (*durationSetting)(&s.HTTPClientTimeout)},
+		{"admin-secret-key", "ADMIN_SECRET_KEY", "secret key for admin login", true, (*stringSetting)(&s.AdminSecretKey)},
+		{"public-access-key", "PUBLIC_ACCESS_KEY", "if set, required to view the dashboard", true, (*stringSetting)(&s.PublicAccessKey)},
+		{"contact-email", "CONTACT_EMAIL", "feedback address shown to visitors", false, (*stringSetting)(&s.ContactEmail)},
+		{"dev-emulators", "DEV_EMULATORS", "start fake devices for local development", false, (*boolSetting)(&s.DevEmulators)},
+		{"dev-emulator-arduino-addr", "DEV_EMULATOR_ARDUINO_ADDR", "listen address of the fake Arduino", false, (*stringSetting)(&s.DevEmulatorArduinoAddr)},
+		{"recharge-cooldown", "RECHARGE_COOLDOWN", "minimum time between a user's recharges (0 for none)", false, (*durationSetting)(&s.RechargeCooldown)},
+		{"recharge-max-per-day", "RECHARGE_MAX_PER_DAY", "recharges per user in 24 hours (0 for unlimited)", false, (*intSetting)(&s.RechargeMaxPerDay)},
+		{"recharge-max-per-session", "RECHARGE_MAX_PER_SESSION", "recharges per user session (0 for unlimited)", false, (*intSetting)(&s.RechargeMaxPerSession)},
+		{"recharge-code", "RECHARGE_CODE", "if set, required to recharge (included in the recharge QR code)", true, (*stringSetting)(&s.RechargeCode)},
+		{"drip-interval", "DRIP_INTERVAL", "add a token this often while below drip-cap (0 disables)", false, (*durationSetting)(&s.DripInterval)},
+		{"drip-cap", "DRIP_CAP", "balance the drip refills up to (0 for default-tokens)", false, (*intSetting)(&s.DripCap)},
+		{"inactive-user-retention", "INACTIVE_USER_RETENTION", "delete users who never used their tokens after this long (0 never)", false, (*durationSetting)(&s.InactiveUserRetention)},
+	}
+}
+
+// loadSettings resolves the settings from defaults, the settings file, the environment and args.
+func loadSettings(args []string) (*Settings, error) {
+	s := defaultSettings()
+	defs := s.defs()
+
+	// Flags are parsed first only to learn which ones were given; they are applied last so
+	// they override the settings file and environment.
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	settingsFile := fs.String("settings", os.Getenv("SETTINGS_FILE"), "optional JSON settings file (env SETTINGS_FILE)")
+	given := make(map[string]string)
+	for _, d := range defs {
+		fs.Var(&recordedFlag{name: d.flag, value: d.value, given: given}, d.flag, fmt.Sprintf("%s (env %s)", d.usage, d.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *settingsFile != "" {
+		if err := s.applyFile(*settingsFile, defs); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range defs {
+		if v, ok := os.LookupEnv(d.env); ok && v != "" {
+			if err := d.value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", d.env, err)
+			}
+		}
+	}
+	for _, d := range defs {
+		if v, ok := given[d.flag]; ok {
+			if err := d.value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %w", d.flag, err)
+			}
+		}
+	}
+
+	if s.DefaultTokens < 0 {
+		return nil, fmt.Errorf("default tokens must not be negative, got %d", s.DefaultTokens)
+	}
+	if s.RechargeCooldown < 0 || s.DripInterval < 0 {
+		return nil, fmt.Errorf("recharge cooldown and drip interval must not be negative")
+	}
+	if s.SessionKeyRotation < 0 || s.InactiveUserRetention < 0 {
+		return nil, fmt.Errorf("session key rotation and inactive user retention must not be negative")
+	}
+	if s.RechargeMaxPerDay < 0 || s.RechargeMaxPerSession < 0 || s.DripCap < 0 {
+		return nil, fmt.Errorf("recharge limits and drip cap must not be negative")
+	}
+	return s, nil
+}
+
+func (s *Settings) applyFile(path string, defs []settingDef) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read settings file: %w", err)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("could not parse settings file %s: %w", path, err)
+	}
+
+	byKey := make(map[string]settingDef)
+	for _, d := range defs {
+		byKey[strings.ReplaceAll(d.flag, "-", "_")] = d
+	}
+	for key, raw := range values {
+		d, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("settings file %s: unknown setting %q", path, key)
+		}
+		if err := d.value.Set(fmt.Sprint(raw)); err != nil {
+			return fmt.Errorf("settings file %s: invalid %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// logSettings prints the effective settings with secrets redacted.
+func (s *Settings) logSettings() {
+	log.Println("Effective settings:")
+	for _, d := range s.defs() {
+		value := d.value.String()
+		if d.secret && value != "" {
+			value = "[REDACTED]"
+		}
+		log.Printf("  %-26s = %s", strings.ReplaceAll(d.flag, "-", "_"), value)
+	}
+	if s.AdminSecretKey == defaultSettings().AdminSecretKey {
+		log.Println("WARNING: admin_secret_key is still the built-in default. Set ADMIN_SECRET_KEY before going live.")
+	}
+}
+
+// recordedFlag remembers a flag's raw value so it can be applied after the other sources.
+type recordedFlag struct {
+	name  string
+	value flag.Value
+	given map[string]string
+}
+
+func (f *recordedFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return f.value.String()
+}
+
+func (f *recordedFlag) Set(v string) error {
+	f.given[f.name] = v
+	return nil
+}
+
+func (f *recordedFlag) IsBoolFlag() bool {
+	_, ok := f.value.(*boolSetting)
+	return ok
+}
+
+type stringSetting string
+
+func (v *stringSetting) String() string     { return string(*v) }
+func (v *stringSetting) Set(s string) error { *v = stringSetting(s); return nil }
+
+type intSetting int
+
+func (v *intSetting) String() string { return strconv.Itoa(int(*v)) }
+func (v *intSetting) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", s)
+	}
+	*v = intSetting(n)
+	return nil
+}
+
+type boolSetting bool
+
+func (v *boolSetting) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *boolSetting) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", s)
+	}
+	*v = boolSetting(b)
+	return nil
+}
+
+// durationSetting accepts Go durations ("90s", "12h") plus a "d" suffix for days ("365d").
+type durationSetting time.Duration
+
+func (v *durationSetting) String() string { return time.Duration(*v).String() }
+func (v *durationSetting) Set(s string) error {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", s)
+		}
+		*v = durationSetting(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", s)
+	}
+	*v = durationSetting(d)
+	return nil
+}
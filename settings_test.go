@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadSettingsPrecedence checks that flags override the environment, which overrides the
+// settings file, which overrides the defaults.
+func TestLoadSettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string // Settings file contents, none if empty
+		env        map[string]string
+		args       []string
+		wantTokens int
+		wantAddr   string
+		wantTTL    time.Duration
+		wantErr    string // Expected in the error, empty if loading should succeed
+	}{
+		{
+			name:       "defaults",
+			wantTokens: 10,
+			wantAddr:   ":8080",
+			wantTTL:    365 * 24 * time.Hour,
+		},
+		{
+			name:       "file overrides defaults",
+			file:       `{"default_tokens": 5, "user_cookie_lifetime": "30d"}`,
+			wantTokens: 5,
+			wantAddr:   ":8080",
+			wantTTL:    30 * 24 * time.Hour,
+		},
+		{
+			name:       "env overrides file",
+			file:       `{"default_tokens": 5, "listen_addr": ":9000"}`,
+			env:        map[string]string{"DEFAULT_TOKENS": "7"},
+			wantTokens: 7,
+			wantAddr:   ":9000",
+			wantTTL:    365 * 24 * time.Hour,
+		},
+		{
+			name:       "flag overrides env and file",
+			file:       `{"default_tokens": 5}`,
+			env:        map[string]string{"DEFAULT_TOKENS": "7", "USER_COOKIE_LIFETIME": "12h"},
+			args:       []string{"-default-tokens", "3"},
+			wantTokens: 3,
+			wantAddr:   ":8080",
+			wantTTL:    12 * time.Hour,
+		},
+		{
+			name:       "empty env is ignored",
+			env:        map[string]string{"DEFAULT_TOKENS": ""},
+			wantTokens: 10,
+			wantAddr:   ":8080",
+			wantTTL:    365 * 24 * time.Hour,
+		},
+		{
+			name:    "unknown file setting",
+			file:    `{"default_tokenz": 5}`,
+			wantErr: `unknown setting "default_tokenz"`,
+		},
+		{
+			name:    "invalid env value",
+			env:     map[string]string{"DEFAULT_TOKENS": "lots"},
+			wantErr: "invalid DEFAULT_TOKENS",
+		},
+		{
+			name:    "negative flag value",
+			args:    []string{"-default-tokens=-1"},
+			wantErr: "must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, d := range defaultSettings().defs() {
+				t.Setenv(d.env, "") // Don't let the machine's environment leak in.
+			}
+			t.Setenv("SETTINGS_FILE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "settings.json")
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-settings", path}, args...)
+			}
+
+			s, err := loadSettings(args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadSettings: %v", err)
+			}
+			if s.DefaultTokens != tt.wantTokens || s.ListenAddr != tt.wantAddr || s.UserCookieLifetime != tt.wantTTL {
+				t.Errorf("got tokens %d, addr %q, cookie lifetime %s; want %d, %q, %s",
+					s.DefaultTokens, s.ListenAddr, s.UserCookieLifetime, tt.wantTokens, tt.wantAddr, tt.wantTTL)
+			}
+		})
+	}
+}
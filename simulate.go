@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Simulation (Dry-Run) Mode ---
+// With "simulate": true globally or on a trigger, delegateTrigger goes through the usual
+// token spending and stats bookkeeping but records the device commands it would have sent
+// instead of sending them. Effects still run in real time so the transcript shows timing.
+
+const maxSimulatedCommands = 1000
+
+// simulatedCommand is one would-be device command in the transcript.
+type simulatedCommand struct {
+	Timestamp time.Time `json:"timestamp"`
+	OffsetMS  int64     `json:"offset_ms"` // Milliseconds since the action started.
+	ActionID  int64     `json:"action_id"`
+	TriggerID string    `json:"trigger_id"`
+	Kind      string    `json:"kind"` // "http", "govee_udp" or "command"
+	Target    string    `json:"target"`
+	Payload   string    `json:"payload,omitempty"`
+}
+
+// simulationRecorder keeps the most recent simulated commands across all actions.
+type simulationRecorder struct {
+	mu      sync.Mutex
+	entries []simulatedCommand
+}
+
+func (r *simulationRecorder) add(c simulatedCommand) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, c)
+	if len(r.entries) > maxSimulatedCommands {
+		r.entries = r.entries[len(r.entries)-maxSimulatedCommands:]
+	}
+}
+
+func (r *simulationRecorder) snapshot() []simulatedCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]simulatedCommand(nil), r.entries...)
+}
+
+func (r *simulationRecorder) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+}
+
+// simulation records the commands of a single simulated action.
+type simulation struct {
+	recorder  *simulationRecorder
+	actionID  int64
+	triggerID string
+	start     time.Time
+}
+
+func (s *simulation) record(kind, target, payload string) {
+	now := time.Now()
+	log.Printf("SIMULATE: action ID %d would send %s to %s: %s", s.actionID, kind, target, payload)
+	s.recorder.add(simulatedCommand{
+		Timestamp: now,
+		OffsetMS:  now.Sub(s.start).Milliseconds(),
+		ActionID:  s.actionID,
+		TriggerID: s.triggerID,
+		Kind:      kind,
+		Target:    target,
+		Payload:   payload,
+	})
+}
+
+// simulationFor returns a simulation for the action if the trigger or the whole config is in
+// simulate mode, or nil if the action should talk to real devices.
+func (app *App) simulationFor(trigger *Trigger, actionID int64) *simulation {
+	app.configMutex.RLock()
+	global := app.config.Simulate
+	app.configMutex.RUnlock()
+
+	if !global && !trigger.Simulate {
+		return nil
+	}
+	return &simulation{recorder: app.simulations, actionID: actionID, triggerID: trigger.ID, start: time.Now()}
+}
+
+// simulatedLightState is what a simulated light reports when asked for its status.
+func simulatedLightState() *lightState {
+	return &lightState{On: true, Brightness: 100, Color: &GoveeColorCommandData{R: 255, G: 255, B: 255}}
+}
+
+// redactQuery hides the value of a sensitive query parameter in a URL before it is recorded.
+func redactQuery(url, param string) string {
+	prefix := param + "="
+	i := strings.Index(url, prefix)
+	if i < 0 {
+		return url
+	}
+	end := strings.IndexByte(url[i:], '&')
+	if end < 0 {
+		return url[:i] + prefix + "REDACTED"
+	}
+	return url[:i] + prefix + "REDACTED" + url[i+end:]
+}
+
+func (app *App) simulationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireRole(w, r, writeRole(r, roleOperator)); !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			app.configMutex.RLock()
+			global := app.config.Simulate
+			app.configMutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"simulate_all": global,
+				"commands":     app.simulations.snapshot(),
+			})
+		case http.MethodDelete:
+			app.simulations.clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
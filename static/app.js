@@ -6,6 +6,9 @@ const triggersContainer = document.getElementById('triggers-container');
 const tokenCountSpan = document.getElementById('token-count');
 const adminIndicator = document.getElementById('admin-indicator');
 const statsLink = document.getElementById('stats-link');
+const manageTriggersLink = document.getElementById('manage-triggers-link');
+const vouchersLink = document.getElementById('vouchers-link');
+let publicAccessKeyForInvites = ''; // Set by generateQrCodes
 const loginLink = document.getElementById('login-link');
 const logoutLink = document.getElementById('logout-link');
 const halloweenFactWrapper = document.getElementById('halloween-fact-wrapper');
@@ -27,17 +30,26 @@ async function updateUserStatus() {
 
         if (user.is_admin) {
             tokenCountSpan.textContent = 'Unlimited';
-            adminIndicator.textContent = 'Admin';
+            adminIndicator.textContent = user.username ? `Admin: ${user.username}` : 'Admin';
             adminIndicator.style.display = 'inline-block';
             statsLink.style.display = 'inline';
+            // Viewers can only look, so the pages for making changes are left out.
+            const canOperate = user.role !== 'viewer';
+            if (manageTriggersLink) manageTriggersLink.style.display = canOperate ? 'inline' : 'none';
+            if (vouchersLink) vouchersLink.style.display = canOperate ? 'inline' : 'none';
             loginLink.style.display = 'none';
             logoutLink.style.display = 'inline';
             generateQrCodes(); // Generate QR codes for admin
+            // Only owners can invite admins.
+            const inviteBox = document.getElementById('admin-invite-box');
+            if (inviteBox) inviteBox.style.display = user.role === 'owner' ? 'block' : 'none';
             loadAndDisplayHalloweenFact(true); // Load fact for admin
         } else {
             tokenCountSpan.textContent = user.tokens_remaining;
             adminIndicator.style.display = 'none';
             statsLink.style.display = 'none';
+            if (manageTriggersLink) manageTriggersLink.style.display = 'none';
+            if (vouchersLink) vouchersLink.style.display = 'none';
             loginLink.style.display = 'inline';
             logoutLink.style.display = 'none';
             if (adminQrSection) adminQrSection.style.display = 'none'; // Hide QR codes for non-admins
@@ -59,10 +71,11 @@ async function activateTrigger(triggerId, button) {
 
     // Optimistic UI update for token count
     let tokenUpdated = false;
+    const cost = parseInt(button.dataset.cost, 10);
     const currentTokens = parseInt(tokenCountSpan.textContent, 10);
-    if (!isNaN(currentTokens) && currentTokens > 0) {
+    if (!isNaN(currentTokens) && cost > 0 && currentTokens >= cost) {
         // Only update if it's a number (i.e., not an admin)
-        tokenCountSpan.textContent = currentTokens - 1;
+        tokenCountSpan.textContent = currentTokens - cost;
         tokenUpdated = true;
     }
 
@@ -74,10 +87,24 @@ async function activateTrigger(triggerId, button) {
         if (!response.ok) {
             // If the server responds with 403, it means the user is out of tokens.
             // The response body is the "out of tokens" page. Redirect the browser to it.
+            // A visitor who still has some tokens just can't afford this trigger.
             if (response.status === 403) {
+                if (!isNaN(currentTokens) && currentTokens > 0) {
+                    button.textContent = 'NOT ENOUGH TOKENS';
+                    updateUserStatus();
+                    return;
+                }
                 window.location.href = "/out-of-tokens.html";
                 return;
             }
+            // 503 means the trigger, its zone or the dashboard was taken offline (or its show hours
+            // ended) after the page loaded.
+            // No token was spent.
+            if (response.status === 503) {
+                button.textContent = 'UNAVAILABLE';
+                loadTriggers();
+                return;
+            }
             const errorText = await response.text();
             throw new Error(`Server error: ${response.status} - ${errorText}`);
         }
@@ -112,50 +139,134 @@ async function loadTriggers() {
         if (!response.ok) {
             throw new Error(`HTTP error! status: ${response.status}`);
         }
-        const triggers = await response.json();
+        const { zones, maintenance, admin } = await response.json();
 
         triggersContainer.innerHTML = ''; // Clear existing content
 
-        const publicTriggers = triggers.filter(t => !t.is_admin_only);
-        const adminTriggers = triggers.filter(t => t.is_admin_only);
+        if (maintenance.disabled) {
+            const notice = document.createElement('p');
+            notice.className = 'maintenance-notice';
+            notice.textContent = maintenance.reason
+                ? `The dashboard is down for maintenance: ${maintenance.reason}`
+                : 'The dashboard is down for maintenance. Please check back soon.';
+            triggersContainer.appendChild(notice);
+        }
 
-        const renderTrigger = (trigger) => {
+        const renderTrigger = (trigger, zone) => {
             const card = document.createElement('div');
             card.className = 'trigger-card';
             if (trigger.is_admin_only) {
                 card.classList.add('admin-trigger');
             }
+            if (trigger.color) {
+                card.style.borderColor = trigger.color;
+            }
 
             const name = document.createElement('h2');
-            name.textContent = trigger.name;
+            name.textContent = trigger.icon ? `${trigger.icon} ${trigger.name}` : trigger.name;
+            card.appendChild(name);
+            if (trigger.category) {
+                const category = document.createElement('span');
+                category.className = 'trigger-category';
+                category.textContent = trigger.category;
+                card.appendChild(category);
+            }
             const description = document.createElement('p');
             description.textContent = trigger.description;
+            const cost = document.createElement('span');
+            cost.className = 'trigger-cost';
+            cost.textContent = trigger.cost === 0 ? 'Free' : trigger.cost === 1 ? '1 token' : `${trigger.cost} tokens`;
             const button = document.createElement('button');
             button.className = 'trigger-button';
             button.textContent = `Activate`;
             button.dataset.triggerId = trigger.id;
+            button.dataset.cost = trigger.cost;
+            if ((maintenance.disabled || zone.disabled) && !admin) {
+                button.disabled = true;
+                button.textContent = 'Closed';
+            } else if (trigger.disabled) {
+                button.disabled = true;
+                button.textContent = 'Out of Order';
+            } else if (trigger.outside_hours) {
+                button.disabled = true;
+                button.textContent = 'Unavailable';
+                if (trigger.next_available_at) {
+                    button.dataset.availableAt = trigger.next_available_at;
+                }
+            }
 
-            card.appendChild(name);
             card.appendChild(description);
+            card.appendChild(cost);
+            if (trigger.disabled && trigger.reason) {
+                const reason = document.createElement('p');
+                reason.className = 'trigger-offline';
+                reason.textContent = trigger.reason;
+                card.appendChild(reason);
+            }
             card.appendChild(button);
             triggersContainer.appendChild(card);
         };
 
-        publicTriggers.forEach(renderTrigger);
+        const renderZoneHeading = (zone) => {
+            if (!zone.name) return;
+            const heading = document.createElement('h2');
+            heading.className = 'zone-heading';
+            heading.textContent = zone.name;
+            triggersContainer.appendChild(heading);
+            if (zone.disabled) {
+                const notice = document.createElement('p');
+                notice.className = 'zone-closed';
+                notice.textContent = zone.reason ? `Temporarily closed: ${zone.reason}` : 'Temporarily closed.';
+                triggersContainer.appendChild(notice);
+            }
+        };
+
+        zones.forEach(zone => {
+            const publicTriggers = zone.triggers.filter(t => !t.is_admin_only);
+            if (publicTriggers.length === 0) return;
+            renderZoneHeading(zone);
+            publicTriggers.forEach(t => renderTrigger(t, zone));
+        });
 
-        if (adminTriggers.length > 0) {
+        const adminZones = zones.filter(zone => zone.triggers.some(t => t.is_admin_only));
+        if (adminZones.length > 0) {
             const separator = document.createElement('hr');
             separator.className = 'admin-separator';
             triggersContainer.appendChild(separator);
-            adminTriggers.forEach(renderTrigger);
+            adminZones.forEach(zone => {
+                zone.triggers.filter(t => t.is_admin_only).forEach(t => renderTrigger(t, zone));
+            });
         }
 
+        updateCountdowns();
+
     } catch (error) {
         console.error("Failed to load triggers:", error);
         triggersContainer.innerHTML = '<p>Could not load triggers. Please try again later.</p>';
     }
 }
 
+// Shows how long until triggers outside their show hours open, and reloads when one does.
+function updateCountdowns() {
+    let opened = false;
+    triggersContainer.querySelectorAll('button[data-available-at]').forEach(button => {
+        const seconds = Math.ceil((Date.parse(button.dataset.availableAt) - Date.now()) / 1000);
+        if (seconds <= 0) {
+            delete button.dataset.availableAt; // Count it once while the triggers reload
+            opened = true;
+            return;
+        }
+        const days = Math.floor(seconds / 86400);
+        const hours = Math.floor(seconds % 86400 / 3600);
+        const minutes = Math.floor(seconds % 3600 / 60);
+        const pad = n => String(n).padStart(2, '0');
+        button.textContent = days > 0
+            ? `Opens in ${days}d ${hours}h`
+            : `Opens in ${hours}:${pad(minutes)}:${pad(seconds % 60)}`;
+    });
+    if (opened) loadTriggers();
+}
+
 // Function to load and display the Halloween fact
 async function loadAndDisplayHalloweenFact(isAdmin) {
     if (!halloweenFactWrapper) {
@@ -238,22 +349,19 @@ async function generateQrCodes() {
 
     try {
         // Fetch all necessary secrets and data in parallel for efficiency
-        const [accessKeyRes, secretKeyRes, factRes] = await Promise.all([
+        const [accessKeyRes, factRes] = await Promise.all([
             fetch('/api/admin/public-access-key'),
-            fetch('/api/admin/secret'),
             fetch('/api/halloween-fact')
         ]);
 
-        if (!accessKeyRes.ok || !secretKeyRes.ok || !factRes.ok) {
+        if (!accessKeyRes.ok || !factRes.ok) {
             throw new Error("Failed to fetch all data for QR codes");
         }
 
         const accessKeyData = await accessKeyRes.json();
-        const secretKeyData = await secretKeyRes.json();
         const factData = await factRes.json();
 
         const publicAccessKey = accessKeyData.public_access_key;
-        const adminSecretKey = secretKeyData.admin_secret_key;
         const livestreamUrl = factData.livestream_url;
         const baseUrl = window.location.origin;
 
@@ -267,21 +375,15 @@ async function generateQrCodes() {
         document.getElementById('qr-dashboard').dataset.value = finalUrl;
 
         // 2. Recharge URL
-        const rechargeUrl = `${baseUrl}/api/recharge`;
-        new QRious({ element: document.getElementById('qr-recharge'), value: rechargeUrl, size: 200 });
-        document.getElementById('qr-recharge').dataset.value = rechargeUrl;
-
-        // 3. Admin Access URL (with BOTH keys)
-        if (adminSecretKey) {
-            const adminUrl = new URL(baseUrl);
-            adminUrl.searchParams.set('admin_key', adminSecretKey);
-            if (publicAccessKey) {
-                adminUrl.searchParams.set('access_key', publicAccessKey);
-            }
-            const finalAdminUrl = adminUrl.toString();
-            new QRious({ element: document.getElementById('qr-admin'), value: finalAdminUrl, size: 200 });
-            document.getElementById('qr-admin').dataset.value = finalAdminUrl;
+        const rechargeUrl = new URL('/api/recharge', baseUrl);
+        if (accessKeyData.recharge_code) {
+            rechargeUrl.searchParams.set('code', accessKeyData.recharge_code);
         }
+        new QRious({ element: document.getElementById('qr-recharge'), value: rechargeUrl.toString(), size: 200 });
+        document.getElementById('qr-recharge').dataset.value = rechargeUrl.toString();
+
+        // 3. Admin invites are created on demand; see createAdminInvite.
+        publicAccessKeyForInvites = publicAccessKey;
 
         // 4. Livestream URL (if it exists)
         if (livestreamUrl) {
@@ -293,6 +395,37 @@ async function generateQrCodes() {
     }
 }
 
+// createAdminInvite asks for a single-use admin invite and shows it as a QR code. The link
+// includes the public access key so it works on a device that hasn't opened the dashboard.
+async function createAdminInvite() {
+    const statusEl = document.getElementById('admin-invite-status');
+    try {
+        const response = await fetch('/api/admin/invites', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ role: document.getElementById('admin-invite-role').value })
+        });
+        if (!response.ok) {
+            statusEl.textContent = await response.text();
+            return;
+        }
+        const invite = await response.json();
+        const inviteUrl = new URL(invite.path, window.location.origin);
+        if (publicAccessKeyForInvites) {
+            inviteUrl.searchParams.set('access_key', publicAccessKeyForInvites);
+        }
+        new QRious({ element: document.getElementById('qr-admin'), value: inviteUrl.toString(), size: 200 });
+        document.getElementById('qr-admin').dataset.value = inviteUrl.toString();
+        statusEl.textContent = `Scan once to get ${invite.role} access. Expires at ${new Date(invite.expires_at).toLocaleTimeString()}.`;
+    } catch (error) {
+        console.error("Failed to create admin invite:", error);
+        statusEl.textContent = 'Could not create an invite.';
+    }
+}
+
+const adminInviteButton = document.getElementById('admin-invite-button');
+if (adminInviteButton) adminInviteButton.addEventListener('click', createAdminInvite);
+
 // Use event delegation for button clicks
 triggersContainer.addEventListener('click', (event) => {
     const button = event.target.closest('.trigger-button');
@@ -381,6 +514,7 @@ function init() {
     checkBackendVersion(); // Check for updates first
     loadTriggers();
     updateUserStatus(); // This now controls whether the fact is loaded
+    setInterval(updateCountdowns, 1000);
 }
 
 init();
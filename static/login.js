@@ -2,22 +2,41 @@ console.log("Admin login script loaded.");
 
 const loginForm = document.getElementById('login-form');
 const errorMessageEl = document.getElementById('error-message');
+const accountFieldsEl = document.getElementById('account-fields');
+const keyFieldsEl = document.getElementById('key-fields');
+
+// Admins log in with their account once one exists, and with the shared secret key until then.
+let useAccounts = false;
+
+async function loadLoginMode() {
+    try {
+        const response = await fetch('/api/admin/login');
+        if (!response.ok) return;
+        useAccounts = (await response.json()).accounts;
+    } catch (error) {
+        console.error("Failed to load login mode:", error);
+    }
+    accountFieldsEl.style.display = useAccounts ? 'block' : 'none';
+    keyFieldsEl.style.display = useAccounts ? 'none' : 'block';
+}
 
 loginForm.addEventListener('submit', async (event) => {
     event.preventDefault();
     errorMessageEl.textContent = '';
 
-    const key = document.getElementById('admin-key').value;
+    const credentials = useAccounts
+        ? { username: document.getElementById('username').value, password: document.getElementById('password').value }
+        : { admin_key: document.getElementById('admin-key').value };
 
     try {
         const response = await fetch('/api/admin/login', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ admin_key: key }),
+            body: JSON.stringify(credentials),
         });
 
         if (!response.ok) {
-            throw new Error('Invalid secret key.');
+            throw new Error(useAccounts ? 'Invalid username or password.' : 'Invalid secret key.');
         }
 
         // On success, the backend sets a new cookie. Redirect to the main page.
@@ -26,4 +45,6 @@ loginForm.addEventListener('submit', async (event) => {
     } catch (error) {
         errorMessageEl.textContent = error.message;
     }
-});
\ No newline at end of file
+});
+
+loadLoginMode();
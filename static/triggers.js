@@ -0,0 +1,271 @@
+console.log("Trigger management script loaded.");
+
+const adminContainer = document.getElementById('triggers-admin');
+const triggersTableBodyEl = document.querySelector('#admin-triggers-table tbody');
+const auditTableBodyEl = document.querySelector('#audit-table tbody');
+const zonesTableBodyEl = document.querySelector('#zones-table tbody');
+const maintenanceStatusEl = document.getElementById('maintenance-status');
+const maintenanceButtonEl = document.getElementById('maintenance-toggle');
+const editorTitleEl = document.getElementById('editor-title');
+const triggerJsonEl = document.getElementById('trigger-json');
+const editorErrorEl = document.getElementById('editor-error');
+
+const newTriggerTemplate = {
+    id: "new_trigger",
+    name: "New Trigger",
+    description: "What this trigger does.",
+    type: "arduino",
+    arduino_ip: "192.168.1.100",
+    secret_key: ""
+};
+
+let triggers = [];
+let offline = {}; // Offline triggers by ID
+let maintenance = { disabled: false };
+let editingId = null; // null while creating a new trigger
+
+function escapeHtml(text) {
+    const div = document.createElement('div');
+    div.textContent = text ?? '';
+    return div.innerHTML;
+}
+
+async function loadTriggers() {
+    try {
+        const response = await fetch('/api/admin/triggers');
+        if (response.status === 403) {
+            adminContainer.innerHTML = `
+                <h2 class="error">Access Denied</h2>
+                <p class="error">You must be an admin to view this page. Please <a href="/login.html">log in</a>.</p>
+            `;
+            return;
+        }
+        if (!response.ok) {
+            throw new Error(`Server error: ${response.status}`);
+        }
+        triggers = await response.json();
+        const statesResponse = await fetch('/api/admin/trigger-states');
+        offline = statesResponse.ok ? await statesResponse.json() : {};
+        renderTriggers();
+        loadMaintenance();
+        loadZones();
+        loadAuditLog();
+    } catch (error) {
+        console.error("Failed to load triggers:", error);
+        triggersTableBodyEl.innerHTML = '<tr><td colspan="6" class="error">Could not load triggers.</td></tr>';
+    }
+}
+
+function renderTriggers() {
+    triggersTableBodyEl.innerHTML = '';
+    if (triggers.length === 0) {
+        triggersTableBodyEl.innerHTML = '<tr><td colspan="6">No triggers defined.</td></tr>';
+        return;
+    }
+
+    triggers.forEach((view, index) => {
+        const t = view.trigger;
+        const row = document.createElement('tr');
+        if (view.disabled) row.classList.add('disabled');
+
+        const origin = view.origin === 'override' ? 'Override (database)' : view.origin === 'database' ? 'Database' : view.source;
+        const updated = view.updated_by ? `<br><span class="origin">Changed ${new Date(view.updated_at).toLocaleString()}</span>` : '';
+        const state = offline[t.id];
+        const status = state ? `<br><span class="error">Offline${state.reason ? ': ' + escapeHtml(state.reason) : ''}</span>` : '';
+        row.innerHTML = `
+            <td>${view.disabled ? '-' : index + 1}${t.order ? `<br><span class="origin">order ${t.order}</span>` : ''}</td>
+            <td><strong>${escapeHtml(t.name)}</strong><br><span class="origin">${escapeHtml(t.id)}</span>${status}</td>
+            <td>${escapeHtml(t.zone || '-')}</td>
+            <td>${escapeHtml(t.type || 'arduino')}</td>
+            <td>${escapeHtml(origin)}${updated}</td>
+            <td class="actions"></td>`;
+
+        const actions = row.querySelector('.actions');
+        const addButton = (label, handler) => {
+            const button = document.createElement('button');
+            button.textContent = label;
+            button.addEventListener('click', handler);
+            actions.appendChild(button);
+        };
+        if (!view.disabled) {
+            addButton('↑', () => moveTrigger(index, -1));
+            addButton('↓', () => moveTrigger(index, 1));
+        }
+        addButton('Edit', () => editTrigger(view));
+        if (!view.disabled) {
+            addButton(state ? 'Bring online' : 'Take offline', () => setOffline(t, !state));
+        }
+        if (!state) {
+            addButton(view.disabled ? 'Show' : 'Hide', () => setDisabled(t.id, !view.disabled));
+        }
+        if (view.origin !== 'file') {
+            addButton(view.origin === 'override' ? 'Revert' : 'Delete', () => deleteTrigger(view));
+        }
+        triggersTableBodyEl.appendChild(row);
+    });
+}
+
+async function loadZones() {
+    try {
+        const response = await fetch('/api/admin/zones');
+        if (!response.ok) return;
+        const zones = await response.json();
+        zonesTableBodyEl.innerHTML = '';
+        if (zones.length === 0) {
+            zonesTableBodyEl.innerHTML = '<tr><td colspan="4">No zones. Set a <code>zone</code> on triggers to group them.</td></tr>';
+            return;
+        }
+        zones.forEach(zone => {
+            const row = document.createElement('tr');
+            if (zone.disabled) row.classList.add('disabled');
+            row.innerHTML = `
+                <td><strong>${escapeHtml(zone.name)}</strong></td>
+                <td>${zone.trigger_count}</td>
+                <td>${zone.disabled ? `Closed${zone.reason ? ': ' + escapeHtml(zone.reason) : ''}` : 'Open'}</td>
+                <td class="actions"></td>`;
+            const button = document.createElement('button');
+            button.textContent = zone.disabled ? 'Open' : 'Close';
+            button.addEventListener('click', () => setZoneDisabled(zone.name, !zone.disabled));
+            row.querySelector('.actions').appendChild(button);
+            zonesTableBodyEl.appendChild(row);
+        });
+    } catch (error) {
+        console.error("Failed to load zones:", error);
+    }
+}
+
+function setZoneDisabled(name, disabled) {
+    let reason = '';
+    if (disabled) {
+        reason = prompt(`Close ${name}? Optionally enter a reason to show visitors:`, 'Props are being reset.');
+        if (reason === null) return;
+    }
+    sendChange('PATCH', `/api/admin/zones/${encodeURIComponent(name)}`, { disabled, reason });
+}
+
+async function loadMaintenance() {
+    try {
+        const response = await fetch('/api/admin/maintenance');
+        if (!response.ok) return;
+        maintenance = await response.json();
+        maintenanceStatusEl.textContent = maintenance.disabled
+            ? `The dashboard is in maintenance mode${maintenance.reason ? ': ' + maintenance.reason : '.'}`
+            : 'The dashboard is open.';
+        maintenanceButtonEl.textContent = maintenance.disabled ? 'End maintenance' : 'Start maintenance';
+    } catch (error) {
+        console.error("Failed to load maintenance mode:", error);
+    }
+}
+
+maintenanceButtonEl.addEventListener('click', () => {
+    let reason = '';
+    if (!maintenance.disabled) {
+        reason = prompt('Put the whole dashboard into maintenance mode? Optionally enter a reason to show visitors:', '');
+        if (reason === null) return;
+    }
+    sendChange('PATCH', '/api/admin/maintenance', { disabled: !maintenance.disabled, reason });
+});
+
+function setOffline(trigger, disabled) {
+    let reason = '';
+    if (disabled) {
+        reason = prompt(`Take ${trigger.name} offline? Optionally enter a reason to show visitors:`, 'Being repaired.');
+        if (reason === null) return;
+    }
+    sendChange('PATCH', `/api/admin/trigger-states/${encodeURIComponent(trigger.id)}`, { disabled, reason });
+}
+
+async function loadAuditLog() {
+    try {
+        const response = await fetch('/api/admin/audit');
+        if (!response.ok) return;
+        const entries = await response.json();
+        auditTableBodyEl.innerHTML = '';
+        entries.slice(0, 50).forEach(entry => {
+            const row = document.createElement('tr');
+            row.innerHTML = `
+                <td>${new Date(entry.timestamp).toLocaleString()}</td>
+                <td>${escapeHtml(entry.actor.length > 20 ? entry.actor.substring(0, 8) + '...' : entry.actor)}</td>
+                <td>${escapeHtml(entry.action)}</td>
+                <td>${escapeHtml(entry.target)}</td>`;
+            auditTableBodyEl.appendChild(row);
+        });
+        if (entries.length === 0) {
+            auditTableBodyEl.innerHTML = '<tr><td colspan="4">No changes yet.</td></tr>';
+        }
+    } catch (error) {
+        console.error("Failed to load audit log:", error);
+    }
+}
+
+// sendChange sends a change and reloads the list, showing the server's message on failure.
+async function sendChange(method, url, body) {
+    editorErrorEl.textContent = '';
+    const response = await fetch(url, {
+        method,
+        headers: { 'Content-Type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body)
+    });
+    if (!response.ok) {
+        const message = await response.text();
+        editorErrorEl.textContent = message;
+        alert(message);
+        return false;
+    }
+    await loadTriggers();
+    return true;
+}
+
+function moveTrigger(index, delta) {
+    const enabled = triggers.filter(v => !v.disabled).map(v => v.trigger.id);
+    const target = index + delta;
+    if (target < 0 || target >= enabled.length) return;
+    [enabled[index], enabled[target]] = [enabled[target], enabled[index]];
+    sendChange('POST', '/api/admin/triggers/reorder', { ids: enabled });
+}
+
+function setDisabled(id, disabled) {
+    sendChange('PATCH', `/api/admin/triggers/${encodeURIComponent(id)}`, { disabled });
+}
+
+function deleteTrigger(view) {
+    const question = view.origin === 'override'
+        ? `Revert "${view.trigger.name}" to the definition in the config file?`
+        : `Delete "${view.trigger.name}"? This can't be undone.`;
+    if (!confirm(question)) return;
+    sendChange('DELETE', `/api/admin/triggers/${encodeURIComponent(view.trigger.id)}`);
+}
+
+function editTrigger(view) {
+    editingId = view.trigger.id;
+    editorTitleEl.textContent = `Edit ${view.trigger.name}`;
+    triggerJsonEl.value = JSON.stringify(view.trigger, null, 2);
+    editorErrorEl.textContent = view.origin === 'file' ? 'Saving will override the config file definition.' : '';
+    triggerJsonEl.scrollIntoView({ behavior: 'smooth' });
+}
+
+function resetEditor() {
+    editingId = null;
+    editorTitleEl.textContent = 'New Trigger';
+    triggerJsonEl.value = JSON.stringify(newTriggerTemplate, null, 2);
+    editorErrorEl.textContent = '';
+}
+
+document.getElementById('save-trigger').addEventListener('click', async () => {
+    let trigger;
+    try {
+        trigger = JSON.parse(triggerJsonEl.value);
+    } catch (error) {
+        editorErrorEl.textContent = `Invalid JSON: ${error.message}`;
+        return;
+    }
+    const saved = editingId === null
+        ? await sendChange('POST', '/api/admin/triggers', trigger)
+        : await sendChange('PUT', `/api/admin/triggers/${encodeURIComponent(editingId)}`, trigger);
+    if (saved) resetEditor();
+});
+
+document.getElementById('cancel-edit').addEventListener('click', resetEditor);
+
+resetEditor();
+loadTriggers();
@@ -0,0 +1,154 @@
+console.log("Voucher script loaded.");
+
+const vouchersContainer = document.getElementById('vouchers-admin');
+const voucherFormEl = document.getElementById('voucher-form');
+const voucherErrorEl = document.getElementById('voucher-error');
+const voucherSheetEl = document.getElementById('voucher-sheet');
+const sheetActionsEl = document.getElementById('sheet-actions');
+const batchesTableBodyEl = document.querySelector('#batches-table tbody');
+
+let publicAccessKey = '';
+let lastBatch = null; // The batch just generated, the only time its codes are known
+
+function escapeHtml(text) {
+    const div = document.createElement('div');
+    div.textContent = text ?? '';
+    return div.innerHTML;
+}
+
+// redeemUrl is what a voucher's QR code opens. It includes the public access key, so a visitor
+// who hasn't been to the dashboard yet gets in and redeems the code in one scan.
+function redeemUrl(code) {
+    const url = new URL('/api/redeem', window.location.origin);
+    url.searchParams.set('code', code);
+    if (publicAccessKey) {
+        url.searchParams.set('access_key', publicAccessKey);
+    }
+    return url.toString();
+}
+
+async function loadBatches() {
+    try {
+        const response = await fetch('/api/admin/redeem-codes');
+        if (response.status === 403) {
+            vouchersContainer.innerHTML = `
+                <h2 class="error">Access Denied</h2>
+                <p class="error">You must be an admin to view this page. Please <a href="/login.html">log in</a>.</p>
+            `;
+            return;
+        }
+        if (!response.ok) {
+            throw new Error(`Server error: ${response.status}`);
+        }
+        const batches = await response.json();
+        batchesTableBodyEl.innerHTML = '';
+        if (batches.length === 0) {
+            batchesTableBodyEl.innerHTML = '<tr><td colspan="6">No vouchers yet.</td></tr>';
+            return;
+        }
+        batches.forEach(batch => {
+            const row = document.createElement('tr');
+            if (batch.revoked) row.classList.add('disabled');
+            row.innerHTML = `
+                <td>${new Date(batch.created_at).toLocaleString()}</td>
+                <td>${escapeHtml(batch.label || batch.batch)}</td>
+                <td>${batch.codes}${batch.max_uses > 1 ? ` &times; ${batch.max_uses} uses` : ''}</td>
+                <td>${batch.tokens}</td>
+                <td>${batch.uses}${batch.revoked ? ' (revoked)' : ''}</td>
+                <td class="actions"></td>`;
+            if (!batch.revoked) {
+                const button = document.createElement('button');
+                button.textContent = 'Revoke';
+                button.addEventListener('click', () => revokeBatch(batch));
+                row.querySelector('.actions').appendChild(button);
+            }
+            batchesTableBodyEl.appendChild(row);
+        });
+    } catch (error) {
+        console.error("Failed to load vouchers:", error);
+        batchesTableBodyEl.innerHTML = '<tr><td colspan="6" class="error">Could not load vouchers.</td></tr>';
+    }
+}
+
+async function revokeBatch(batch) {
+    if (!confirm(`Revoke every unredeemed code in ${batch.label || batch.batch}? This can't be undone.`)) return;
+    try {
+        const response = await fetch(`/api/admin/redeem-codes/${encodeURIComponent(batch.batch)}`, { method: 'DELETE' });
+        if (!response.ok) {
+            alert(`Could not revoke the batch: ${await response.text()}`);
+        }
+    } catch (error) {
+        console.error("Failed to revoke batch:", error);
+    }
+    loadBatches();
+}
+
+function renderSheet(batch, label) {
+    voucherSheetEl.innerHTML = '';
+    batch.codes.forEach(code => {
+        const voucher = document.createElement('div');
+        voucher.className = 'voucher';
+        voucher.innerHTML = `
+            <h3>${batch.tokens} Scare Token${batch.tokens === 1 ? '' : 's'}</h3>
+            <canvas></canvas>
+            <code>${escapeHtml(code)}</code>
+            ${label ? `<small>${escapeHtml(label)}</small>` : ''}`;
+        new QRious({ element: voucher.querySelector('canvas'), value: redeemUrl(code), size: 160 });
+        voucherSheetEl.appendChild(voucher);
+    });
+    sheetActionsEl.style.display = 'block';
+}
+
+voucherFormEl.addEventListener('submit', async (event) => {
+    event.preventDefault();
+    voucherErrorEl.textContent = '';
+    const label = document.getElementById('voucher-label').value.trim();
+    try {
+        const response = await fetch('/api/admin/redeem-codes', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                count: Number(document.getElementById('voucher-count').value),
+                tokens: Number(document.getElementById('voucher-tokens').value),
+                max_uses: Number(document.getElementById('voucher-uses').value),
+                label
+            })
+        });
+        if (!response.ok) {
+            voucherErrorEl.textContent = await response.text();
+            return;
+        }
+        lastBatch = await response.json();
+        renderSheet(lastBatch, label);
+        loadBatches();
+    } catch (error) {
+        console.error("Failed to generate vouchers:", error);
+        voucherErrorEl.textContent = 'Could not generate vouchers.';
+    }
+});
+
+document.getElementById('print-sheet').addEventListener('click', () => window.print());
+
+document.getElementById('download-csv').addEventListener('click', () => {
+    if (!lastBatch) return;
+    const lines = ['code,tokens,max_uses,url', ...lastBatch.codes.map(code => `${code},${lastBatch.tokens},${lastBatch.max_uses},${redeemUrl(code)}`)];
+    const link = document.createElement('a');
+    link.href = URL.createObjectURL(new Blob([lines.join('\n') + '\n'], { type: 'text/csv' }));
+    link.download = `vouchers-${lastBatch.batch}.csv`;
+    link.click();
+    URL.revokeObjectURL(link.href);
+});
+
+async function init() {
+    try {
+        const response = await fetch('/api/admin/public-access-key');
+        if (response.ok) {
+            publicAccessKey = (await response.json()).public_access_key || '';
+        }
+    } catch (error) {
+        console.error("Failed to load the public access key:", error);
+    }
+    loadBatches();
+}
+
+init();
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- User Management ---
+// Admins can look up a user, grant or take away tokens, ban them, make them an admin or take
+// that away, and reset their sessions. Every change is recorded in the audit log.
+//
+// Resetting a user's sessions refuses every session cookie issued for them before the reset.
+// Cookies are only ever issued to new users, so whoever holds one starts again as a new user.
+
+const maxUserDetailHistory = 20 // Ledger entries included in a user lookup.
+
+// userDetail is what an admin sees when looking up a user.
+type userDetail struct {
+	User
+	CreatedAt       time.Time     `json:"created_at"`
+	Banned          bool          `json:"banned"`
+	BanReason       string        `json:"ban_reason,omitempty"`
+	SessionsResetAt *time.Time    `json:"sessions_reset_at,omitempty"`
+	Activations     int           `json:"activations"`
+	TokensUsed      int           `json:"tokens_used"`
+	Recharges       int           `json:"recharges"`
+	Redemptions     int           `json:"redemptions"`
+	History         []ledgerEntry `json:"history"`
+}
+
+// userPatch is the body of PATCH /api/admin/users/{id}. Fields that are left out aren't
+// changed.
+type userPatch struct {
+	Banned  *bool  `json:"banned"`
+	Reason  string `json:"reason"` // Shown to a banned user
+	IsAdmin *bool  `json:"is_admin"`
+	Role    string `json:"role"` // Admin role given on promotion; viewer if unset
+}
+
+// queryLedger returns a user's most recent ledger entries, newest first.
+func queryLedger(db dbQuerier, userID string, limit int) ([]ledgerEntry, error) {
+	rows, err := db.Query(`
+		SELECT l.id, l.timestamp, l.delta, l.balance, l.reason, l.action_id, COALESCE(a.trigger_id, '')
+		FROM token_ledger l
+		LEFT JOIN actions a ON a.id = l.action_id
+		WHERE l.user_id = ?
+		ORDER BY l.id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ledgerEntry{}
+	for rows.Next() {
+		var e ledgerEntry
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Delta, &e.Balance, &e.Reason, &e.ActionID, &e.TriggerID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// lookupUser loads a user with their activity. It returns sql.ErrNoRows if there is no such user.
+func (app *App) lookupUser(id string) (*userDetail, error) {
+	var d userDetail
+	var resetAt sql.NullInt64
+	var account, accountRole, sessionRole string
+	err := app.db.QueryRow(`SELECT u.id, u.tokens_remaining, u.is_admin, u.created_at, u.banned, COALESCE(u.ban_reason, ''), u.sessions_reset_at,
+			COALESCE(u.admin_account, ''), COALESCE(a.role, ''), COALESCE(u.admin_role, '')
+		FROM users u LEFT JOIN admin_accounts a ON a.username = u.admin_account WHERE u.id = ?`, id).
+		Scan(&d.ID, &d.TokensRemaining, &d.IsAdmin, &d.CreatedAt, &d.Banned, &d.BanReason, &resetAt, &account, &accountRole, &sessionRole)
+	if err != nil {
+		return nil, err
+	}
+	resolveAdminRole(&d.User, account, accountRole, sessionRole)
+	if resetAt.Valid {
+		t := time.Unix(resetAt.Int64, 0).UTC()
+		d.SessionsResetAt = &t
+	}
+
+	err = app.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(cost), 0) FROM actions WHERE user_id = ? AND success = 1", id).Scan(&d.Activations, &d.TokensUsed)
+	if err != nil {
+		return nil, fmt.Errorf("could not count activations: %w", err)
+	}
+	err = app.db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN source = 'recharge' THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN source = 'redeem' THEN 1 ELSE 0 END), 0)
+		FROM recharges WHERE user_id = ?`, id).Scan(&d.Recharges, &d.Redemptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not count recharges: %w", err)
+	}
+	if d.History, err = queryLedger(app.db, id, maxUserDetailHistory); err != nil {
+		return nil, fmt.Errorf("could not query token history: %w", err)
+	}
+	return &d, nil
+}
+
+// grantTokens adds delta tokens to a user's balance, or takes them away if it is negative. The
+// balance can't be taken below zero.
+func (app *App) grantTokens(admin *User, userID string, delta int, note string) (int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET tokens_remaining = tokens_remaining + ? WHERE id = ? AND tokens_remaining + ? >= 0", delta, userID, delta)
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return 0, sql.ErrNoRows
+	}
+	if err := recordLedgerEntry(tx, userID, delta, ledgerAdminGrant, 0); err != nil {
+		return 0, err
+	}
+	var balance int
+	if err := tx.QueryRow("SELECT tokens_remaining FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		return 0, err
+	}
+	action := "user.grant"
+	if delta < 0 {
+		action = "user.revoke"
+	}
+	if err := recordAudit(tx, admin.actor(), action, userID, map[string]interface{}{"delta": delta, "balance": balance, "note": note}); err != nil {
+		return 0, err
+	}
+	return balance, tx.Commit()
+}
+
+// userChange is one change to a user and the audit action it is recorded as.
+type userChange struct {
+	action  string
+	details interface{}
+	query   string
+	args    []interface{}
+}
+
+// updateUser applies changes to a user in one transaction together with their audit records,
+// so either all of them are made or none.
+func (app *App) updateUser(admin *User, userID string, changes ...userChange) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range changes {
+		res, err := tx.Exec(c.query, c.args...)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		if err := recordAudit(tx, admin.actor(), c.action, userID, c.details); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		log.Printf("Admin %s: %s %s.", admin.actor(), c.action, userID)
+	}
+	return nil
+}
+
+// adminUsersHandler serves the user management endpoints:
+//
+//	GET   /api/admin/users/{id}                 look up a user
+//	PATCH /api/admin/users/{id}                 ban or unban, promote or demote
+//	POST  /api/admin/users/{id}/tokens          grant or revoke tokens: {"delta": 5, "note": "..."}
+//	POST  /api/admin/users/{id}/reset-sessions  sign the user out everywhere
+func (app *App) adminUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := requireRole(w, r, writeRole(r, roleOwner))
+		if !ok {
+			return
+		}
+
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/users/"), "/")
+		if id == "" {
+			http.Error(w, "User ID required", http.StatusBadRequest)
+			return
+		}
+
+		// writeResult reports the outcome of a change and answers with the updated user.
+		writeResult := func(err error) {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			case err != nil:
+				log.Printf("ERROR: could not update user %s: %v", id, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			detail, err := app.lookupUser(id)
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("ERROR: could not look up user %s: %v", id, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(detail)
+		}
+
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			writeResult(nil)
+		case sub == "" && r.Method == http.MethodPatch:
+			var payload userPatch
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || (payload.Banned == nil && payload.IsAdmin == nil) {
+				http.Error(w, `Expected {"banned": true|false, "reason": "..."} and/or {"is_admin": true|false, "role": "viewer|operator|owner"}`, http.StatusBadRequest)
+				return
+			}
+			if payload.Role != "" && (payload.IsAdmin == nil || !*payload.IsAdmin || roleRank[payload.Role] == 0) {
+				http.Error(w, `"role" must be viewer, operator or owner, and is only used with {"is_admin": true}`, http.StatusBadRequest)
+				return
+			}
+			if id == admin.ID {
+				http.Error(w, "You can't ban or demote yourself", http.StatusBadRequest)
+				return
+			}
+			var changes []userChange
+			if payload.Banned != nil {
+				action, reason := "user.unban", ""
+				if *payload.Banned {
+					action, reason = "user.ban", payload.Reason
+				}
+				changes = append(changes, userChange{action, map[string]string{"reason": reason},
+					"UPDATE users SET banned = ?, ban_reason = NULLIF(?, '') WHERE id = ?", []interface{}{*payload.Banned, reason, id}})
+			}
+			if payload.IsAdmin != nil && *payload.IsAdmin {
+				// The session gets the role itself, detached from any admin account.
+				role := payload.Role
+				if role == "" {
+					role = roleViewer
+				}
+				changes = append(changes, userChange{"user.promote", map[string]string{"role": role},
+					"UPDATE users SET is_admin = 1, admin_role = ?, admin_account = NULL WHERE id = ?", []interface{}{role, id}})
+			} else if payload.IsAdmin != nil {
+				changes = append(changes, userChange{"user.demote", nil,
+					"UPDATE users SET is_admin = 0, admin_role = NULL WHERE id = ?", []interface{}{id}})
+			}
+			writeResult(app.updateUser(admin, id, changes...))
+		case sub == "tokens" && r.Method == http.MethodPost:
+			var payload struct {
+				Delta int    `json:"delta"`
+				Note  string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Delta == 0 {
+				http.Error(w, `Expected {"delta": <nonzero number of tokens>, "note": "..."}`, http.StatusBadRequest)
+				return
+			}
+			if _, err := app.grantTokens(admin, id, payload.Delta, payload.Note); errors.Is(err, sql.ErrNoRows) {
+				// Either the user doesn't exist or the balance doesn't cover the revocation.
+				if _, lookupErr := app.lookupUser(id); lookupErr == nil {
+					http.Error(w, "The user doesn't have that many tokens", http.StatusConflict)
+					return
+				}
+				writeResult(err)
+				return
+			} else if err != nil {
+				writeResult(err)
+				return
+			}
+			log.Printf("Admin %s: adjusted tokens of %s by %d.", admin.actor(), id, payload.Delta)
+			writeResult(nil)
+		case sub == "reset-sessions" && r.Method == http.MethodPost:
+			writeResult(app.updateUser(admin, id, userChange{"user.reset_sessions", nil,
+				"UPDATE users SET sessions_reset_at = ? WHERE id = ?", []interface{}{time.Now().Unix(), id}}))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Config Validation ---
+// Catches mistakes at load time instead of when a visitor presses the button. Every problem
+// is reported with its file and path (e.g. "triggers[3].govee_brightness") so a single run
+// lists everything that needs fixing.
+
+// knownTriggerTypes are the values accepted in a trigger's "type" field. An empty type
+// means "arduino" for backward compatibility.
+var knownTriggerTypes = []string{"arduino", "govee_lightning", "govee_status", "govee_set_state", "hue", "command"}
+
+// hueEffects are the effects a "hue" trigger may select.
+var hueEffects = []string{effectLightning, effectSetState, effectStatus, effectAlert, effectFlash}
+
+// configProblem is a single validation finding.
+type configProblem struct {
+	File    string
+	Path    string
+	Message string
+	Warning bool // Warnings are reported but don't prevent the config from loading.
+}
+
+func (p configProblem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	s := severity + ": "
+	if p.Path != "" {
+		s += p.Path + ": "
+	}
+	s += p.Message
+	if p.File != "" {
+		return p.File + ": " + s
+	}
+	return s
+}
+
+// configError is returned when a config has one or more validation errors.
+type configError struct {
+	Problems []configProblem
+}
+
+func (e *configError) Error() string {
+	errorCount := 0
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		if !p.Warning {
+			errorCount++
+		}
+		lines = append(lines, p.String())
+	}
+	return fmt.Sprintf("invalid configuration (%d errors):\n  %s", errorCount, strings.Join(lines, "\n  "))
+}
+
+// hasConfigErrors reports whether any of the problems is an error rather than a warning.
+func hasConfigErrors(problems []configProblem) bool {
+	return slices.ContainsFunc(problems, func(p configProblem) bool { return !p.Warning })
+}
+
+// parseConfig decodes one config file, JSON or YAML depending on its extension, and reports
+// decoding problems and unknown fields. It returns nil if the file can't be decoded. Semantic
+// validation happens in validateConfig once all files are merged.
+func parseConfig(path string, data []byte) (*Config, []configProblem) {
+	if isYAMLFile(path) {
+		converted, err := yamlToJSON(data)
+		if err != nil {
+			return nil, []configProblem{{File: path, Message: err.Error()}}
+		}
+		data = converted
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		p := jsonProblem(data, err)
+		p.File = path
+		return nil, []configProblem{p}
+	}
+
+	var raw interface{}
+	json.Unmarshal(data, &raw) // Can't fail: the same bytes just decoded into Config.
+
+	problems := unknownFields(raw, reflect.TypeOf(config), "")
+	for i := range problems {
+		problems[i].File = path
+	}
+	return &config, problems
+}
+
+// jsonProblem turns a decoding error into a problem with a line/column or field path.
+func jsonProblem(data []byte, err error) configProblem {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := lineAndColumn(data, syntaxErr.Offset)
+		return configProblem{Path: fmt.Sprintf("line %d, column %d", line, col), Message: syntaxErr.Error()}
+	case errors.As(err, &typeErr):
+		return configProblem{Path: jsonFieldPath(typeErr.Field), Message: fmt.Sprintf("expected %s but found JSON %s", typeErr.Type, typeErr.Value)}
+	default:
+		return configProblem{Message: err.Error()}
+	}
+}
+
+// jsonFieldPath converts a field path from encoding/json ("triggers.0.cost") to the form used
+// in every other problem ("triggers[0].cost").
+func jsonFieldPath(field string) string {
+	var path string
+	for _, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			path += "[" + part + "]"
+		} else {
+			path = joinPath(path, part)
+		}
+	}
+	return path
+}
+
+// lineAndColumn converts the offset of a JSON syntax error, which counts the offending byte, to
+// the 1-based line and column of that byte.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	before := data[:min(max(int(offset)-1, 0), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// unknownFields walks the raw JSON alongside the Go type and reports keys that don't map
+// to any field, which usually means a typo ("govee_brightnes") that would be silently ignored.
+func unknownFields(raw interface{}, t reflect.Type, path string) []configProblem {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []configProblem
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fieldPath := joinPath(path, k)
+			fieldType, ok := fields[k]
+			if !ok {
+				problems = append(problems, configProblem{Path: fieldPath, Message: "unknown field (typo?); it will be ignored", Warning: true})
+				continue
+			}
+			problems = append(problems, unknownFields(obj[k], fieldType, fieldPath)...)
+		}
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range arr {
+			problems = append(problems, unknownFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// validateConfig checks the semantic rules that decoding alone can't enforce. Trigger
+// problems are reported against the file the trigger was defined in.
+func validateConfig(config *Config) []configProblem {
+	var problems []configProblem
+	file := config.path
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, configProblem{File: file, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(path, format string, args ...interface{}) {
+		problems = append(problems, configProblem{File: file, Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+	}
+
+	if config.LivestreamURL != "" {
+		if u, err := url.Parse(config.LivestreamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("livestream_url", "must be an http:// or https:// URL")
+		}
+	}
+	for i, cmd := range config.AllowedCommands {
+		if !filepath.IsAbs(cmd) {
+			add(fmt.Sprintf("allowed_commands[%d]", i), "must be an absolute path, got %q", cmd)
+		}
+	}
+
+	if len(config.Triggers) == 0 {
+		warn("triggers", "no triggers are defined; the dashboard will be empty")
+	}
+
+	seenIDs := make(map[string]int)
+	for i := range config.Triggers {
+		t := &config.Triggers[i]
+		var path string
+		file, path = config.triggerLocation(i)
+
+		if t.ID == "" {
+			add(path+".id", "is required")
+		} else if first, dup := seenIDs[t.ID]; dup {
+			firstFile, firstPath := config.triggerLocation(first)
+			if firstFile != file {
+				firstPath = firstFile + " " + firstPath
+			}
+			add(path+".id", "duplicate id %q (also used by %s)", t.ID, firstPath)
+		} else {
+			seenIDs[t.ID] = i
+			if strings.ContainsAny(t.ID, "/?#% ") {
+				add(path+".id", "must not contain spaces or any of / ? # %% since it is used in URLs")
+			}
+		}
+		if t.Name == "" {
+			add(path+".name", "is required")
+		}
+		if t.Description == "" {
+			warn(path+".description", "is empty; the button will have no explanation")
+		}
+		if t.Color != "" && !triggerColorPattern.MatchString(t.Color) {
+			add(path+".color", "must be a hex colour like #f80 or #ff8800, got %q", t.Color)
+		}
+		if utf8.RuneCountInString(t.Icon) > maxTriggerIconLength {
+			add(path+".icon", "must be at most %d characters", maxTriggerIconLength)
+		}
+		if t.Cost != nil && *t.Cost < 0 {
+			add(path+".cost", "must not be negative, got %d", *t.Cost)
+		}
+
+		triggerType := t.Type
+		if triggerType == "" {
+			triggerType = "arduino"
+		}
+		if !slices.Contains(knownTriggerTypes, triggerType) {
+			add(path+".type", "unknown type %q (expected one of: %s)", t.Type, strings.Join(knownTriggerTypes, ", "))
+			continue
+		}
+
+		isGovee := strings.HasPrefix(triggerType, "govee_")
+		switch {
+		case triggerType == "arduino":
+			if t.ArduinoIP == "" {
+				add(path+".arduino_ip", "is required for arduino triggers")
+			}
+			if t.SecretKey == "" {
+				add(path+".secret_key", "is required for arduino triggers")
+			}
+		case isGovee:
+			if t.GoveeDeviceIP == "" {
+				add(path+".govee_device_ip", "is required for %s triggers", triggerType)
+			} else if net.ParseIP(t.GoveeDeviceIP) == nil {
+				add(path+".govee_device_ip", "must be an IP address, got %q", t.GoveeDeviceIP)
+			}
+			if t.GoveeModel == "" {
+				warn(path+".govee_model", "is missing; it is only used for logging")
+			}
+			validateLightSettings(path, "govee", t.GoveeBrightness, t.GoveeColor, t.GoveeColorTemp, 2000, 9000, add)
+			if triggerType != "govee_set_state" && (t.GoveeBrightness != nil || t.GoveeColor != nil || t.GoveeColorTemp != nil) {
+				warn(path, "govee_brightness/govee_color/govee_color_temp are only used by govee_set_state triggers")
+			}
+		case triggerType == "hue":
+			if t.HueBridgeIP == "" {
+				add(path+".hue_bridge_ip", "is required for hue triggers")
+			}
+			if t.HueAppKey == "" {
+				add(path+".hue_app_key", "is required for hue triggers")
+			}
+			if t.HueLightID == "" {
+				add(path+".hue_light_id", "is required for hue triggers")
+			}
+			if t.Effect != "" && !slices.Contains(hueEffects, t.Effect) {
+				add(path+".effect", "unknown effect %q (expected one of: %s)", t.Effect, strings.Join(hueEffects, ", "))
+			}
+			validateLightSettings(path, "hue", t.HueBrightness, t.HueColor, t.HueColorTemp, 2000, 6500, add)
+		case triggerType == "command":
+			if t.Command == "" {
+				add(path+".command", "is required for command triggers")
+			} else if !slices.Contains(config.AllowedCommands, t.Command) {
+				add(path+".command", "%q is not listed in allowed_commands", t.Command)
+			}
+			if t.TimeoutSeconds < 0 {
+				add(path+".timeout_seconds", "must not be negative")
+			}
+		}
+
+		// Fields that belong to another trigger type are almost always a copy/paste mistake.
+		if !isGovee && (t.GoveeDeviceIP != "" || t.GoveeModel != "") {
+			warn(path, "govee_* fields are ignored by %s triggers", triggerType)
+		}
+		if triggerType != "hue" && (t.HueBridgeIP != "" || t.HueLightID != "" || t.Effect != "") {
+			warn(path, "hue_* and effect fields are ignored by %s triggers", triggerType)
+		}
+		if triggerType != "arduino" && t.ArduinoIP != "" {
+			warn(path+".arduino_ip", "is ignored by %s triggers", triggerType)
+		}
+		if triggerType != "command" && (t.Command != "" || len(t.Args) > 0 || len(t.Env) > 0) {
+			warn(path, "command/args/env are ignored by %s triggers", triggerType)
+		}
+	}
+	return problems
+}
+
+// validateLightSettings checks the brightness, colour and colour temperature of a light trigger.
+func validateLightSettings(path, prefix string, brightness *int, color *GoveeColorCommandData, colorTemp *int, minKelvin, maxKelvin int, add func(string, string, ...interface{})) {
+	if brightness != nil && (*brightness < 1 || *brightness > 100) {
+		add(path+"."+prefix+"_brightness", "must be between 1 and 100, got %d", *brightness)
+	}
+	if color != nil {
+		channels := []struct {
+			name  string
+			value int
+		}{{"r", color.R}, {"g", color.G}, {"b", color.B}}
+		for _, c := range channels {
+			if c.value < 0 || c.value > 255 {
+				add(path+"."+prefix+"_color."+c.name, "must be between 0 and 255, got %d", c.value)
+			}
+		}
+	}
+	// A colour temperature of 0 is allowed and means "not set".
+	if colorTemp != nil && *colorTemp != 0 && (*colorTemp < minKelvin || *colorTemp > maxKelvin) {
+		add(path+"."+prefix+"_color_temp", "must be between %d and %d Kelvin, got %d", minKelvin, maxKelvin, *colorTemp)
+	}
+}
+
+// runValidateConfig implements "dashboard validate-config <path>". It runs the same loading,
+// merging and validation as the server and returns the process exit code. Secret references
+// are only warned about if they can't be resolved, since the check usually runs on a machine
+// without the server's secrets.
+func runValidateConfig(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dashboard validate-config <path/to/config.json|config.yaml>")
+		return 2
+	}
+	path := args[0]
+
+	config, problems, err := loadConfigFile(path, false)
+	var cfgErr *configError
+	switch {
+	case errors.As(err, &cfgErr):
+		problems = cfgErr.Problems
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	errorCount, warningCount := 0, 0
+	for _, p := range problems {
+		if p.Warning {
+			warningCount++
+		} else {
+			errorCount++
+		}
+		fmt.Println(p)
+	}
+
+	if errorCount > 0 {
+		fmt.Printf("%s is INVALID: %d errors, %d warnings.\n", path, errorCount, warningCount)
+		return 1
+	}
+	fmt.Printf("%s is valid: %d triggers from %d files, %d warnings.\n", path, len(config.Triggers), len(config.files), warningCount)
+	return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestValidateConfigProblems checks that each mistake is reported once, as an error or a
+// warning, at the path of the field that has to be fixed.
+func TestValidateConfigProblems(t *testing.T) {
+	const arduino = `{"id": "scream", "name": "Scream", "description": "Boo", "arduino_ip": "10.0.0.5", "secret_key": "k"}`
+	tests := []struct {
+		name       string
+		config     string
+		want       []string // "error: path" or "warning: path", in order
+		wantInMsg  string   // Expected in the first problem's message
+		wantErrors bool
+	}{
+		{
+			name:   "valid",
+			config: `{"triggers": [` + arduino + `]}`,
+		},
+		{
+			name:       "missing fields",
+			config:     `{"triggers": [{"description": "Boo"}]}`,
+			want:       []string{"error: triggers[0].id", "error: triggers[0].name", "error: triggers[0].arduino_ip", "error: triggers[0].secret_key"},
+			wantInMsg:  "is required",
+			wantErrors: true,
+		},
+		{
+			name:       "duplicate id",
+			config:     `{"triggers": [` + arduino + `, ` + arduino + `]}`,
+			want:       []string{"error: triggers[1].id"},
+			wantInMsg:  `duplicate id "scream" (also used by triggers[0])`,
+			wantErrors: true,
+		},
+		{
+			name:       "unknown type",
+			config:     `{"triggers": [{"id": "fog", "name": "Fog", "description": "Whoosh", "type": "fogger"}]}`,
+			want:       []string{"error: triggers[0].type"},
+			wantInMsg:  `unknown type "fogger"`,
+			wantErrors: true,
+		},
+		{
+			name: "out of range values",
+			config: `{"triggers": [{"id": "glow", "name": "Glow", "description": "Red", "type": "govee_set_state", "govee_device_ip": "10.0.0.9",
+				"govee_model": "H6159", "govee_brightness": 150, "govee_color": {"r": 300, "g": 0, "b": 0}, "cost": -1}]}`,
+			want:       []string{"error: triggers[0].cost", "error: triggers[0].govee_brightness", "error: triggers[0].govee_color.r"},
+			wantInMsg:  "must not be negative, got -1",
+			wantErrors: true,
+		},
+		{
+			name:       "bad id characters",
+			config:     `{"triggers": [{"id": "a b", "name": "A", "description": "Boo", "arduino_ip": "10.0.0.5", "secret_key": "k"}]}`,
+			want:       []string{"error: triggers[0].id"},
+			wantInMsg:  "must not contain spaces",
+			wantErrors: true,
+		},
+		{
+			name:      "unknown fields are warnings",
+			config:    `{"livestream": "x", "triggers": [{"id": "scream", "name": "Scream", "description": "Boo", "arduino_ip": "10.0.0.5", "secret_key": "k", "secret_kye": "k"}]}`,
+			want:      []string{"warning: livestream", "warning: triggers[0].secret_kye"},
+			wantInMsg: "unknown field",
+		},
+		{
+			name:      "fields of another type are warnings",
+			config:    `{"triggers": [{"id": "scream", "name": "Scream", "description": "Boo", "arduino_ip": "10.0.0.5", "secret_key": "k", "hue_light_id": "3"}]}`,
+			want:      []string{"warning: triggers[0]"},
+			wantInMsg: "ignored by arduino triggers",
+		},
+		{
+			name:      "no triggers",
+			config:    `{}`,
+			want:      []string{"warning: triggers"},
+			wantInMsg: "no triggers are defined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, problems := parseConfig("config.json", []byte(tt.config))
+			if config == nil {
+				t.Fatalf("parseConfig failed: %v", problems)
+			}
+			problems = append(problems, validateConfig(config)...)
+
+			var got []string
+			for _, p := range problems {
+				severity := "error"
+				if p.Warning {
+					severity = "warning"
+				}
+				got = append(got, severity+": "+p.Path)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got problems %q, want %q", got, tt.want)
+			}
+			if len(problems) > 0 && !strings.Contains(problems[0].Message, tt.wantInMsg) {
+				t.Errorf("first message = %q, want it to contain %q", problems[0].Message, tt.wantInMsg)
+			}
+			if hasConfigErrors(problems) != tt.wantErrors {
+				t.Errorf("hasConfigErrors = %v, want %v", !tt.wantErrors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+// TestParseConfigDecodingProblems checks that syntax and type errors point at the line or
+// field.
+func TestParseConfigDecodingProblems(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantPath string
+	}{
+		{name: "syntax error", config: "{\n  \"triggers\": [\n    {\"id\": \"a\",}\n  ]\n}", wantPath: "line 3, column 16"},
+		{name: "wrong type", config: `{"triggers": [{"id": "a", "cost": "free"}]}`, wantPath: "triggers[0].cost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, problems := parseConfig("config.json", []byte(tt.config))
+			if config != nil || len(problems) != 1 {
+				t.Fatalf("got config %v and problems %v, want one decoding problem", config, problems)
+			}
+			if problems[0].Path != tt.wantPath || problems[0].File != "config.json" || problems[0].Warning {
+				t.Errorf("got %+v, want an error at %q in config.json", problems[0], tt.wantPath)
+			}
+		})
+	}
+}
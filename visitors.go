@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Visitors ---
+// A visitor only gets a users row, and a session cookie, when they first do something with
+// their tokens: activate a trigger, recharge or redeem a code. Until then the middleware gives
+// handlers a visitor without an ID and with the default balance, so page loads by bots, link
+// previews and scrapers don't add users.
+//
+// Users who never did anything with their tokens are deleted once they are older than
+// inactive-user-retention. Their balance is still the default, so nothing is lost if they come
+// back: they are a new visitor again.
+
+const inactiveUserCleanupInterval = time.Hour
+
+// newVisitor returns a visitor who isn't in the database yet.
+func (app *App) newVisitor() *User {
+	return &User{TokensRemaining: app.settings.DefaultTokens}
+}
+
+// ensureUser stores a visitor created by newVisitor as a new user and signs them in. It does
+// nothing for a user who already exists.
+func (app *App) ensureUser(w http.ResponseWriter, r *http.Request, user *User) error {
+	if user.ID != "" {
+		return nil
+	}
+	created, err := app.createUser(nil)
+	if err != nil {
+		return err
+	}
+	if err := app.setUserCookie(w, r, created.ID); err != nil {
+		return err
+	}
+	*user = *created
+	log.Printf("New user created: ID=%s, Tokens=%d", user.ID, user.TokensRemaining)
+	return nil
+}
+
+// inactiveUsersQuery selects the users deleteInactiveUsers deletes. Its arguments are the
+// retention as a SQLite datetime modifier, ledgerSignup and ledgerOpeningBalance; users from
+// before the ledger only have an opening balance entry, which doesn't count as activity.
+const inactiveUsersQuery = `SELECT u.id FROM users u
+	WHERE u.created_at < datetime('now', ?)
+		AND u.is_admin = 0 AND u.banned = 0 AND u.admin_account IS NULL
+		AND NOT EXISTS (SELECT 1 FROM actions a WHERE a.user_id = u.id)
+		AND NOT EXISTS (SELECT 1 FROM recharges c WHERE c.user_id = u.id)
+		AND NOT EXISTS (SELECT 1 FROM token_ledger l WHERE l.user_id = u.id AND l.reason NOT IN (?, ?))`
+
+// deleteInactiveUsers deletes visitors created more than retention ago who never activated
+// a trigger, recharged or redeemed a code and whose balance was never changed by an admin,
+// together with their signup or opening balance ledger entries. It returns the number of users deleted.
+func (app *App) deleteInactiveUsers(retention time.Duration) (int64, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	modifier := fmt.Sprintf("-%d seconds", int64(retention.Seconds()))
+	// The ledger entries go first; the users still match afterwards.
+	if _, err := tx.Exec("DELETE FROM token_ledger WHERE user_id IN ("+inactiveUsersQuery+")", modifier, ledgerSignup, ledgerOpeningBalance); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM users WHERE id IN ("+inactiveUsersQuery+")", modifier, ledgerSignup, ledgerOpeningBalance)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+	return deleted, tx.Commit()
+}
+
+// cleanUpInactiveUsers runs deleteInactiveUsers every hour, unless the retention is 0.
+func (app *App) cleanUpInactiveUsers() {
+	retention := app.settings.InactiveUserRetention
+	if retention <= 0 {
+		return
+	}
+	for {
+		deleted, err := app.deleteInactiveUsers(retention)
+		if err != nil {
+			log.Printf("ERROR: could not delete inactive users: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d inactive users who never used their tokens.", deleted)
+		}
+		time.Sleep(inactiveUserCleanupInterval)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDeleteInactiveUsers checks that only old users who never did anything with their
+// tokens are deleted, including those from before the ledger, and that their ledger entries
+// go with them.
+func TestDeleteInactiveUsers(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, app *App) string // Creates the user and returns its ID
+		wantDeleted bool
+	}{
+		{
+			name:        "old signup",
+			setup:       func(t *testing.T, app *App) string { return newInactiveTestUser(t, app, "-8 days") },
+			wantDeleted: true,
+		},
+		{
+			name:  "recent signup",
+			setup: func(t *testing.T, app *App) string { return newInactiveTestUser(t, app, "-1 days") },
+		},
+		{
+			name: "backfilled from before the ledger",
+			setup: func(t *testing.T, app *App) string {
+				if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin, created_at) VALUES ('legacy', 10, 0, datetime('now', '-30 days'))"); err != nil {
+					t.Fatalf("insert user: %v", err)
+				}
+				if err := backfillLedger(app.db); err != nil {
+					t.Fatalf("backfillLedger: %v", err)
+				}
+				return "legacy"
+			},
+			wantDeleted: true,
+		},
+		{
+			name: "backfilled and activated",
+			setup: func(t *testing.T, app *App) string {
+				if _, err := app.db.Exec("INSERT INTO users (id, tokens_remaining, is_admin, created_at) VALUES ('legacy', 9, 0, datetime('now', '-30 days'))"); err != nil {
+					t.Fatalf("insert user: %v", err)
+				}
+				if _, err := app.db.Exec("INSERT INTO actions (user_id, trigger_id, success, cost) VALUES ('legacy', 'scream', 1, 1)"); err != nil {
+					t.Fatalf("insert action: %v", err)
+				}
+				if err := backfillLedger(app.db); err != nil {
+					t.Fatalf("backfillLedger: %v", err)
+				}
+				return "legacy"
+			},
+		},
+		{
+			name: "credited by an admin",
+			setup: func(t *testing.T, app *App) string {
+				id := newInactiveTestUser(t, app, "-8 days")
+				if err := adjustTokens(app.db, id, 5, ledgerAdminGrant, 0); err != nil {
+					t.Fatalf("adjustTokens: %v", err)
+				}
+				return id
+			},
+		},
+		{
+			name: "banned",
+			setup: func(t *testing.T, app *App) string {
+				id := newInactiveTestUser(t, app, "-8 days")
+				if _, err := app.db.Exec("UPDATE users SET banned = 1 WHERE id = ?", id); err != nil {
+					t.Fatalf("ban user: %v", err)
+				}
+				return id
+			},
+		},
+		{
+			name: "admin session",
+			setup: func(t *testing.T, app *App) string {
+				user, err := app.createUser(&adminSession{role: roleOperator})
+				if err != nil {
+					t.Fatalf("createUser: %v", err)
+				}
+				ageTestUser(t, app, user.ID, "-8 days")
+				return user.ID
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			id := tt.setup(t, app)
+
+			deleted, err := app.deleteInactiveUsers(7 * 24 * time.Hour)
+			if err != nil {
+				t.Fatalf("deleteInactiveUsers: %v", err)
+			}
+			var wantCount int64
+			if tt.wantDeleted {
+				wantCount = 1
+			}
+			if deleted != wantCount {
+				t.Errorf("deleted %d users, want %d", deleted, wantCount)
+			}
+			var users, entries int
+			if err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", id).Scan(&users); err != nil {
+				t.Fatalf("count users: %v", err)
+			}
+			if err := app.db.QueryRow("SELECT COUNT(*) FROM token_ledger WHERE user_id = ?", id).Scan(&entries); err != nil {
+				t.Fatalf("count ledger entries: %v", err)
+			}
+			if (users == 0) != tt.wantDeleted || (entries == 0) != tt.wantDeleted {
+				t.Errorf("%d users and %d ledger entries are left, want them deleted = %v", users, entries, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+// newInactiveTestUser creates a visitor the way ensureUser does, created at the SQLite
+// datetime modifier age.
+func newInactiveTestUser(t *testing.T, app *App, age string) string {
+	t.Helper()
+	user, err := app.createUser(nil)
+	if err != nil {
+		t.Fatalf("createUser: %v", err)
+	}
+	ageTestUser(t, app, user.ID, age)
+	return user.ID
+}
+
+func ageTestUser(t *testing.T, app *App, id, age string) {
+	t.Helper()
+	if _, err := app.db.Exec("UPDATE users SET created_at = datetime('now', ?) WHERE id = ?", age, id); err != nil {
+		t.Fatalf("age user: %v", err)
+	}
+}
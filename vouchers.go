@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Redeem Codes ---
+// Admins generate batches of codes worth a number of tokens, such as vouchers sold with scare
+// tickets at the gate. Only a hash of each code is stored, so the codes are shown once, when
+// the batch is generated, for printing (see static/vouchers.html). Visitors redeem a code by
+// scanning its QR code, which opens /api/redeem?code=... to confirm it, or by typing it in. Each redemption
+// is recorded in the recharges table with source "redeem". A multi-use code can be redeemed
+// once by each visitor until its uses run out.
+
+const (
+	redeemCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No 0/O or 1/I, which are easy to misread.
+	redeemCodeLength   = 12                                 // Printed in groups of four.
+	maxRedeemBatchSize = 500
+	maxRedeemTokens    = 1000
+)
+
+// errRedeemRefused is returned for codes that can't be redeemed; the message is shown to the
+// visitor.
+type errRedeemRefused struct{ message string }
+
+func (e *errRedeemRefused) Error() string { return e.message }
+
+// normalizeRedeemCode accepts codes typed in any case, with or without dashes and spaces.
+func normalizeRedeemCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func hashRedeemCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRedeemCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRedeemCode returns a random code formatted as XXXX-XXXX-XXXX.
+func newRedeemCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < redeemCodeLength; i++ {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(redeemCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(redeemCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// redeemBatch summarises one generated batch for the admin page.
+type redeemBatch struct {
+	Batch     string    `json:"batch"`
+	Label     string    `json:"label,omitempty"`
+	Tokens    int       `json:"tokens"`
+	MaxUses   int       `json:"max_uses"`
+	Codes     int       `json:"codes"`
+	Uses      int       `json:"uses"`
+	Revoked   bool      `json:"revoked"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// redeemCode adds a code's tokens to a user's balance. It returns the number of tokens added.
+// A visitor created by newVisitor is stored as a new user, but only once the code is known to
+// be good, so invalid codes don't add users; the caller signs them in.
+func (app *App) redeemCode(user *User, code string) (int, error) {
+	if user.IsAdmin {
+		return 0, &errRedeemRefused{"Admins have unlimited tokens; keep the code for a visitor."}
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var tokens int
+	var revoked bool
+	err = tx.QueryRow("SELECT id, tokens, revoked FROM redeem_codes WHERE code_hash = ?", hashRedeemCode(code)).Scan(&id, &tokens, &revoked)
+	if errors.Is(err, sql.ErrNoRows) || revoked {
+		return 0, &errRedeemRefused{"That code isn't valid."}
+	}
+	if err != nil {
+		return 0, err
+	}
+	redeemer := user
+	if user.ID == "" {
+		if redeemer, err = app.insertUser(tx, nil); err != nil {
+			return 0, err
+		}
+	}
+	var redeemed bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM recharges WHERE user_id = ? AND code_id = ?)", redeemer.ID, id).Scan(&redeemed); err != nil {
+		return 0, err
+	}
+	if redeemed {
+		return 0, &errRedeemRefused{"You've already redeemed this code."}
+	}
+
+	// The use count is checked by the update itself, so a code can't be over-redeemed by
+	// parallel requests.
+	res, err := tx.Exec("UPDATE redeem_codes SET uses = uses + 1 WHERE id = ? AND uses < max_uses", id)
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return 0, &errRedeemRefused{"That code has already been used."}
+	}
+	if err := adjustTokens(tx, redeemer.ID, tokens, ledgerRedeem, 0); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT INTO recharges (user_id, source, code_id) VALUES (?, 'redeem', ?)", redeemer.ID, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	redeemer.TokensRemaining += tokens
+	*user = *redeemer
+	return tokens, nil
+}
+
+// redeemHandler redeems a code. GET is what a scanned QR code opens: it only shows a page with
+// a button that posts the code, so link previews and prefetches can't use it up. POST takes
+// that form and redirects to the dashboard, or shows a page explaining why the code didn't
+// work; or it takes {"code": "..."} and answers with JSON.
+func (app *App) redeemHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userContextKey).(*User)
+		if !ok {
+			http.Error(w, "Could not identify user", http.StatusInternalServerError)
+			return
+		}
+
+		var code string
+		isForm := false
+		switch {
+		case r.Method == http.MethodGet:
+			app.renderRedeemPage(w, r.URL.Query().Get("code"))
+			return
+		case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded"):
+			code = r.FormValue("code")
+			isForm = true
+		case r.Method == http.MethodPost:
+			var payload struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			code = payload.Code
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		isNew := user.ID == ""
+		tokens, err := app.redeemCode(user, code)
+		var refused *errRedeemRefused
+		switch {
+		case errors.As(err, &refused):
+			if isForm {
+				app.renderInfoPage(w, http.StatusBadRequest, "Code Not Redeemed", refused.message)
+			} else {
+				http.Error(w, refused.message, http.StatusBadRequest)
+			}
+			return
+		case err != nil:
+			log.Printf("ERROR: could not redeem code for user %s: %v", user.ID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if isNew {
+			if err := app.setUserCookie(w, r, user.ID); err != nil {
+				log.Printf("ERROR: could not sign in new user %s: %v", user.ID, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("New user created: ID=%s, Tokens=%d", user.ID, user.TokensRemaining-tokens)
+		}
+		log.Printf("User %s redeemed a code worth %d tokens.", user.ID, tokens)
+		if isForm {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"tokens_added": tokens, "tokens_remaining": user.TokensRemaining})
+	}
+}
+
+// renderRedeemPage asks a visitor who scanned a voucher to confirm redeeming its code.
+func (app *App) renderRedeemPage(w http.ResponseWriter, code string) {
+	if strings.TrimSpace(code) == "" {
+		app.renderInfoPage(w, http.StatusBadRequest, "Code Not Redeemed", "This link doesn't include a code. You can type the code in on the dashboard when you run out of tokens.")
+		return
+	}
+	escaped := html.EscapeString(code)
+	form := fmt.Sprintf(`<p>Redeem code <strong>%s</strong>?</p>
+		<form method="post" action="/api/redeem">
+			<input type="hidden" name="code" value="%s">
+			<button type="submit" style="background-color: #e67e22; color: #121212; border: none; border-radius: 4px; padding: 0.75rem 1.5rem; font-size: 1rem; cursor: pointer;">Redeem</button>
+		</form>`, escaped, escaped)
+	app.renderInfoPage(w, http.StatusOK, "Redeem Code", form)
+}
+
+// generateRedeemCodes creates a batch of codes and returns them. This is the only time the
+// codes themselves are available.
+func (app *App) generateRedeemCodes(user *User, count, tokens, maxUses int, label string) (string, []string, error) {
+	suffix := make([]byte, 2)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", nil, err
+	}
+	batch := time.Now().UTC().Format("20060102-150405-") + hex.EncodeToString(suffix)
+	codes := make([]string, 0, count)
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+	for len(codes) < count {
+		code, err := newRedeemCode()
+		if err != nil {
+			return "", nil, err
+		}
+		// A collision is practically impossible, but the unique index would catch it.
+		res, err := tx.Exec(`INSERT INTO redeem_codes (code_hash, batch, label, tokens, max_uses, created_by)
+			VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT(code_hash) DO NOTHING`, hashRedeemCode(code), batch, label, tokens, maxUses, user.actor())
+		if err != nil {
+			return "", nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			codes = append(codes, code)
+		}
+	}
+	details := map[string]interface{}{"count": count, "tokens": tokens, "max_uses": maxUses, "label": label}
+	if err := recordAudit(tx, user.actor(), "redeem_codes.generate", batch, details); err != nil {
+		return "", nil, err
+	}
+	return batch, codes, tx.Commit()
+}
+
+func (app *App) listRedeemBatches() ([]redeemBatch, error) {
+	rows, err := app.db.Query(`
+		SELECT batch, COALESCE(label, ''), tokens, max_uses, COUNT(*), SUM(uses), MAX(revoked), MIN(created_at), created_by
+		FROM redeem_codes
+		GROUP BY batch
+		ORDER BY MIN(id) DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []redeemBatch{}
+	for rows.Next() {
+		var b redeemBatch
+		var createdAt string
+		if err := rows.Scan(&b.Batch, &b.Label, &b.Tokens, &b.MaxUses, &b.Codes, &b.Uses, &b.Revoked, &createdAt, &b.CreatedBy); err != nil {
+			return nil, err
+		}
+		b.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// adminRedeemCodesHandler lists batches (GET), generates a batch (POST) and revokes the unused
+// codes of a batch (DELETE /api/admin/redeem-codes/{batch}).
+func (app *App) adminRedeemCodesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireRole(w, r, writeRole(r, roleOperator))
+		if !ok {
+			return
+		}
+
+		batch := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/redeem-codes"), "/")
+		switch {
+		case batch == "" && r.Method == http.MethodGet:
+			batches, err := app.listRedeemBatches()
+			if err != nil {
+				log.Printf("ERROR: could not list redeem codes: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batches)
+		case batch == "" && r.Method == http.MethodPost:
+			var payload struct {
+				Count   int    `json:"count"`
+				Tokens  int    `json:"tokens"`
+				MaxUses int    `json:"max_uses"`
+				Label   string `json:"label"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if payload.MaxUses == 0 {
+				payload.MaxUses = 1
+			}
+			switch {
+			case payload.Count < 1 || payload.Count > maxRedeemBatchSize:
+				http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxRedeemBatchSize), http.StatusBadRequest)
+				return
+			case payload.Tokens < 1 || payload.Tokens > maxRedeemTokens:
+				http.Error(w, fmt.Sprintf("tokens must be between 1 and %d", maxRedeemTokens), http.StatusBadRequest)
+				return
+			case payload.MaxUses < 1:
+				http.Error(w, "max_uses must be at least 1", http.StatusBadRequest)
+				return
+			}
+
+			batchID, codes, err := app.generateRedeemCodes(user, payload.Count, payload.Tokens, payload.MaxUses, payload.Label)
+			if err != nil {
+				log.Printf("ERROR: could not generate redeem codes: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Admin %s generated %d redeem codes worth %d tokens (batch %s).", user.actor(), len(codes), payload.Tokens, batchID)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"batch": batchID, "tokens": payload.Tokens, "max_uses": payload.MaxUses, "codes": codes})
+		case batch != "" && r.Method == http.MethodDelete:
+			tx, err := app.db.Begin()
+			if err != nil {
+				log.Printf("ERROR: could not begin transaction: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			res, err := tx.Exec("UPDATE redeem_codes SET revoked = 1 WHERE batch = ?", batch)
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 0 {
+					http.Error(w, "Batch not found", http.StatusNotFound)
+					return
+				}
+				err = recordAudit(tx, user.actor(), "redeem_codes.revoke", batch, nil)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				log.Printf("ERROR: could not revoke redeem codes: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
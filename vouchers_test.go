@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRedeemCreatesUserOnlyOnSuccess checks that a visitor without a user cookie is only stored,
+// and signed in, when their code is actually redeemed.
+func TestRedeemCreatesUserOnlyOnSuccess(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      func(app *App, codes []string) string
+		wantCode  int
+		wantUsers int // Besides the one who used the code up
+	}{
+		{
+			name:      "valid code",
+			code:      func(app *App, codes []string) string { return codes[1] },
+			wantCode:  http.StatusOK,
+			wantUsers: 1,
+		},
+		{
+			name:     "unknown code",
+			code:     func(app *App, codes []string) string { return "AAAA-BBBB-CCCC" },
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "used up code",
+			code:     func(app *App, codes []string) string { return codes[0] },
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "revoked code",
+			code: func(app *App, codes []string) string {
+				if _, err := app.db.Exec("UPDATE redeem_codes SET revoked = 1"); err != nil {
+					t.Fatalf("revoke codes: %v", err)
+				}
+				return codes[1]
+			},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, nil)
+			app.settings.DefaultTokens = 10
+			if err := app.loadSessionKeys(); err != nil {
+				t.Fatalf("loadSessionKeys: %v", err)
+			}
+			_, codes, err := app.generateRedeemCodes(&User{ID: "admin", IsAdmin: true}, 2, 5, 1, "")
+			if err != nil {
+				t.Fatalf("generateRedeemCodes: %v", err)
+			}
+			other, err := app.createUser(nil)
+			if err != nil {
+				t.Fatalf("createUser: %v", err)
+			}
+			if _, err := app.redeemCode(other, codes[0]); err != nil {
+				t.Fatalf("redeem the first code: %v", err)
+			}
+
+			visitor := app.newVisitor()
+			rec := httptest.NewRecorder()
+			app.redeemHandler()(rec, requestAs(visitor, http.MethodPost, "/api/redeem", `{"code": "`+tt.code(app, codes)+`"}`))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			var users int
+			if err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE id != ?", other.ID).Scan(&users); err != nil {
+				t.Fatalf("count users: %v", err)
+			}
+			if users != tt.wantUsers {
+				t.Errorf("%d users were created, want %d", users, tt.wantUsers)
+			}
+			signedIn := len(rec.Result().Cookies()) > 0
+			if signedIn != (tt.wantUsers > 0) {
+				t.Errorf("signed in = %v, want %v", signedIn, tt.wantUsers > 0)
+			}
+			if tt.wantUsers > 0 {
+				var tokens int
+				if err := app.db.QueryRow("SELECT tokens_remaining FROM users WHERE id = ?", visitor.ID).Scan(&tokens); err != nil {
+					t.Fatalf("read new user: %v", err)
+				}
+				if tokens != 15 || visitor.TokensRemaining != 15 {
+					t.Errorf("balance = %d (visitor %d), want 15", tokens, visitor.TokensRemaining)
+				}
+			}
+		})
+	}
+}
+
+// TestRedeemLinkNeedsConfirmation checks that opening a voucher link only shows a form, and
+// that posting the form redeems the code and goes to the dashboard.
+func TestRedeemLinkNeedsConfirmation(t *testing.T) {
+	app := newTestApp(t, nil)
+	if err := app.loadSessionKeys(); err != nil {
+		t.Fatalf("loadSessionKeys: %v", err)
+	}
+	_, codes, err := app.generateRedeemCodes(&User{ID: "admin", IsAdmin: true}, 1, 5, 1, "")
+	if err != nil {
+		t.Fatalf("generateRedeemCodes: %v", err)
+	}
+	countUses := func() (users, uses int) {
+		if err := app.db.QueryRow("SELECT (SELECT COUNT(*) FROM users), (SELECT SUM(uses) FROM redeem_codes)").Scan(&users, &uses); err != nil {
+			t.Fatalf("count uses: %v", err)
+		}
+		return users, uses
+	}
+
+	rec := httptest.NewRecorder()
+	app.redeemHandler()(rec, requestAs(app.newVisitor(), http.MethodGet, "/api/redeem?code="+url.QueryEscape(codes[0]), ""))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post" action="/api/redeem">`) ||
+		!strings.Contains(rec.Body.String(), `value="`+codes[0]+`"`) {
+		t.Fatalf("GET answered %d without a form for the code: %s", rec.Code, rec.Body)
+	}
+	if users, uses := countUses(); users != 0 || uses != 0 {
+		t.Fatalf("GET created %d users and used the code %d times, want neither", users, uses)
+	}
+
+	req := requestAs(app.newVisitor(), http.MethodPost, "/api/redeem", url.Values{"code": {codes[0]}}.Encode())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	app.redeemHandler()(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("form POST answered %d to %q, want a redirect to /: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	if users, uses := countUses(); users != 1 || uses != 1 {
+		t.Errorf("form POST created %d users and used the code %d times, want 1 and 1", users, uses)
+	}
+}
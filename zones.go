@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Zones ---
+// Triggers can be grouped by the maze zone they are in ("Graveyard", "Crypt", ...). The
+// dashboard shows one section per zone, and admins can close a whole zone while actors reset
+// props: its triggers stay visible, with the reason, but can't be activated (see availability.go).
+
+// triggerColorPattern is the format accepted for a trigger's "color".
+var triggerColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+const maxTriggerIconLength = 16 // Room for an emoji sequence or a short label.
+
+// publicZone is one group of triggers in the /api/triggers response.
+type publicZone struct {
+	Name     string          `json:"name"` // Empty for triggers without a zone
+	Disabled bool            `json:"disabled,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Triggers []publicTrigger `json:"triggers"`
+}
+
+// groupTriggers groups the triggers for which include returns true by zone, with their current
+// availability, in display order (see sortTriggers). Zones appear in the order of their first
+// trigger.
+func (app *App) groupTriggers(include func(*Trigger) bool) []publicZone {
+	triggers := make([]*Trigger, 0, len(app.config.Triggers))
+	for i := range app.config.Triggers {
+		if include(&app.config.Triggers[i]) {
+			triggers = append(triggers, &app.config.Triggers[i])
+		}
+	}
+	sortTriggers(triggers)
+
+	now := time.Now()
+	zones := []publicZone{}
+	index := make(map[string]int)
+	for _, t := range triggers {
+		i, ok := index[t.Zone]
+		if !ok {
+			state := app.zones[t.Zone]
+			i = len(zones)
+			index[t.Zone] = i
+			zones = append(zones, publicZone{Name: t.Zone, Disabled: state.Disabled, Reason: state.Reason})
+		}
+		p := t.public()
+		if s := app.triggerStates[t.ID]; s.Disabled {
+			p.Disabled, p.Reason = true, s.Reason
+		}
+		if open, next := t.availableAt(now); !open {
+			p.OutsideHours = true
+			if !next.IsZero() {
+				p.NextAvailableAt = &next
+			}
+		}
+		zones[i].Triggers = append(zones[i].Triggers, p)
+	}
+	return zones
+}
+
+// sortTriggers puts merged triggers in display order: those ordered on the Manage Triggers
+// page first, in that order, then the rest by "order" (ties keep the configured order).
+func sortTriggers(triggers []*Trigger) {
+	sort.SliceStable(triggers, func(i, j int) bool {
+		if triggers[i].positioned || triggers[j].positioned {
+			return triggers[i].positioned && !triggers[j].positioned // Already in position order
+		}
+		return triggers[i].Order < triggers[j].Order
+	})
+}
+
+// adminZoneView is a zone as listed for admins.
+type adminZoneView struct {
+	Name         string `json:"name"`
+	TriggerCount int    `json:"trigger_count"`
+	offlineState
+}
+
+func (app *App) adminZonesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireRole(w, r, writeRole(r, roleOperator))
+		if !ok {
+			return
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/zones"), "/")
+		switch {
+		case name == "" && r.Method == http.MethodGet:
+			app.configMutex.RLock()
+			views := []adminZoneView{}
+			index := make(map[string]int)
+			for _, t := range app.config.Triggers {
+				if t.Zone == "" {
+					continue
+				}
+				if i, ok := index[t.Zone]; ok {
+					views[i].TriggerCount++
+					continue
+				}
+				index[t.Zone] = len(views)
+				views = append(views, adminZoneView{Name: t.Zone, TriggerCount: 1, offlineState: app.zones[t.Zone]})
+			}
+			app.configMutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(views)
+		case name != "" && r.Method == http.MethodPatch:
+			payload, ok := decodeOfflinePayload(r)
+			if !ok {
+				http.Error(w, `Expected {"disabled": true|false, "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			action := "zone.open"
+			if *payload.Disabled {
+				action = "zone.close"
+			}
+			app.configMutex.Lock()
+			defer app.configMutex.Unlock()
+			if err := app.saveOfflineState(user, "zones", "name", name, action, app.zones, *payload.Disabled, payload.Reason); err != nil {
+				log.Printf("ERROR: could not update zone '%s': %v", name, err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}